@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-url-shortener/storage"
+)
+
+// runBackup implements the backup subcommand for SQLite databases. It can
+// run against a database the server is using.
+//
+//	backup [--db-path urls.db] --dir backups [--keep 7] [create]
+//	backup --dir backups list
+func runBackup(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dbPath := flags.String("db-path", "urls.db", "Path to SQLite database")
+	dir := flags.String("dir", "", "Directory for backups")
+	keep := flags.Int("keep", storage.DefaultBackupKeep, "Number of newest backups to keep (0 keeps all)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	action := "create"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args()[1:], " "))
+	}
+	if *dir == "" {
+		return errors.New("--dir is required")
+	}
+
+	switch action {
+	case "create":
+		ctx, cancel := interruptContext()
+		defer cancel()
+
+		backup, err := storage.BackupDatabase(ctx, *dbPath, storage.BackupOptions{Dir: *dir, Keep: *keep})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created %s (%d bytes, sha256 %s)\n", backup.Path, backup.Size, backup.SHA256)
+		return nil
+
+	case "list":
+		backups, err := storage.ListBackups(*dir)
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			fmt.Fprintln(out, "No backups")
+		}
+		for _, backup := range backups {
+			fmt.Fprintf(out, "%s  %s  %10d  %s\n", backup.CreatedAt.Format(time.RFC3339), backup.Name, backup.Size, backup.SHA256)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown backup action %q (want create or list)", action)
+	}
+}
+
+// runRestore implements the restore subcommand. It picks the newest backup
+// taken at or before --at (or a named --backup), verifies it and swaps it in.
+// The server must be stopped while it runs.
+//
+//	restore [--db-path urls.db] --dir backups [--at 2024-03-01T12:00:00Z | --backup name]
+func runRestore(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dbPath := flags.String("db-path", "urls.db", "Path to SQLite database to replace")
+	dir := flags.String("dir", "", "Directory for backups")
+	at := flags.String("at", "", "Restore the newest backup taken at or before this RFC 3339 time (default newest)")
+	name := flags.String("backup", "", "Restore this backup file instead, by name within --dir or by path")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if *name != "" && *at != "" {
+		return errors.New("--at and --backup cannot be used together")
+	}
+
+	path := *name
+	if path != "" && *dir != "" && !strings.ContainsRune(path, filepath.Separator) {
+		path = filepath.Join(*dir, path)
+	}
+	if path == "" {
+		if *dir == "" {
+			return errors.New("--dir or --backup is required")
+		}
+		var when time.Time
+		if *at != "" {
+			var err error
+			if when, err = time.Parse(time.RFC3339, *at); err != nil {
+				return fmt.Errorf("invalid --at: %w", err)
+			}
+		}
+		backup, err := storage.FindBackup(*dir, when)
+		if err != nil {
+			return err
+		}
+		path = backup.Path
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	_, err := os.Stat(*dbPath)
+	replaced := err == nil
+
+	fmt.Fprintf(out, "Verifying %s\n", path)
+	if err := storage.RestoreBackup(ctx, path, *dbPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Restored %s to %s\n", path, *dbPath)
+	if replaced {
+		fmt.Fprintf(out, "The previous database was kept as %s.pre-restore\n", *dbPath)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Package geoip resolves client addresses to a country and city using a local
+// MaxMind-format (.mmdb) database, such as GeoLite2-City, without calling any
+// remote service.
+package geoip
+
+import (
+	"net"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is where an address was resolved to. Country is an ISO 3166-1
+// alpha-2 code and City an English name; either may be empty.
+type Location struct {
+	Country string
+	City    string
+}
+
+// record is the subset of a GeoIP2/GeoLite2 City or Country record we read
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// Resolver looks addresses up in an mmdb file that can be reloaded in place
+type Resolver struct {
+	path string
+
+	mutex  sync.RWMutex
+	reader *maxminddb.Reader
+}
+
+// Open loads the database at path
+func Open(path string) (*Resolver, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{path: path, reader: reader}, nil
+}
+
+// Lookup returns the location of ip, or an empty Location when the
+// address is invalid or not in the database
+func (r *Resolver) Lookup(ip net.IP) Location {
+	if ip == nil {
+		return Location{}
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var found record
+	if err := r.reader.Lookup(ip, &found); err != nil {
+		return Location{}
+	}
+	return Location{Country: found.Country.ISOCode, City: found.City.Names["en"]}
+}
+
+// Reload reopens the database file, for example after it has been replaced
+// with a newer release. The old database keeps serving if the new one
+// cannot be opened.
+func (r *Resolver) Reload() error {
+	reader, err := maxminddb.Open(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	old := r.reader
+	r.reader = reader
+	r.mutex.Unlock()
+
+	return old.Close()
+}
+
+// Close releases the database
+func (r *Resolver) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reader.Close()
+}
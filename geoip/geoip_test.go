@@ -0,0 +1,114 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// writeFixture generates a small City database mapping each network to a
+// country code and, when not empty, a city name. Like a real update, it
+// replaces path by renaming, since open databases are memory-mapped.
+func writeFixture(t *testing.T, path string, networks map[string][2]string) {
+	t.Helper()
+
+	tree, err := mmdbwriter.New(mmdbwriter.Options{
+		DatabaseType:            "GeoLite2-City",
+		RecordSize:              24,
+		IncludeReservedNetworks: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create fixture: %v", err)
+	}
+
+	for cidr, location := range networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("Invalid fixture network %s: %v", cidr, err)
+		}
+		data := mmdbtype.Map{
+			"country": mmdbtype.Map{"iso_code": mmdbtype.String(location[0])},
+		}
+		if location[1] != "" {
+			data["city"] = mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String(location[1])}}
+		}
+		if err := tree.Insert(network, data); err != nil {
+			t.Fatalf("Failed to insert %s: %v", cidr, err)
+		}
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "fixture-*.mmdb")
+	if err != nil {
+		t.Fatalf("Failed to create fixture file: %v", err)
+	}
+	if _, err := tree.WriteTo(file); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		t.Fatalf("Failed to replace fixture: %v", err)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	writeFixture(t, path, map[string][2]string{
+		"203.0.113.0/24":  {"DE", "Berlin"},
+		"2001:db8::/32":   {"JP", "Tokyo"},
+		"198.51.100.0/24": {"FR", ""},
+	})
+
+	resolver, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer resolver.Close()
+
+	tests := map[string]Location{
+		"203.0.113.57":       {Country: "DE", City: "Berlin"},
+		"2001:db8:abcd::1":   {Country: "JP", City: "Tokyo"},
+		"198.51.100.1":       {Country: "FR"},
+		"192.0.2.1":          {},
+		"::ffff:203.0.113.9": {Country: "DE", City: "Berlin"},
+	}
+	for address, expected := range tests {
+		if got := resolver.Lookup(net.ParseIP(address)); got != expected {
+			t.Errorf("Lookup(%s) = %+v, expected %+v", address, got, expected)
+		}
+	}
+	if got := resolver.Lookup(nil); got != (Location{}) {
+		t.Errorf("Expected an empty location for a nil address, got %+v", got)
+	}
+
+	t.Run("reloads a replaced database", func(t *testing.T) {
+		writeFixture(t, path, map[string][2]string{"203.0.113.0/24": {"AT", "Vienna"}})
+		if err := resolver.Reload(); err != nil {
+			t.Fatalf("Failed to reload database: %v", err)
+		}
+		if got := resolver.Lookup(net.ParseIP("203.0.113.57")); got.Country != "AT" || got.City != "Vienna" {
+			t.Errorf("Expected the reloaded location, got %+v", got)
+		}
+	})
+
+	t.Run("keeps serving when the new file is broken", func(t *testing.T) {
+		broken := filepath.Join(t.TempDir(), "broken.mmdb")
+		if err := os.WriteFile(broken, []byte("not a database"), 0o644); err != nil {
+			t.Fatalf("Failed to write broken file: %v", err)
+		}
+		if err := os.Rename(broken, path); err != nil {
+			t.Fatalf("Failed to replace fixture: %v", err)
+		}
+		if err := resolver.Reload(); err == nil {
+			t.Fatal("Expected reloading a broken file to fail")
+		}
+		if got := resolver.Lookup(net.ParseIP("203.0.113.57")); got.Country != "AT" {
+			t.Errorf("Expected the previous database to keep serving, got %+v", got)
+		}
+	})
+}
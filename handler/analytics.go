@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go-url-shortener/storage"
+)
+
+// Default report ranges when from is omitted
+const (
+	defaultHourlyRange = 24 * time.Hour
+	defaultDailyRange  = 30 * 24 * time.Hour
+)
+
+// GetAnalytics returns click counts over time for one link, with breakdowns
+// by referrer domain, browser, operating system, language and country.
+// Query parameters: interval (hour or day), from and to (RFC 3339; to defaults
+// to now and from to 24 hours or 30 days before it), and tz (an IANA zone
+// name that decides where hours and days begin, UTC by default).
+func (h *URLHandler) GetAnalytics(c *gin.Context) {
+	if h.clicks == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Click logging is disabled"})
+		return
+	}
+
+	opts, err := parseAnalyticsOptions(c)
+	if err != nil {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	id := h.linkKey(c)
+	if _, err := h.store.Lookup(ctx, id); err != nil {
+		h.errorCounter.Inc()
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+		} else {
+			h.storeFailure(c, err, "Failed to get URL")
+		}
+		return
+	}
+
+	clicks, err := h.clicks.Store().ListClicks(ctx, id, opts.From, opts.To)
+	if err != nil {
+		h.errorCounter.Inc()
+		h.storeFailure(c, err, "Failed to get clicks")
+		return
+	}
+
+	report, err := storage.Analyze(id, clicks, opts)
+	if err != nil {
+		h.errorCounter.Inc()
+		if err == storage.ErrTooManyBuckets {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid request: range spans more than %d buckets", storage.MaxAnalyticsBuckets)})
+		} else if err == storage.ErrInvalid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to analyze clicks"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// parseAnalyticsOptions reads the report range and bucketing from the query string
+func parseAnalyticsOptions(c *gin.Context) (storage.AnalyticsOptions, error) {
+	opts := storage.AnalyticsOptions{
+		Interval: storage.IntervalDay,
+		Location: time.UTC,
+		To:       time.Now(),
+	}
+
+	switch interval := c.Query("interval"); interval {
+	case "":
+	case storage.IntervalHour, storage.IntervalDay:
+		opts.Interval = interval
+	default:
+		return opts, errors.New("interval must be hour or day")
+	}
+
+	if tz := c.Query("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return opts, errors.New("tz must be an IANA time zone such as Europe/Berlin")
+		}
+		opts.Location = location
+	}
+
+	to, err := parseTimeQuery(c, "to")
+	if err != nil {
+		return opts, err
+	}
+	if to != nil {
+		opts.To = *to
+	}
+
+	from, err := parseTimeQuery(c, "from")
+	if err != nil {
+		return opts, err
+	}
+	switch {
+	case from != nil:
+		opts.From = *from
+	case opts.Interval == storage.IntervalHour:
+		opts.From = opts.To.Add(-defaultHourlyRange)
+	default:
+		opts.From = opts.To.Add(-defaultDailyRange)
+	}
+
+	if !opts.From.Before(opts.To) {
+		return opts, errors.New("from must be before to")
+	}
+	return opts, nil
+}
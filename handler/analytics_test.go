@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go-url-shortener/storage"
+)
+
+func TestGetAnalytics(t *testing.T) {
+	ctx := context.Background()
+	router, handler, store := setupTestEnvironment()
+	defer store.Close()
+
+	t.Run("Click logging disabled", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/urls/anything/analytics", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("Expected status Not Implemented, got %v", w.Code)
+		}
+	})
+
+	ring := storage.NewClickRing(100)
+	clicks := storage.NewClickLog(ring, storage.ClickLogOptions{}, prometheus.NewRegistry())
+	defer clicks.Close()
+	handler.SetClickLog(clicks)
+
+	url, err := store.Create(ctx, "https://example.com/analytics")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	day := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+	ring.RecordClicks(ctx, []storage.Click{
+		{URLID: url.ID, Time: day.Add(9 * time.Hour), Referrer: "https://twitter.com/post", Language: "fr-FR"},
+		{URLID: url.ID, Time: day.Add(9*time.Hour + 30*time.Minute), Referrer: "https://twitter.com/other", Language: "fr"},
+		{URLID: url.ID, Time: day.Add(11 * time.Hour)},
+		{URLID: "someone-else", Time: day.Add(9 * time.Hour)},
+	})
+
+	t.Run("Hourly buckets", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/urls/"+url.ID+"/analytics?interval=hour&from=2024-05-10T09:00:00Z&to=2024-05-10T12:00:00Z&tz=Europe/Paris", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+		}
+
+		var report storage.Analytics
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if report.Total != 3 || report.Timezone != "Europe/Paris" {
+			t.Errorf("Unexpected report: total %d in %s", report.Total, report.Timezone)
+		}
+		expected := []int{2, 0, 1}
+		if len(report.Series) != len(expected) {
+			t.Fatalf("Expected %d buckets, got %d", len(expected), len(report.Series))
+		}
+		for i, bucket := range report.Series {
+			if bucket.Clicks != expected[i] {
+				t.Errorf("Bucket %d: expected %d clicks, got %d", i, expected[i], bucket.Clicks)
+			}
+		}
+		if _, offset := report.Series[0].Start.Zone(); offset != 2*60*60 {
+			t.Errorf("Expected bucket starts in Paris summer time, got offset %d", offset)
+		}
+		if report.Referrers[0].Name != "twitter.com" || report.Referrers[0].Clicks != 2 {
+			t.Errorf("Unexpected referrers: %+v", report.Referrers)
+		}
+		if report.Languages[0].Name != "fr" || report.Languages[0].Clicks != 2 {
+			t.Errorf("Unexpected languages: %+v", report.Languages)
+		}
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		queries := []string{
+			"interval=week",
+			"tz=Mars/Olympus_Mons",
+			"from=yesterday",
+			"from=2024-05-11T00:00:00Z&to=2024-05-10T00:00:00Z",
+			"interval=hour&from=2020-01-01T00:00:00Z&to=2024-01-01T00:00:00Z",
+		}
+		for _, query := range queries {
+			req, _ := http.NewRequest("GET", "/api/urls/"+url.ID+"/analytics?"+query, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status Bad Request, got %v", query, w.Code)
+			}
+		}
+	})
+
+	t.Run("Unknown link", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/urls/nonexistent/analytics", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status Not Found, got %v", w.Code)
+		}
+	})
+}
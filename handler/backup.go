@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go-url-shortener/storage"
+)
+
+// RequireAdmin rejects requests that do not carry the admin token as
+// "Authorization: Bearer <token>". Without a token the admin endpoints are
+// closed entirely.
+func (h *URLHandler) RequireAdmin(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if h.adminToken == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+		h.errorCounter.Inc()
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	c.Next()
+}
+
+// CreateBackup takes an online backup of the database and returns its
+// name, size and checksum. It is not bound by the store timeout, since
+// copying a large database can take a while.
+func (h *URLHandler) CreateBackup(c *gin.Context) {
+	if h.backups == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Backups are not configured"})
+		return
+	}
+
+	backup, err := h.backups.Backup(c.Request.Context(), h.backupOpts)
+	if err != nil {
+		h.errorCounter.Inc()
+		h.storeFailure(c, err, "Failed to create backup")
+		return
+	}
+	c.JSON(http.StatusCreated, backup)
+}
+
+// ListBackups returns the backups in the backup directory, oldest first
+func (h *URLHandler) ListBackups(c *gin.Context) {
+	if h.backups == nil {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Backups are not configured"})
+		return
+	}
+
+	backups, err := storage.ListBackups(h.backupOpts.Dir)
+	if err != nil {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list backups"})
+		return
+	}
+	if backups == nil {
+		backups = []*storage.Backup{}
+	}
+	c.JSON(http.StatusOK, gin.H{"backups": backups})
+}
@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"go-url-shortener/storage"
+)
+
+func TestBackups(t *testing.T) {
+	router, handler, store := setupTestEnvironment()
+	defer store.Close()
+
+	send := func(method, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/api/admin/backups", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Closed without a token", func(t *testing.T) {
+		if w := send("POST", "anything"); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status Unauthorized, got %v", w.Code)
+		}
+	})
+
+	handler.SetAdminToken("secret")
+
+	t.Run("Wrong token", func(t *testing.T) {
+		if w := send("GET", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status Unauthorized, got %v", w.Code)
+		}
+	})
+
+	t.Run("Backups not configured", func(t *testing.T) {
+		if w := send("POST", "secret"); w.Code != http.StatusNotImplemented {
+			t.Errorf("Expected status Not Implemented, got %v", w.Code)
+		}
+	})
+
+	if !storage.SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	sqliteStore, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "urls.db"))
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store: %v", err)
+	}
+	defer sqliteStore.Close()
+	handler.SetBackups(sqliteStore, storage.BackupOptions{Dir: filepath.Join(t.TempDir(), "backups")})
+
+	t.Run("Create and list", func(t *testing.T) {
+		w := send("POST", "secret")
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status Created, got %v: %s", w.Code, w.Body.String())
+		}
+		var created storage.Backup
+		if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+
+		w = send("GET", "secret")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v", w.Code)
+		}
+		var listed struct {
+			Backups []storage.Backup `json:"backups"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if len(listed.Backups) != 1 || listed.Backups[0].Name != created.Name || listed.Backups[0].SHA256 != created.SHA256 {
+			t.Errorf("Expected the created backup to be listed, got %+v", listed.Backups)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-url-shortener/storage"
+)
+
+func TestDomains(t *testing.T) {
+	router, handler, store := setupTestEnvironment()
+	defer store.Close()
+	handler.SetDomains([]string{"go.team.io", "Links.Product.com"}, UnknownHostDefault)
+
+	shorten := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	redirect := func(host, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The same alias on two domains and the default one
+	for _, body := range []string{
+		`{"url":"https://example.com/team","alias":"docs","domain":"go.team.io"}`,
+		`{"url":"https://example.com/product","alias":"docs","domain":"links.product.com"}`,
+		`{"url":"https://example.com/default","alias":"docs"}`,
+	} {
+		if w := shorten(body); w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK for %s, got %v: %s", body, w.Code, w.Body.String())
+		}
+	}
+
+	t.Run("Shorten reports the domain", func(t *testing.T) {
+		w := shorten(`{"url":"https://example.com/generated","domain":"GO.TEAM.IO"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if resp["domain"] != "go.team.io" || resp["id"] == "" {
+			t.Errorf("Expected a code on go.team.io, got %v", resp)
+		}
+	})
+
+	t.Run("Unknown domain", func(t *testing.T) {
+		w := shorten(`{"url":"https://example.com/","domain":"evil.example"}`)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request, got %v", w.Code)
+		}
+	})
+
+	t.Run("Redirects by host", func(t *testing.T) {
+		for host, want := range map[string]string{
+			"go.team.io":             "https://example.com/team",
+			"links.product.com:8080": "https://example.com/product",
+			"localhost:8080":         "https://example.com/default",
+		} {
+			w := redirect(host, "/docs")
+			if w.Code != http.StatusFound || w.Header().Get("Location") != want {
+				t.Errorf("%s: expected a redirect to %s, got %v %s", host, want, w.Code, w.Header().Get("Location"))
+			}
+		}
+	})
+
+	t.Run("API takes a domain parameter", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/urls/docs?domain=links.product.com", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp storage.URL
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if resp.Original != "https://example.com/product" || resp.Domain() != "links.product.com" {
+			t.Errorf("Expected the links.product.com link, got %+v", resp)
+		}
+
+		req, _ = http.NewRequest("GET", "/api/stats?domain=go.team.io", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page storage.ListPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if len(page.URLs) != 2 {
+			t.Errorf("Expected 2 links on go.team.io, got %d", len(page.URLs))
+		}
+		for _, url := range page.URLs {
+			if url.Domain() != "go.team.io" {
+				t.Errorf("Expected only go.team.io links, got %+v", url)
+			}
+		}
+	})
+
+	t.Run("Unknown host rejected", func(t *testing.T) {
+		handler.SetDomains([]string{"go.team.io"}, UnknownHostReject)
+		if w := redirect("localhost", "/docs"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected status Not Found, got %v", w.Code)
+		}
+	})
+
+	t.Run("Unknown host redirected", func(t *testing.T) {
+		handler.SetDomains([]string{"go.team.io"}, "https://www.team.io/")
+		w := redirect("localhost", "/docs")
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "https://www.team.io/" {
+			t.Errorf("Expected a redirect to the fallback, got %v %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+}
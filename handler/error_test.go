@@ -2,11 +2,13 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,23 +18,59 @@ import (
 // mockErrorStore is a Store implementation that returns errors
 type mockErrorStore struct{}
 
-func (s *mockErrorStore) Create(url string) (*storage.URL, error) {
+func (s *mockErrorStore) Create(ctx context.Context, url string, opts ...storage.CreateOption) (*storage.URL, error) {
 	return nil, storage.ErrInvalid
 }
 
-func (s *mockErrorStore) Get(id string) (*storage.URL, error) {
+func (s *mockErrorStore) CreateWithID(ctx context.Context, id, url string, opts ...storage.CreateOption) (*storage.URL, error) {
+	return nil, storage.ErrConflict
+}
+
+func (s *mockErrorStore) Get(ctx context.Context, id string) (*storage.URL, error) {
 	return nil, storage.ErrNotFound
 }
 
-func (s *mockErrorStore) GetStats() ([]*storage.URL, error) {
+func (s *mockErrorStore) Lookup(ctx context.Context, id string) (*storage.URL, error) {
+	return nil, storage.ErrNotFound
+}
+
+func (s *mockErrorStore) Update(ctx context.Context, id, url string, opts ...storage.UpdateOption) (*storage.URL, error) {
+	return nil, errors.New("database error")
+}
+
+func (s *mockErrorStore) SetDetails(ctx context.Context, id string, details storage.Details) (*storage.URL, error) {
+	return nil, errors.New("database error")
+}
+
+func (s *mockErrorStore) SetHealth(ctx context.Context, id string, health storage.Health) error {
+	return errors.New("database error")
+}
+
+func (s *mockErrorStore) Delete(ctx context.Context, id string) error {
+	return errors.New("database error")
+}
+
+func (s *mockErrorStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	return 0, errors.New("database error")
+}
+
+func (s *mockErrorStore) GetStats(ctx context.Context) ([]*storage.URL, error) {
 	return nil, errors.New("database error")
 }
 
-func (s *mockErrorStore) GetTotalCount() (int, error) {
+func (s *mockErrorStore) List(ctx context.Context, opts storage.ListOptions) (*storage.ListPage, error) {
+	return nil, errors.New("database error")
+}
+
+func (s *mockErrorStore) Iterate(ctx context.Context, fn func(*storage.URL) error) error {
+	return errors.New("database error")
+}
+
+func (s *mockErrorStore) GetTotalCount(ctx context.Context) (int, error) {
 	return 0, errors.New("database error")
 }
 
-func (s *mockErrorStore) GetTotalHits() (int, error) {
+func (s *mockErrorStore) GetTotalHits(ctx context.Context) (int, error) {
 	return 0, errors.New("database error")
 }
 
@@ -40,6 +78,16 @@ func (s *mockErrorStore) Close() error {
 	return nil
 }
 
+// blockingStore is a Store whose redirects wait until the context is done
+type blockingStore struct {
+	mockErrorStore
+}
+
+func (s *blockingStore) Get(ctx context.Context, id string) (*storage.URL, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
 // setupErrorTestEnvironment sets up a test environment with a mock error store
 func setupErrorTestEnvironment() *gin.Engine {
 	gin.SetMode(gin.TestMode)
@@ -57,6 +105,9 @@ func setupErrorTestEnvironment() *gin.Engine {
 	// Set up routes
 	router.POST("/api/shorten", handler.Shorten)
 	router.GET("/api/stats", handler.GetStats)
+	router.GET("/api/urls/:id", handler.GetURL)
+	router.PATCH("/api/urls/:id", handler.UpdateURL)
+	router.DELETE("/api/urls/:id", handler.DeleteURL)
 	router.GET("/:id", handler.Redirect)
 	router.GET("/metrics", handler.GetMetrics)
 	
@@ -89,51 +140,130 @@ func TestErrorHandling(t *testing.T) {
 		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
 			t.Fatalf("Failed to parse response: %v", err)
 		}
-		
+
 		if resp.Error == "" {
 			t.Error("Expected error message in response")
 		}
 	})
-	
+
+	t.Run("Handle CreateWithID Conflict", func(t *testing.T) {
+		// Create request with an alias the store reports as taken
+		reqBody := `{"url":"https://example.com/test","alias":"taken"}`
+		req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+
+		// Perform request
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// Assert status code (should be Conflict)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected status Conflict, got %v", w.Code)
+		}
+	})
+
 	t.Run("Handle Get Error", func(t *testing.T) {
 		// Create request for non-existent URL
 		req, _ := http.NewRequest("GET", "/abc123", nil)
-		
+
 		// Perform request
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
-		
+
 		// Assert status code (should be Not Found)
 		if w.Code != http.StatusNotFound {
 			t.Errorf("Expected status Not Found, got %v", w.Code)
 		}
 	})
-	
+
+	t.Run("Handle Lookup Error", func(t *testing.T) {
+		// Create request for non-existent URL
+		req, _ := http.NewRequest("GET", "/api/urls/abc123", nil)
+
+		// Perform request
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// Assert status code (should be Not Found)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status Not Found, got %v", w.Code)
+		}
+	})
+
+	t.Run("Handle Update Error", func(t *testing.T) {
+		// Create request
+		reqBody := `{"url":"https://example.com/updated"}`
+		req, _ := http.NewRequest("PATCH", "/api/urls/abc123", bytes.NewBufferString(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+
+		// Perform request
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// Assert status code (should be Internal Server Error)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status Internal Server Error, got %v", w.Code)
+		}
+	})
+
+	t.Run("Handle Delete Error", func(t *testing.T) {
+		// Create request
+		req, _ := http.NewRequest("DELETE", "/api/urls/abc123", nil)
+
+		// Perform request
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// Assert status code (should be Internal Server Error)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status Internal Server Error, got %v", w.Code)
+		}
+	})
+
 	t.Run("Handle GetStats Error", func(t *testing.T) {
 		// Create request
 		req, _ := http.NewRequest("GET", "/api/stats", nil)
-		
+
 		// Perform request
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
-		
+
 		// Assert status code (should be Internal Server Error)
 		if w.Code != http.StatusInternalServerError {
 			t.Errorf("Expected status Internal Server Error, got %v", w.Code)
 		}
 	})
-	
+
 	t.Run("Handle GetMetrics Error", func(t *testing.T) {
 		// Create request
 		req, _ := http.NewRequest("GET", "/metrics", nil)
-		
+
 		// Perform request
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
-		
+
 		// Assert status code (should be Internal Server Error)
 		if w.Code != http.StatusInternalServerError {
 			t.Errorf("Expected status Internal Server Error, got %v", w.Code)
 		}
 	})
 }
+
+// TestStoreTimeout tests that slow store calls are cut off by the store timeout
+func TestStoreTimeout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+
+	handler := NewURLHandler(&blockingStore{}, prometheus.NewRegistry())
+	handler.SetStoreTimeout(10 * time.Millisecond)
+	router.GET("/:id", handler.Redirect)
+
+	req, _ := http.NewRequest("GET", "/abc123", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// Assert status code (should be Gateway Timeout)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status Gateway Timeout, got %v", w.Code)
+	}
+}
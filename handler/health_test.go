@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+)
+
+func TestListBrokenLinks(t *testing.T) {
+	router, _, store := setupTestEnvironment()
+	defer store.Close()
+
+	ctx := context.Background()
+	store.CreateWithID(ctx, "fine", "https://example.com/fine")
+	store.CreateWithID(ctx, "gone", "https://example.com/gone")
+	store.CreateWithID(ctx, "fresh", "https://example.com/fresh")
+	now := time.Now()
+	store.SetHealth(ctx, "fine", storage.Health{StatusCode: http.StatusOK, CheckedAt: now, LastOKAt: &now})
+	store.SetHealth(ctx, "gone", storage.Health{StatusCode: http.StatusGone, LatencyMS: 35, CheckedAt: now})
+
+	req, _ := http.NewRequest("GET", "/api/urls?health=broken", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+	var page storage.ListPage
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(page.URLs) != 1 || page.URLs[0].ID != "gone" {
+		t.Fatalf("Expected only the broken link, got %+v", page.URLs)
+	}
+	if h := page.URLs[0].Health; h == nil || h.StatusCode != http.StatusGone || h.LatencyMS != 35 {
+		t.Errorf("Expected the check result in the response, got %+v", h)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/urls?health=sick", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status Bad Request for an unknown health, got %v", w.Code)
+	}
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-url-shortener/metadata"
+	"go-url-shortener/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetadataFetcher(t *testing.T) {
+	router, handler, store := setupTestEnvironment()
+	defer store.Close()
+
+	// The destination answers only once the link has been returned, so a
+	// Shorten that waited on the fetch would never return
+	release := make(chan struct{})
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `<html><head><title>Quarterly Report</title><link rel="icon" href="/icon.svg"><meta property="og:image" content="https://cdn.example.com/q3.png"></head></html>`)
+	}))
+	defer destination.Close()
+
+	fetcher := metadata.NewFetcher(store, metadata.Options{AllowPrivate: true}, prometheus.NewRegistry())
+	defer fetcher.Close()
+	handler.SetMetadataFetcher(fetcher)
+
+	body := fmt.Sprintf(`{"url":%q,"alias":"report"}`, destination.URL+"/q3")
+	req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	close(release)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+
+	// The stats API lists the link with what was found on the page
+	var found *storage.URL
+	for deadline := time.Now().Add(5 * time.Second); found == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the metadata")
+		}
+		req, _ := http.NewRequest("GET", "/api/stats", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var page storage.ListPage
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if len(page.URLs) == 1 && page.URLs[0].FaviconURL != "" {
+			found = page.URLs[0]
+		}
+	}
+
+	want := storage.Details{
+		Title:      "Quarterly Report",
+		FaviconURL: destination.URL + "/icon.svg",
+		ImageURL:   "https://cdn.example.com/q3.png",
+	}
+	if found.Title != want.Title || found.FaviconURL != want.FaviconURL || found.ImageURL != want.ImageURL {
+		t.Errorf("Expected %+v, got %+v", want, found.Details)
+	}
+}
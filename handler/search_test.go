@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-url-shortener/storage"
+)
+
+func TestSearch(t *testing.T) {
+	router, _, store := setupTestEnvironment()
+	defer store.Close()
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	search := func(query string) []string {
+		t.Helper()
+		w := send("GET", "/api/search?"+query, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK for %s, got %v: %s", query, w.Code, w.Body.String())
+		}
+		var resp struct {
+			URLs []storage.URL `json:"urls"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		ids := []string{}
+		for _, url := range resp.URLs {
+			ids = append(ids, url.ID)
+		}
+		return ids
+	}
+
+	w := send("POST", "/api/shorten", `{"url":"https://wiki.example.com/handbook","alias":"handbook","title":"Engineering Handbook","tags":["Docs","onboarding"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+	}
+	var created storage.URL
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if created.Title != "Engineering Handbook" || strings.Join(created.Tags, ",") != "docs,onboarding" {
+		t.Errorf("Expected the details in the response, got %+v", created)
+	}
+	send("POST", "/api/shorten", `{"url":"https://example.com/pricing","alias":"pricing","tags":["sales"]}`)
+
+	t.Run("By words and tags", func(t *testing.T) {
+		if ids := search("q=engineering+hand"); strings.Join(ids, ",") != "handbook" {
+			t.Errorf("Expected the handbook, got %v", ids)
+		}
+		if ids := search("tag=sales"); strings.Join(ids, ",") != "pricing" {
+			t.Errorf("Expected the pricing link, got %v", ids)
+		}
+		if ids := search("q=example&tag=docs&tag=onboarding"); strings.Join(ids, ",") != "handbook" {
+			t.Errorf("Expected the handbook, got %v", ids)
+		}
+		if ids := search("q=nothing"); len(ids) != 0 {
+			t.Errorf("Expected no results, got %v", ids)
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		for _, query := range []string{"", "q=+", "q=docs&limit=0"} {
+			if w := send("GET", "/api/search?"+query, ""); w.Code != http.StatusBadRequest {
+				t.Errorf("%q: expected status Bad Request, got %v", query, w.Code)
+			}
+		}
+	})
+
+	t.Run("Edit details", func(t *testing.T) {
+		w := send("PATCH", "/api/urls/pricing", `{"title":"Pricing","tags":["sales","public"]}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v: %s", w.Code, w.Body.String())
+		}
+		var updated storage.URL
+		if err := json.Unmarshal(w.Body.Bytes(), &updated); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if updated.Title != "Pricing" || updated.Original != "https://example.com/pricing" || strings.Join(updated.Tags, ",") != "public,sales" {
+			t.Errorf("Expected only the details to change, got %+v", updated)
+		}
+		if ids := search("tag=public"); strings.Join(ids, ",") != "pricing" {
+			t.Errorf("Expected the new tag to be searchable, got %v", ids)
+		}
+
+		if w := send("PATCH", "/api/urls/pricing", `{}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for an empty update, got %v", w.Code)
+		}
+		long := strings.Repeat("x", maxTitleLength+1)
+		if w := send("PATCH", "/api/urls/pricing", `{"url":"https://example.com/changed","title":"`+long+`"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for a long title, got %v", w.Code)
+		}
+		if w := send("PATCH", "/api/urls/pricing", `{"url":"not-a-url","title":"Other"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request for an invalid URL, got %v", w.Code)
+		}
+		if url, _ := store.Lookup(context.Background(), "pricing"); url.Original != "https://example.com/pricing" || url.Title != "Pricing" {
+			t.Errorf("Expected a rejected update to change nothing, got %+v", url)
+		}
+	})
+}
@@ -1,23 +1,96 @@
 package handler
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go-url-shortener/geoip"
+	"go-url-shortener/metadata"
 	"go-url-shortener/storage"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 // URLHandler manages URL shortening requests
 type URLHandler struct {
-	store            storage.Store
-	redirectCounter  *prometheus.CounterVec
-	shortenCounter   prometheus.Counter
-	errorCounter     prometheus.Counter
+	store           storage.Store
+	storeTimeout    time.Duration
+	dedup           bool
+	clicks          *storage.ClickLog
+	geo             *geoip.Resolver
+	fetcher         *metadata.Fetcher
+	domains         map[string]bool
+	unknownHost     string
+	lowercaseIDs    bool
+	backups         storage.Backuper
+	backupOpts      storage.BackupOptions
+	adminToken      string
+	redirectCounter *prometheus.CounterVec
+	shortenCounter  prometheus.Counter
+	errorCounter    prometheus.Counter
 }
 
 // ShortenRequest represents the request to shorten a URL
 type ShortenRequest struct {
-	URL string `json:"url" binding:"required"`
+	URL       string     `json:"url" binding:"required"`
+	Alias     string     `json:"alias"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+	MaxHits   int        `json:"max_hits"`
+	Dedup     *bool      `json:"dedup"`
+	Domain    string     `json:"domain"`
+
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// UpdateRequest represents the request to change a URL's destination or
+// details; fields that are left out keep their value
+type UpdateRequest struct {
+	URL         string    `json:"url"`
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+}
+
+// Page size limits for /api/stats
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// Limits on the details of a link
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 1000
+	maxTags              = 20
+	maxTagLength         = 50
+)
+
+// aliasPattern restricts custom aliases to URL-safe characters
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,32}$`)
+
+// What Redirect does when the Host header is not one of the configured
+// domains; any other value is a URL to redirect to
+const (
+	UnknownHostDefault = "default"
+	UnknownHostReject  = "reject"
+)
+
+// reservedAliases are path segments that would shadow existing routes
+var reservedAliases = map[string]bool{
+	"api":     true,
+	"metrics": true,
 }
 
 // NewURLHandler creates a new URL handler
@@ -56,6 +129,123 @@ func NewURLHandler(store storage.Store, registry *prometheus.Registry) *URLHandl
 	}
 }
 
+// SetStoreTimeout bounds how long a single request may wait on the store.
+// Zero means requests are only bounded by the client connection.
+func (h *URLHandler) SetStoreTimeout(timeout time.Duration) {
+	h.storeTimeout = timeout
+}
+
+// SetDedup sets whether shortening a URL that already has a matching link
+// returns that link instead of creating another. Requests can override it.
+func (h *URLHandler) SetDedup(dedup bool) {
+	h.dedup = dedup
+}
+
+// SetClickLog records a click event for every successful redirect
+func (h *URLHandler) SetClickLog(clicks *storage.ClickLog) {
+	h.clicks = clicks
+}
+
+// SetGeoIP resolves the country and city of each recorded click
+func (h *URLHandler) SetGeoIP(resolver *geoip.Resolver) {
+	h.geo = resolver
+}
+
+// SetMetadataFetcher fetches the title, description, favicon and image of
+// every new or changed destination in the background
+func (h *URLHandler) SetMetadataFetcher(fetcher *metadata.Fetcher) {
+	h.fetcher = fetcher
+}
+
+// SetDomains namespaces links by the domains they are served from. Redirects
+// on any other host fall back to unknownHost: UnknownHostDefault serves links
+// without a domain, UnknownHostReject answers 404, and anything else is a URL
+// to redirect to. Without domains every host serves the default links.
+func (h *URLHandler) SetDomains(domains []string, unknownHost string) {
+	h.domains = make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		if domain = storage.NormalizeDomain(strings.TrimSpace(domain)); domain != "" {
+			h.domains[domain] = true
+		}
+	}
+	h.unknownHost = unknownHost
+}
+
+// SetLowercaseIDs makes IDs case-insensitive, for ID strategies that only
+// generate lower case: IDs in requests are lower-cased, and so are custom
+// aliases when they are created
+func (h *URLHandler) SetLowercaseIDs(lowercase bool) {
+	h.lowercaseIDs = lowercase
+}
+
+// SetBackups enables the backup endpoints, writing to opts.Dir
+func (h *URLHandler) SetBackups(backuper storage.Backuper, opts storage.BackupOptions) {
+	h.backups = backuper
+	h.backupOpts = opts
+}
+
+// SetAdminToken sets the bearer token the admin endpoints require
+func (h *URLHandler) SetAdminToken(token string) {
+	h.adminToken = token
+}
+
+// storeContext derives the context for store calls from the request, so that
+// store work is abandoned when the client disconnects or the deadline passes
+func (h *URLHandler) storeContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	if h.storeTimeout > 0 {
+		return context.WithTimeout(c.Request.Context(), h.storeTimeout)
+	}
+	return context.WithCancel(c.Request.Context())
+}
+
+// linkID returns the :id parameter, lower-cased when IDs are case-insensitive
+func (h *URLHandler) linkID(c *gin.Context) string {
+	if h.lowercaseIDs {
+		return strings.ToLower(c.Param("id"))
+	}
+	return c.Param("id")
+}
+
+// linkKey returns the store key for the :id parameter on the domain given in
+// the domain query parameter, for the API endpoints
+func (h *URLHandler) linkKey(c *gin.Context) string {
+	return storage.LinkKey(storage.NormalizeDomain(c.Query("domain")), h.linkID(c))
+}
+
+// redirectKey returns the store key for the :id parameter on the request's
+// Host. For an unknown host it applies the fallback, and returns false if that
+// already answered the request.
+func (h *URLHandler) redirectKey(c *gin.Context) (string, bool) {
+	id := h.linkID(c)
+	if len(h.domains) == 0 {
+		return id, true
+	}
+
+	host := storage.NormalizeDomain(c.Request.Host)
+	if h.domains[host] {
+		return storage.LinkKey(host, id), true
+	}
+	switch h.unknownHost {
+	case "", UnknownHostDefault:
+		return id, true
+	case UnknownHostReject:
+		h.errorCounter.Inc()
+		c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+	default:
+		c.Redirect(http.StatusFound, h.unknownHost)
+	}
+	return "", false
+}
+
+// storeFailure reports an unexpected store error, distinguishing timeouts
+func (h *URLHandler) storeFailure(c *gin.Context, err error, message string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Storage timed out"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
 // Shorten handles URL shortening requests
 func (h *URLHandler) Shorten(c *gin.Context) {
 	h.shortenCounter.Inc()
@@ -67,37 +257,136 @@ func (h *URLHandler) Shorten(c *gin.Context) {
 		return
 	}
 
-	url, err := h.store.Create(req.URL)
+	// Resolve expiry from either an absolute time or a TTL
+	var opts []storage.CreateOption
+	if req.ExpiresAt != nil && req.TTL != "" {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify either expires_at or ttl, not both"})
+		return
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			h.errorCounter.Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ttl"})
+			return
+		}
+		opts = append(opts, storage.WithTTL(ttl))
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			h.errorCounter.Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+			return
+		}
+		opts = append(opts, storage.WithExpiry(*req.ExpiresAt))
+	}
+
+	if req.MaxHits < 0 {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_hits must not be negative"})
+		return
+	}
+	if req.MaxHits > 0 {
+		opts = append(opts, storage.WithMaxHits(req.MaxHits))
+	}
+
+	details := storage.Details{Title: req.Title, Description: req.Description, Tags: req.Tags}
+	if problem := validateDetails(details); problem != "" {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+	opts = append(opts, storage.WithDetails(details))
+
+	// Links on a domain live in its own namespace
+	domain := storage.NormalizeDomain(req.Domain)
+	if domain != "" && !h.domains[domain] {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown domain"})
+		return
+	}
+
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	var url *storage.URL
+	var err error
+	if req.Alias != "" {
+		if h.lowercaseIDs {
+			req.Alias = strings.ToLower(req.Alias)
+		}
+		if !aliasPattern.MatchString(req.Alias) {
+			h.errorCounter.Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alias"})
+			return
+		}
+		if reservedAliases[req.Alias] {
+			h.errorCounter.Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Alias is reserved"})
+			return
+		}
+		url, err = h.store.CreateWithID(ctx, storage.LinkKey(domain, req.Alias), req.URL, opts...)
+	} else {
+		// Aliases always get their own link, so only plain creates deduplicate
+		dedup := h.dedup
+		if req.Dedup != nil {
+			dedup = *req.Dedup
+		}
+		if dedup {
+			opts = append(opts, storage.WithDedup())
+		}
+		if domain != "" {
+			opts = append(opts, storage.WithDomain(domain))
+		}
+		url, err = h.store.Create(ctx, req.URL, opts...)
+	}
 	if err != nil {
 		h.errorCounter.Inc()
 		if err == storage.ErrInvalid {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL"})
+		} else if err == storage.ErrConflict {
+			c.JSON(http.StatusConflict, gin.H{"error": "Alias already in use"})
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create shortened URL"})
+			h.storeFailure(c, err, "Failed to create shortened URL")
 		}
 		return
 	}
 
+	if h.fetcher != nil {
+		h.fetcher.Enqueue(url)
+	}
+
 	// Return shortened URL
 	c.JSON(http.StatusOK, url)
 }
 
 // Redirect handles URL redirection
 func (h *URLHandler) Redirect(c *gin.Context) {
-	id := c.Param("id")
-	if id == "" {
+	if c.Param("id") == "" {
 		h.errorCounter.Inc()
 		c.JSON(http.StatusBadRequest, gin.H{"error": "URL ID is required"})
 		return
 	}
+	id, ok := h.redirectKey(c)
+	if !ok {
+		return
+	}
 
-	url, err := h.store.Get(id)
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	url, err := h.store.Get(ctx, id)
 	if err != nil {
 		h.errorCounter.Inc()
 		if err == storage.ErrNotFound {
 			c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+		} else if err == storage.ErrExpired {
+			c.JSON(http.StatusGone, gin.H{"error": "URL expired"})
+		} else if err == storage.ErrExhausted {
+			c.JSON(http.StatusGone, gin.H{"error": "URL exhausted"})
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get URL"})
+			h.storeFailure(c, err, "Failed to get URL")
 		}
 		return
 	}
@@ -105,35 +394,327 @@ func (h *URLHandler) Redirect(c *gin.Context) {
 	// Update metrics
 	h.redirectCounter.With(prometheus.Labels{"url_id": id}).Inc()
 
+	// Record the click; this only queues it, so the redirect never waits
+	if h.clicks != nil {
+		click := storage.Click{
+			URLID:     id,
+			Time:      time.Now(),
+			Referrer:  c.Request.Referer(),
+			UserAgent: c.Request.UserAgent(),
+			Language:  c.GetHeader("Accept-Language"),
+			ClientIP:  anonymizeIP(c.ClientIP()),
+		}
+
+		// Resolve the full address; only the anonymized one is stored
+		if h.geo != nil {
+			location := h.geo.Lookup(net.ParseIP(c.ClientIP()))
+			click.Country, click.City = location.Country, location.City
+		}
+		h.clicks.Record(click)
+	}
+
 	// Redirect to original URL
 	c.Redirect(http.StatusFound, url.Original)
 }
 
-// GetStats returns stats for all URLs
+// anonymizeIP zeroes the host part of a client address, keeping the /24 of
+// an IPv4 address and the /48 of an IPv6 one
+func anonymizeIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// GetURL returns a single URL record without counting a hit
+func (h *URLHandler) GetURL(c *gin.Context) {
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	url, err := h.store.Lookup(ctx, h.linkKey(c))
+	if err != nil {
+		h.errorCounter.Inc()
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+		} else {
+			h.storeFailure(c, err, "Failed to get URL")
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, url)
+}
+
+// UpdateURL changes the destination or details of an existing URL
+func (h *URLHandler) UpdateURL(c *gin.Context) {
+	var req UpdateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	changesDetails := req.Title != nil || req.Description != nil || req.Tags != nil
+	if req.URL == "" && !changesDetails {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+		return
+	}
+
+	// Check the new details before anything is changed
+	var changed storage.Details
+	if req.Title != nil {
+		changed.Title = *req.Title
+	}
+	if req.Description != nil {
+		changed.Description = *req.Description
+	}
+	if req.Tags != nil {
+		changed.Tags = *req.Tags
+	}
+	if problem := validateDetails(changed); problem != "" {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	// The destination and details change together or not at all
+	url, err := h.store.Update(ctx, h.linkKey(c), req.URL, storage.ChangeDetails(storage.DetailsChange{
+		Title:       req.Title,
+		Description: req.Description,
+		Tags:        req.Tags,
+	}))
+	if err != nil {
+		h.errorCounter.Inc()
+		if err == storage.ErrInvalid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL"})
+		} else if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+		} else {
+			h.storeFailure(c, err, "Failed to update URL")
+		}
+		return
+	}
+	if req.URL != "" && h.fetcher != nil {
+		h.fetcher.Enqueue(url)
+	}
+
+	c.JSON(http.StatusOK, url)
+}
+
+// validateDetails checks the details of a link against the length limits and
+// returns the problem, or "" if there is none
+func validateDetails(details storage.Details) string {
+	if utf8.RuneCountInString(details.Title) > maxTitleLength {
+		return fmt.Sprintf("title must be at most %d characters", maxTitleLength)
+	}
+	if utf8.RuneCountInString(details.Description) > maxDescriptionLength {
+		return fmt.Sprintf("description must be at most %d characters", maxDescriptionLength)
+	}
+	tags := storage.NormalizeTags(details.Tags)
+	if len(tags) > maxTags {
+		return fmt.Sprintf("at most %d tags are allowed", maxTags)
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return fmt.Sprintf("tags must be at most %d characters", maxTagLength)
+		}
+	}
+	return ""
+}
+
+// DeleteURL removes a URL
+func (h *URLHandler) DeleteURL(c *gin.Context) {
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	id := h.linkKey(c)
+	if err := h.store.Delete(ctx, id); err != nil {
+		h.errorCounter.Inc()
+		if err == storage.ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "URL not found"})
+		} else {
+			h.storeFailure(c, err, "Failed to delete URL")
+		}
+		return
+	}
+
+	// Clicks kept apart from the store go too, so that an alias created
+	// later under the same ID starts without history
+	if h.clicks != nil {
+		if err := h.clicks.Forget(ctx, id); err != nil {
+			h.storeFailure(c, err, "Failed to delete clicks")
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetStats returns a page of URL stats; it also serves /api/urls.
+// Query parameters: sort (created_at or hits), order (asc or desc), limit, cursor,
+// created_from and created_to (RFC 3339), host (destination host substring),
+// domain (only links served from that domain; empty for the default one)
+// and health (broken, healthy or unchecked).
 func (h *URLHandler) GetStats(c *gin.Context) {
-	urls, err := h.store.GetStats()
+	opts, err := parseListOptions(c)
+	if err != nil {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+		return
+	}
+
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	page, err := h.store.List(ctx, opts)
+	if err != nil {
+		h.errorCounter.Inc()
+		if err == storage.ErrInvalidCursor {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		} else {
+			h.storeFailure(c, err, "Failed to get stats")
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, page)
+}
+
+// Search finds links by free text and tags.
+// Query parameters: q (words matched against the start of words in the
+// destination, title and tags), tag (repeatable; links must have every tag)
+// and limit. Results are newest first.
+func (h *URLHandler) Search(c *gin.Context) {
+	opts := storage.SearchOptions{
+		Query: strings.TrimSpace(c.Query("q")),
+		Tags:  storage.NormalizeTags(c.QueryArray("tag")),
+		Limit: defaultPageSize,
+	}
+	if opts.Query == "" && len(opts.Tags) == 0 {
+		h.errorCounter.Inc()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "q or tag is required"})
+		return
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			h.errorCounter.Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxPageSize)})
+			return
+		}
+		opts.Limit = n
+	}
+
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	urls, err := storage.Search(ctx, h.store, opts)
 	if err != nil {
 		h.errorCounter.Inc()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stats"})
+		h.storeFailure(c, err, "Failed to search URLs")
 		return
 	}
+	if urls == nil {
+		urls = []*storage.URL{}
+	}
 
 	c.JSON(http.StatusOK, gin.H{"urls": urls})
 }
 
+// parseListOptions reads listing options from the query string
+func parseListOptions(c *gin.Context) (storage.ListOptions, error) {
+	opts := storage.ListOptions{
+		SortBy:     storage.SortByCreatedAt,
+		Descending: true,
+		Limit:      defaultPageSize,
+		Cursor:     c.Query("cursor"),
+		Host:       c.Query("host"),
+	}
+	if domain, ok := c.GetQuery("domain"); ok {
+		domain = storage.NormalizeDomain(domain)
+		opts.Domain = &domain
+	}
+
+	switch sortBy := c.Query("sort"); sortBy {
+	case "":
+	case storage.SortByCreatedAt, storage.SortByHits:
+		opts.SortBy = sortBy
+	default:
+		return opts, errors.New("sort must be created_at or hits")
+	}
+
+	switch health := c.Query("health"); health {
+	case "":
+	case storage.HealthBroken, storage.HealthHealthy, storage.HealthUnchecked:
+		opts.Health = health
+	default:
+		return opts, errors.New("health must be broken, healthy or unchecked")
+	}
+
+	switch c.Query("order") {
+	case "", "desc":
+	case "asc":
+		opts.Descending = false
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return opts, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		opts.Limit = n
+	}
+
+	var err error
+	if opts.CreatedFrom, err = parseTimeQuery(c, "created_from"); err != nil {
+		return opts, err
+	}
+	if opts.CreatedTo, err = parseTimeQuery(c, "created_to"); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// parseTimeQuery reads an optional RFC 3339 timestamp from the query string
+func parseTimeQuery(c *gin.Context, param string) (*time.Time, error) {
+	value := c.Query(param)
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 timestamp", param)
+	}
+	return &t, nil
+}
+
 // GetMetrics returns metrics for Prometheus
 func (h *URLHandler) GetMetrics(c *gin.Context) {
-	totalCount, err := h.store.GetTotalCount()
+	ctx, cancel := h.storeContext(c)
+	defer cancel()
+
+	totalCount, err := h.store.GetTotalCount(ctx)
 	if err != nil {
 		h.errorCounter.Inc()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get total count"})
+		h.storeFailure(c, err, "Failed to get total count")
 		return
 	}
 
-	totalHits, err := h.store.GetTotalHits()
+	totalHits, err := h.store.GetTotalHits(ctx)
 	if err != nil {
 		h.errorCounter.Inc()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get total hits"})
+		h.storeFailure(c, err, "Failed to get total hits")
 		return
 	}
 
@@ -2,13 +2,21 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"go-url-shortener/geoip"
 	"go-url-shortener/storage"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -29,6 +37,15 @@ func setupTestEnvironment() (*gin.Engine, *URLHandler, storage.Store) {
 	// Set up routes
 	router.POST("/api/shorten", handler.Shorten)
 	router.GET("/api/stats", handler.GetStats)
+	router.GET("/api/search", handler.Search)
+	router.GET("/api/urls", handler.GetStats)
+	router.GET("/api/urls/:id", handler.GetURL)
+	router.PATCH("/api/urls/:id", handler.UpdateURL)
+	router.DELETE("/api/urls/:id", handler.DeleteURL)
+	router.GET("/api/urls/:id/analytics", handler.GetAnalytics)
+	admin := router.Group("/api/admin", handler.RequireAdmin)
+	admin.POST("/backups", handler.CreateBackup)
+	admin.GET("/backups", handler.ListBackups)
 	router.GET("/:id", handler.Redirect)
 	
 	return router, handler, store
@@ -103,61 +120,503 @@ func TestShorten(t *testing.T) {
 	store.Close()
 }
 
+func TestShortenWithAlias(t *testing.T) {
+	router, _, store := setupTestEnvironment()
+
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"Valid Alias", `{"url":"https://example.com/roadmap","alias":"q3-roadmap"}`, http.StatusOK},
+		{"Duplicate Alias", `{"url":"https://example.com/other","alias":"q3-roadmap"}`, http.StatusConflict},
+		{"Reserved Alias", `{"url":"https://example.com/test","alias":"metrics"}`, http.StatusBadRequest},
+		{"Invalid Characters", `{"url":"https://example.com/test","alias":"bad/alias"}`, http.StatusBadRequest},
+		{"Too Short", `{"url":"https://example.com/test","alias":"ab"}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.expected {
+				t.Errorf("Expected status %v, got %v", tt.expected, w.Code)
+			}
+		})
+	}
+
+	t.Run("Redirect Alias", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/q3-roadmap", nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if location := w.Header().Get("Location"); location != "https://example.com/roadmap" {
+			t.Errorf("Expected redirect location %q, got %q", "https://example.com/roadmap", location)
+		}
+	})
+
+	// Clean up
+	store.Close()
+}
+
+func TestLowercaseIDs(t *testing.T) {
+	router, handler, store := setupTestEnvironment()
+	defer store.Close()
+	handler.SetLowercaseIDs(true)
+
+	if _, err := store.CreateWithID(context.Background(), "abc123", "https://example.com/lower"); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	t.Run("Redirect Any Case", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/ABC123", nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if location := w.Header().Get("Location"); location != "https://example.com/lower" {
+			t.Errorf("Expected redirect location %q, got %q", "https://example.com/lower", location)
+		}
+	})
+
+	t.Run("Alias Stored Lowercase", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(`{"url":"https://example.com/alias","alias":"MyLink"}`))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var resp storage.URL
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if resp.ID != "mylink" {
+			t.Errorf("Expected ID %q, got %q", "mylink", resp.ID)
+		}
+	})
+}
+
+func TestShortenWithDedup(t *testing.T) {
+	router, handler, store := setupTestEnvironment()
+
+	shorten := func(body string) string {
+		req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v", w.Code)
+		}
+		var resp storage.URL
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return resp.ID
+	}
+
+	t.Run("Per Request", func(t *testing.T) {
+		first := shorten(`{"url":"https://example.com/dedup","dedup":true}`)
+		if again := shorten(`{"url":"https://example.com/dedup","dedup":true}`); again != first {
+			t.Errorf("Expected %q to be reused, got %q", first, again)
+		}
+		if plain := shorten(`{"url":"https://example.com/dedup"}`); plain == first {
+			t.Error("Expected a new link without dedup")
+		}
+	})
+
+	t.Run("Same TTL", func(t *testing.T) {
+		first := shorten(`{"url":"https://example.com/dedup-ttl","ttl":"24h","dedup":true}`)
+		if again := shorten(`{"url":"https://example.com/dedup-ttl","ttl":"24h","dedup":true}`); again != first {
+			t.Errorf("Expected %q to be reused, got %q", first, again)
+		}
+		if longer := shorten(`{"url":"https://example.com/dedup-ttl","ttl":"48h","dedup":true}`); longer == first {
+			t.Error("Expected a new link for another ttl")
+		}
+	})
+
+	t.Run("Server Wide", func(t *testing.T) {
+		handler.SetDedup(true)
+		defer handler.SetDedup(false)
+
+		first := shorten(`{"url":"https://example.com/server-dedup"}`)
+		if again := shorten(`{"url":"https://example.com/server-dedup"}`); again != first {
+			t.Errorf("Expected %q to be reused, got %q", first, again)
+		}
+		if optOut := shorten(`{"url":"https://example.com/server-dedup","dedup":false}`); optOut == first {
+			t.Error("Expected a new link when the request opts out")
+		}
+		if alias := shorten(`{"url":"https://example.com/server-dedup","alias":"own-link"}`); alias != "own-link" {
+			t.Errorf("Expected aliases to get their own link, got %q", alias)
+		}
+	})
+
+	// Clean up
+	store.Close()
+}
+
+func TestShortenWithExpiry(t *testing.T) {
+	router, _, store := setupTestEnvironment()
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{"TTL", `{"url":"https://example.com/ttl","ttl":"1h"}`, http.StatusOK},
+		{"Expires At", `{"url":"https://example.com/expires","expires_at":"` + future + `"}`, http.StatusOK},
+		{"Both", `{"url":"https://example.com/both","ttl":"1h","expires_at":"` + future + `"}`, http.StatusBadRequest},
+		{"Invalid TTL", `{"url":"https://example.com/ttl","ttl":"soon"}`, http.StatusBadRequest},
+		{"Negative TTL", `{"url":"https://example.com/ttl","ttl":"-1h"}`, http.StatusBadRequest},
+		{"Past Expiry", `{"url":"https://example.com/past","expires_at":"` + past + `"}`, http.StatusBadRequest},
+		{"Negative Max Hits", `{"url":"https://example.com/once","max_hits":-1}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/api/shorten", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.expected {
+				t.Errorf("Expected status %v, got %v", tt.expected, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp storage.URL
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if resp.ExpiresAt == nil {
+				t.Error("Expected expires_at to be set")
+			}
+		})
+	}
+
+	// Clean up
+	store.Close()
+}
+
 func TestRedirect(t *testing.T) {
+	ctx := context.Background()
 	router, _, store := setupTestEnvironment()
-	
+
 	// Create a URL for testing redirects
-	url, err := store.Create("https://example.com/test-redirect")
+	url, err := store.Create(ctx, "https://example.com/test-redirect")
 	if err != nil {
 		t.Fatalf("Failed to create URL: %v", err)
 	}
-	
+
 	t.Run("Valid Redirect", func(t *testing.T) {
 		// Create request
 		req, _ := http.NewRequest("GET", "/"+url.ID, nil)
-		
+
 		// Perform request
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
-		
+
 		// Assert status code (should be Found/302)
 		if w.Code != http.StatusFound {
 			t.Errorf("Expected status Found, got %v", w.Code)
 		}
-		
+
 		// Check redirect location
 		if location := w.Header().Get("Location"); location != "https://example.com/test-redirect" {
 			t.Errorf("Expected redirect location %q, got %q", "https://example.com/test-redirect", location)
 		}
 	})
-	
+
+	t.Run("Expired URL", func(t *testing.T) {
+		expired, err := store.Create(ctx, "https://example.com/test-expired", storage.WithExpiry(time.Now().Add(-time.Minute)))
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+
+		// Create request
+		req, _ := http.NewRequest("GET", "/"+expired.ID, nil)
+
+		// Perform request
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		// Assert status code (should be Gone)
+		if w.Code != http.StatusGone {
+			t.Errorf("Expected status Gone, got %v", w.Code)
+		}
+	})
+
+	t.Run("Exhausted URL", func(t *testing.T) {
+		once, err := store.Create(ctx, "https://example.com/test-once", storage.WithMaxHits(1))
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+
+		// First visit redirects, second one is refused
+		for _, expected := range []int{http.StatusFound, http.StatusGone} {
+			req, _ := http.NewRequest("GET", "/"+once.ID, nil)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != expected {
+				t.Errorf("Expected status %v, got %v", expected, w.Code)
+			}
+		}
+	})
+
 	t.Run("Non-existent ID", func(t *testing.T) {
 		// Create request with non-existent ID
 		req, _ := http.NewRequest("GET", "/nonexistent", nil)
-		
+
 		// Perform request
 		w := httptest.NewRecorder()
 		router.ServeHTTP(w, req)
-		
+
 		// Assert status code (should be Not Found)
 		if w.Code != http.StatusNotFound {
 			t.Errorf("Expected status Not Found, got %v", w.Code)
 		}
 	})
-	
+
+	// Clean up
+	store.Close()
+}
+
+func TestRedirectRecordsClick(t *testing.T) {
+	ctx := context.Background()
+	router, handler, store := setupTestEnvironment()
+	defer store.Close()
+
+	ring := storage.NewClickRing(10)
+	clicks := storage.NewClickLog(ring, storage.ClickLogOptions{}, prometheus.NewRegistry())
+	handler.SetClickLog(clicks)
+
+	url, err := store.Create(ctx, "https://example.com/clicked")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/"+url.ID, nil)
+	req.Header.Set("Referer", "https://news.example.org/item?id=1")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0")
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+	req.RemoteAddr = "203.0.113.57:41000"
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status Found, got %v", w.Code)
+	}
+
+	// Closing the log writes the queued click
+	clicks.Close()
+
+	recorded, err := ring.ListClicks(ctx, url.ID, time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to list clicks: %v", err)
+	}
+	if len(recorded) != 1 {
+		t.Fatalf("Expected 1 click, got %d", len(recorded))
+	}
+	click := recorded[0]
+	if click.Referrer != "https://news.example.org/item?id=1" || click.Language != "de-DE,de;q=0.9" {
+		t.Errorf("Unexpected click headers: %+v", click)
+	}
+	if click.UserAgent != "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0" {
+		t.Errorf("Unexpected user agent %q", click.UserAgent)
+	}
+	if click.ClientIP != "203.0.113.0" {
+		t.Errorf("Expected anonymized client IP 203.0.113.0, got %q", click.ClientIP)
+	}
+}
+
+func TestRedirectResolvesClickLocation(t *testing.T) {
+	ctx := context.Background()
+	router, handler, store := setupTestEnvironment()
+	defer store.Close()
+
+	// A one-network City database
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoLite2-City", IncludeReservedNetworks: true})
+	if err != nil {
+		t.Fatalf("Failed to create GeoIP fixture: %v", err)
+	}
+	_, network, _ := net.ParseCIDR("203.0.113.0/24")
+	tree.Insert(network, mmdbtype.Map{
+		"country": mmdbtype.Map{"iso_code": mmdbtype.String("NL")},
+		"city":    mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String("Amsterdam")}},
+	})
+	var fixture bytes.Buffer
+	if _, err := tree.WriteTo(&fixture); err != nil {
+		t.Fatalf("Failed to write GeoIP fixture: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "city.mmdb")
+	if err := os.WriteFile(path, fixture.Bytes(), 0o644); err != nil {
+		t.Fatalf("Failed to write GeoIP fixture: %v", err)
+	}
+	resolver, err := geoip.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP fixture: %v", err)
+	}
+	defer resolver.Close()
+
+	ring := storage.NewClickRing(10)
+	clicks := storage.NewClickLog(ring, storage.ClickLogOptions{}, prometheus.NewRegistry())
+	handler.SetClickLog(clicks)
+	handler.SetGeoIP(resolver)
+
+	url, err := store.Create(ctx, "https://example.com/located")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/"+url.ID, nil)
+	req.RemoteAddr = "203.0.113.57:41000"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	clicks.Close()
+
+	recorded, _ := ring.ListClicks(ctx, url.ID, time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if len(recorded) != 1 {
+		t.Fatalf("Expected 1 click, got %d", len(recorded))
+	}
+	if recorded[0].Country != "NL" || recorded[0].City != "Amsterdam" {
+		t.Errorf("Expected click located in Amsterdam, NL, got %q, %q", recorded[0].City, recorded[0].Country)
+	}
+	if recorded[0].ClientIP != "203.0.113.0" {
+		t.Errorf("Expected only the anonymized address to be stored, got %q", recorded[0].ClientIP)
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := map[string]string{
+		"198.51.100.23":       "198.51.100.0",
+		"2001:db8:abcd:12::1": "2001:db8:abcd::",
+		"::ffff:192.0.2.200":  "192.0.2.0",
+		"not an address":      "",
+	}
+	for input, expected := range tests {
+		if got := anonymizeIP(input); got != expected {
+			t.Errorf("anonymizeIP(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
+
+func TestURLCRUD(t *testing.T) {
+	ctx := context.Background()
+	router, _, store := setupTestEnvironment()
+
+	// Create a URL for testing
+	url, err := store.Create(ctx, "https://example.com/test-crud")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	t.Run("Get URL", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/api/urls/"+url.ID, nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status OK, got %v", w.Code)
+		}
+
+		var resp storage.URL
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if resp.Original != "https://example.com/test-crud" {
+			t.Errorf("Expected original URL to be %q, got %q", "https://example.com/test-crud", resp.Original)
+		}
+		if resp.Hits != 0 {
+			t.Errorf("Expected lookup not to count a hit, got %d hits", resp.Hits)
+		}
+	})
+
+	t.Run("Update URL", func(t *testing.T) {
+		reqBody := `{"url":"https://example.com/test-crud-updated"}`
+		req, _ := http.NewRequest("PATCH", "/api/urls/"+url.ID, bytes.NewBufferString(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status OK, got %v", w.Code)
+		}
+
+		// Redirect must follow the new destination
+		req, _ = http.NewRequest("GET", "/"+url.ID, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if location := w.Header().Get("Location"); location != "https://example.com/test-crud-updated" {
+			t.Errorf("Expected redirect location %q, got %q", "https://example.com/test-crud-updated", location)
+		}
+	})
+
+	t.Run("Update Invalid URL", func(t *testing.T) {
+		reqBody := `{"url":"not-a-url"}`
+		req, _ := http.NewRequest("PATCH", "/api/urls/"+url.ID, bytes.NewBufferString(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status Bad Request, got %v", w.Code)
+		}
+	})
+
+	t.Run("Delete URL", func(t *testing.T) {
+		req, _ := http.NewRequest("DELETE", "/api/urls/"+url.ID, nil)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("Expected status No Content, got %v", w.Code)
+		}
+
+		// Deleted URL is gone from every endpoint
+		for _, method := range []string{"GET", "DELETE"} {
+			req, _ := http.NewRequest(method, "/api/urls/"+url.ID, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected status Not Found for %s, got %v", method, w.Code)
+			}
+		}
+	})
+
 	// Clean up
 	store.Close()
 }
 
 func TestGetStats(t *testing.T) {
+	ctx := context.Background()
 	router, _, store := setupTestEnvironment()
 	
 	// Create some URLs for testing
-	url1, _ := store.Create("https://example.com/test-stats-1")
-	url2, _ := store.Create("https://example.com/test-stats-2")
+	url1, _ := store.Create(ctx, "https://example.com/test-stats-1")
+	url2, _ := store.Create(ctx, "https://example.com/test-stats-2")
 	
 	// Increment hits for one URL
-	_, _ = store.Get(url1.ID)
+	_, _ = store.Get(ctx, url1.ID)
 	
 	t.Run("Get Stats", func(t *testing.T) {
 		// Create request
@@ -215,7 +674,50 @@ func TestGetStats(t *testing.T) {
 			t.Error("Second URL not found in stats")
 		}
 	})
-	
+
+	t.Run("Paginate Stats", func(t *testing.T) {
+		// First page holds the newest URL only
+		req, _ := http.NewRequest("GET", "/api/stats?limit=1", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status OK, got %v", w.Code)
+		}
+		var resp storage.ListPage
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if len(resp.URLs) != 1 || resp.NextCursor == "" {
+			t.Fatalf("Expected one URL and a next cursor, got %+v", resp)
+		}
+
+		// Second page holds the other one
+		req, _ = http.NewRequest("GET", "/api/stats?limit=1&cursor="+resp.NextCursor, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var next storage.ListPage
+		if err := json.Unmarshal(w.Body.Bytes(), &next); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if len(next.URLs) != 1 || next.URLs[0].ID == resp.URLs[0].ID || next.NextCursor != "" {
+			t.Errorf("Expected the remaining URL and no cursor, got %+v", next)
+		}
+	})
+
+	t.Run("Invalid Stats Query", func(t *testing.T) {
+		for _, query := range []string{"sort=id", "order=up", "limit=0", "created_from=yesterday", "cursor=bogus"} {
+			req, _ := http.NewRequest("GET", "/api/stats?"+query, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status Bad Request for %q, got %v", query, w.Code)
+			}
+		}
+	})
+
 	// Clean up
 	store.Close()
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go-url-shortener/metadata"
+	"go-url-shortener/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// healthUserAgent identifies the checker to destination servers
+const healthUserAgent = "go-url-shortener/1.0 (link check)"
+
+// healthChecker periodically requests the destination of every live link
+// and records the outcome on the link, so that links to deleted pages are
+// found before someone follows them
+type healthChecker struct {
+	store    storage.Store
+	interval time.Duration
+	workers  int
+	client   *http.Client
+	broken   prometheus.Gauge
+	logger   *zap.Logger
+}
+
+// newHealthChecker creates a checker and registers its metrics. Requests
+// time out after timeout and only go to private addresses if allowPrivate
+// is set; links to them are otherwise left unchecked.
+func newHealthChecker(store storage.Store, interval, timeout time.Duration, workers int, allowPrivate bool, registry *prometheus.Registry, logger *zap.Logger) *healthChecker {
+	broken := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "url_shortener_broken_links",
+			Help: "Number of live links whose destination failed the latest health check",
+		},
+	)
+	registry.MustRegister(broken)
+
+	if workers <= 0 {
+		workers = 1
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = metadata.RefusePrivate
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        workers,
+			IdleConnTimeout:     time.Minute,
+		},
+		Timeout: timeout,
+	}
+
+	return &healthChecker{
+		store:    store,
+		interval: interval,
+		workers:  workers,
+		client:   client,
+		broken:   broken,
+		logger:   logger,
+	}
+}
+
+// run checks at startup and then on every tick until the context is cancelled
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := h.checkOnce(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			h.logger.Error("Failed to check link health", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkOnce checks every link that has not expired or used up its hits and
+// returns how many are broken. Links sharing a destination are checked once.
+func (h *healthChecker) checkOnce(ctx context.Context, now time.Time) (int, error) {
+	links := make(map[string][]*storage.URL)
+	err := h.store.Iterate(ctx, func(link *storage.URL) error {
+		if !link.Expired(now) && !link.Exhausted() {
+			links[link.Original] = append(links[link.Original], link)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var mutex sync.Mutex
+	var saveErr error
+	broken, refused := 0, 0
+
+	var group errgroup.Group
+	group.SetLimit(h.workers)
+	for original, sharing := range links {
+		original, sharing := original, sharing
+		group.Go(func() error {
+			result, checked := h.check(ctx, original)
+			if !checked {
+				mutex.Lock()
+				refused += len(sharing)
+				mutex.Unlock()
+				return nil
+			}
+			for _, link := range sharing {
+				health := result
+				if !health.Broken() {
+					health.LastOKAt = &health.CheckedAt
+				} else if link.Health != nil {
+					health.LastOKAt = link.Health.LastOKAt
+				}
+
+				// A link deleted since the listing has nothing to record
+				if err := h.store.SetHealth(ctx, link.ID, health); err != nil && err != storage.ErrNotFound {
+					mutex.Lock()
+					saveErr = err
+					mutex.Unlock()
+				}
+			}
+
+			if result.Broken() {
+				mutex.Lock()
+				broken += len(sharing)
+				mutex.Unlock()
+			}
+			return nil
+		})
+	}
+	group.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return broken, err
+	}
+	h.broken.Set(float64(broken))
+	h.logger.Info("Checked link health",
+		zap.Int("destinations", len(links)), zap.Int("broken", broken), zap.Int("unchecked", refused))
+	return broken, saveErr
+}
+
+// check requests a destination with HEAD, then with GET if that fails,
+// since some servers reject or mishandle HEAD. It reports false when the
+// destination is in a private network the checker may not reach, which
+// says nothing about whether the link works.
+func (h *healthChecker) check(ctx context.Context, original string) (storage.Health, bool) {
+	health, err := h.request(ctx, http.MethodHead, original)
+	if health.Broken() && !errors.Is(err, metadata.ErrPrivateAddress) {
+		health, err = h.request(ctx, http.MethodGet, original)
+	}
+	return health, !errors.Is(err, metadata.ErrPrivateAddress)
+}
+
+// request sends one request, following redirects, and records the final
+// status and how long it took to arrive, along with the error if it failed
+func (h *healthChecker) request(ctx context.Context, method, original string) (storage.Health, error) {
+	start := time.Now()
+	health := storage.Health{CheckedAt: start}
+
+	req, err := http.NewRequestWithContext(ctx, method, original, nil)
+	if err != nil {
+		health.Error = err.Error()
+		return health, err
+	}
+	req.Header.Set("User-Agent", healthUserAgent)
+
+	resp, err := h.client.Do(req)
+	health.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		// The method and URL are already on the link
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		health.Error = err.Error()
+		return health, err
+	}
+	resp.Body.Close()
+
+	health.StatusCode = resp.StatusCode
+	return health, nil
+}
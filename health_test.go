@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestHealthChecker(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	defer store.Close()
+
+	var heads, gets atomic.Int32
+	var deleted atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		} else {
+			gets.Add(1)
+		}
+		switch r.URL.Path {
+		case "/page":
+			if deleted.Load() {
+				http.NotFound(w, r)
+			}
+		case "/moved":
+			http.Redirect(w, r, "/page", http.StatusMovedPermanently)
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	page, _ := store.CreateWithID(ctx, "page", server.URL+"/page")
+	store.CreateWithID(ctx, "page-again", server.URL+"/page")
+	moved, _ := store.CreateWithID(ctx, "moved", server.URL+"/moved")
+	noHead, _ := store.CreateWithID(ctx, "no-head", server.URL+"/no-head")
+	missing, _ := store.CreateWithID(ctx, "missing", server.URL+"/missing")
+	down, _ := store.CreateWithID(ctx, "down", closed.URL+"/page")
+	expired, _ := store.CreateWithID(ctx, "expired", server.URL+"/missing", storage.WithExpiry(time.Now().Add(-time.Hour)))
+
+	checker := newHealthChecker(store, time.Hour, time.Second, 2, false, prometheus.NewRegistry(), zap.NewNop())
+	checker.client = &http.Client{Timeout: time.Second}
+
+	broken, err := checker.checkOnce(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if broken != 2 {
+		t.Errorf("Expected 2 broken links, got %d", broken)
+	}
+	if got := testutil.ToFloat64(checker.broken); got != 2 {
+		t.Errorf("Expected the broken links gauge to be 2, got %v", got)
+	}
+
+	health := func(id string) *storage.Health {
+		t.Helper()
+		url, err := store.Lookup(ctx, id)
+		if err != nil {
+			t.Fatalf("Failed to look up %s: %v", id, err)
+		}
+		return url.Health
+	}
+	for _, url := range []*storage.URL{page, moved, noHead} {
+		h := health(url.ID)
+		if h == nil || h.StatusCode != http.StatusOK || h.LastOKAt == nil || !h.LastOKAt.Equal(h.CheckedAt) {
+			t.Errorf("Expected %s to be healthy, got %+v", url.ID, h)
+		}
+	}
+	if h := health(missing.ID); h == nil || h.StatusCode != http.StatusNotFound || h.LastOKAt != nil {
+		t.Errorf("Expected missing to be broken with a 404, got %+v", h)
+	}
+	if h := health(down.ID); h == nil || h.StatusCode != 0 || h.Error == "" || strings.Contains(h.Error, closed.URL) {
+		t.Errorf("Expected down to be broken with a connection error, got %+v", h)
+	}
+	if h := health(expired.ID); h != nil {
+		t.Errorf("Expected expired links to be skipped, got %+v", h)
+	}
+
+	// Links sharing a destination are checked once, and GET is only used
+	// when HEAD fails
+	if got := heads.Load(); got != 5 {
+		t.Errorf("Expected 5 HEAD requests, got %d", got)
+	}
+	if got := gets.Load(); got != 2 {
+		t.Errorf("Expected 2 GET requests, got %d", got)
+	}
+
+	// A page that disappears keeps the time it was last seen working
+	lastOK := *health(page.ID).LastOKAt
+	deleted.Store(true)
+	if broken, _ := checker.checkOnce(ctx, time.Now()); broken != 5 {
+		t.Errorf("Expected 5 broken links once the page is deleted, got %d", broken)
+	}
+	if h := health(page.ID); h.StatusCode != http.StatusNotFound || h.LastOKAt == nil || !h.LastOKAt.Equal(lastOK) {
+		t.Errorf("Expected a 404 with the last successful check kept, got %+v", h)
+	}
+
+}
+
+func TestHealthCheckerPrivateDestinations(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	defer store.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	intranet, _ := store.CreateWithID(ctx, "intranet", server.URL+"/wiki")
+
+	// A private destination that may not be checked is not reported broken
+	strict := newHealthChecker(store, time.Hour, time.Second, 1, false, prometheus.NewRegistry(), zap.NewNop())
+	broken, err := strict.checkOnce(ctx, time.Now())
+	if err != nil || broken != 0 {
+		t.Errorf("Expected no broken links, got %d, %v", broken, err)
+	}
+	if got := testutil.ToFloat64(strict.broken); got != 0 {
+		t.Errorf("Expected the broken links gauge to be 0, got %v", got)
+	}
+	if url, _ := store.Lookup(ctx, intranet.ID); url.Health != nil {
+		t.Errorf("Expected the private destination to be left unchecked, got %+v", url.Health)
+	}
+
+	// Allowing private addresses checks it like any other
+	allowing := newHealthChecker(store, time.Hour, time.Second, 1, true, prometheus.NewRegistry(), zap.NewNop())
+	if broken, err := allowing.checkOnce(ctx, time.Now()); err != nil || broken != 0 {
+		t.Errorf("Expected no broken links, got %d, %v", broken, err)
+	}
+	if url, _ := store.Lookup(ctx, intranet.ID); url.Health == nil || url.Health.StatusCode != http.StatusOK {
+		t.Errorf("Expected the private destination to be checked, got %+v", url.Health)
+	}
+}
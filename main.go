@@ -5,12 +5,19 @@ import (
 	"flag"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	// Time zone data for analytics ?tz=, since the runtime image has none
+	_ "time/tzdata"
+
+	"go-url-shortener/geoip"
 	"go-url-shortener/handler"
+	"go-url-shortener/metadata"
 	"go-url-shortener/storage"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +28,43 @@ import (
 )
 
 func main() {
+	// Subcommands come before the server flags
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "migrate:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		if err := runBackup(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "backup:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		if err := runRestore(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "restore:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:], os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "export:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:], os.Stdin, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "import:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Use default args for normal execution
 	runServer(os.Args)
 }
@@ -36,8 +80,42 @@ func runServer(args []string) {
 	// Parse command-line flags
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	port := flag.Int("port", 8080, "Port to listen on")
-	dbType := flag.String("db", "memory", "Database type (memory or sqlite)")
-	dbPath := flag.String("db-path", "urls.db", "Path to SQLite database (only for sqlite)")
+	dbType := flag.String("db", "memory", "Database type (memory, sqlite, bolt, postgres or redis)")
+	dbPath := flag.String("db-path", "urls.db", "Path to SQLite or bbolt database file (only for sqlite and bolt)")
+	memoryDir := flag.String("memory-dir", "", "Directory for the memory store's snapshot and write-ahead log (only for memory, empty keeps data in memory only)")
+	memorySync := flag.String("memory-sync", storage.SyncInterval, "When the memory store's write-ahead log is fsynced (always, interval or never)")
+	memorySnapshotInterval := flag.Duration("memory-snapshot-interval", storage.DefaultSnapshotInterval, "How often the memory store compacts its write-ahead log into a snapshot")
+	dbDSN := flag.String("db-dsn", "", "PostgreSQL or Redis connection URL (only for postgres and redis)")
+	dbMaxConns := flag.Int("db-max-conns", 10, "Maximum open database connections (only for postgres)")
+	idStrategy := flag.String("id-strategy", "base62", "Short ID strategy (base62, unambiguous, lowercase, words or hash)")
+	dedup := flag.Bool("dedup", false, "Return the existing link when a URL is shortened again (requests can override with \"dedup\")")
+	idLength := flag.Int("id-length", storage.DefaultIDLength, "Starting length of generated short IDs")
+	reapInterval := flag.Duration("reap-interval", time.Minute, "How often expired URLs are purged")
+	storeTimeout := flag.Duration("store-timeout", 5*time.Second, "Maximum time a request may wait on storage (0 disables)")
+	hitFlushInterval := flag.Duration("hit-flush-interval", storage.DefaultHitFlushInterval, "How often buffered hits are written (only for sqlite, 0 writes every hit immediately)")
+	hitFlushSize := flag.Int("hit-flush-size", storage.DefaultHitFlushSize, "Number of buffered hits that triggers an early write (only for sqlite)")
+	cacheSize := flag.Int("cache-size", 0, "Number of short IDs to cache for redirects (0 disables the cache)")
+	cacheTTL := flag.Duration("cache-ttl", storage.DefaultCacheTTL, "How long cached redirects are served before the store is read again")
+	expiredRetention := flag.Duration("expired-retention", 24*time.Hour, "How long expired URLs answer 410 Gone before being purged")
+	clickLog := flag.Bool("click-log", true, "Record a click event for every redirect")
+	clickRetention := flag.Duration("click-retention", storage.DefaultClickRetention, "How long click events are kept (0 keeps them forever)")
+	geoIPDB := flag.String("geoip-db", "", "Path to a MaxMind-format .mmdb file for resolving click locations (reloaded on SIGHUP)")
+	clickRingSize := flag.Int("click-ring-size", storage.DefaultClickRingSize, "Number of click events kept in memory for backends without a clicks table")
+	backupDir := flag.String("backup-dir", "", "Directory for online database backups (only for sqlite, empty disables backups)")
+	backupKeep := flag.Int("backup-keep", storage.DefaultBackupKeep, "Number of newest backups to keep (0 keeps all)")
+	backupInterval := flag.Duration("backup-interval", 0, "How often a backup is taken automatically (0 only backs up on request)")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token for /api/admin endpoints (defaults to $ADMIN_TOKEN, empty disables them)")
+	domains := flag.String("domains", "", "Comma-separated custom domains, each serving its own set of links")
+	unknownHost := flag.String("unknown-host", handler.UnknownHostDefault, "Redirects on hosts not in --domains: default (serve links without a domain), reject (404) or a URL to redirect to")
+	fetchMetadata := flag.Bool("fetch-metadata", true, "Fetch the title, description, favicon and Open Graph image of new destinations in the background")
+	metadataWorkers := flag.Int("metadata-workers", metadata.DefaultWorkers, "Number of destination pages fetched at the same time")
+	metadataTimeout := flag.Duration("metadata-timeout", metadata.DefaultTimeout, "Maximum time a destination page fetch may take")
+	metadataMaxBytes := flag.Int64("metadata-max-bytes", metadata.DefaultMaxBytes, "Maximum number of bytes read from a destination page")
+	metadataMaxRedirects := flag.Int("metadata-max-redirects", metadata.DefaultMaxRedirects, "Maximum number of redirects followed when fetching a destination page")
+	healthInterval := flag.Duration("health-interval", 6*time.Hour, "How often every destination is checked for broken links (0 disables checks)")
+	healthTimeout := flag.Duration("health-timeout", 10*time.Second, "Maximum time a destination health check may take")
+	healthWorkers := flag.Int("health-workers", 8, "Number of destinations checked at the same time")
+	healthAllowPrivate := flag.Bool("health-allow-private", false, "Check destinations on loopback and private network addresses (otherwise they are left unchecked)")
 	flag.Parse()
 
 	// Configure structured logging
@@ -53,28 +131,196 @@ func runServer(args []string) {
 
 	switch *dbType {
 	case "memory":
-		logger.Info("Using in-memory storage")
-		store = storage.NewMemoryStore()
+		if *memoryDir == "" {
+			logger.Info("Using in-memory storage")
+			store = storage.NewMemoryStore()
+			break
+		}
+		logger.Info("Using persistent in-memory storage", zap.String("dir", *memoryDir), zap.String("sync", *memorySync))
+		store, err = storage.OpenMemoryStore(storage.PersistenceOptions{
+			Dir:              *memoryDir,
+			Sync:             *memorySync,
+			SnapshotInterval: *memorySnapshotInterval,
+		})
+		if err != nil {
+			logger.Fatal("Failed to open memory store", zap.Error(err))
+		}
 	case "sqlite":
 		logger.Info("Using SQLite storage", zap.String("path", *dbPath))
-		store, err = storage.NewSQLiteStore(*dbPath)
+		sqliteStore, err := storage.NewSQLiteStore(*dbPath)
 		if err != nil {
 			logger.Fatal("Failed to create SQLite store", zap.Error(err))
 		}
+		if *hitFlushInterval > 0 {
+			sqliteStore.BufferHits(storage.HitBufferOptions{
+				FlushInterval: *hitFlushInterval,
+				FlushSize:     *hitFlushSize,
+			})
+		}
+		store = sqliteStore
+	case "bolt":
+		logger.Info("Using bbolt storage", zap.String("path", *dbPath))
+		store, err = storage.NewBoltStore(*dbPath)
+		if err != nil {
+			logger.Fatal("Failed to create bbolt store", zap.Error(err))
+		}
+	case "postgres":
+		logger.Info("Using PostgreSQL storage", zap.Int("max_conns", *dbMaxConns))
+		store, err = storage.NewPostgresStore(*dbDSN, *dbMaxConns)
+		if err != nil {
+			logger.Fatal("Failed to create PostgreSQL store", zap.Error(err))
+		}
+	case "redis":
+		logger.Info("Using Redis storage")
+		store, err = storage.NewRedisStore(*dbDSN)
+		if err != nil {
+			logger.Fatal("Failed to create Redis store", zap.Error(err))
+		}
 	default:
 		logger.Fatal("Invalid database type", zap.String("type", *dbType))
 	}
 	defer store.Close()
 
+	// Configure short ID generation
+	generator, err := storage.NewIDGenerator(*idStrategy)
+	if err != nil {
+		logger.Fatal("Invalid ID strategy", zap.Error(err))
+	}
+	if configurable, ok := store.(storage.IDConfigurable); ok {
+		configurable.SetIDGenerator(generator, *idLength)
+	}
+
 	// Create a prometheus registry
 	registry := prometheus.NewRegistry()
 
 	// Register default collectors
 	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
 	registry.MustRegister(prometheus.NewGoCollector())
+	if instrumented, ok := store.(storage.MetricsRegisterer); ok {
+		instrumented.RegisterMetrics(registry)
+	}
+
+	// Record click events in the store when it has a clicks table, otherwise
+	// keep the most recent ones in memory
+	var clicks *storage.ClickLog
+	if *clickLog {
+		clickStore, ok := store.(storage.ClickStore)
+		if !ok {
+			logger.Info("Keeping click events in memory", zap.Int("size", *clickRingSize))
+			clickStore = storage.NewClickRing(*clickRingSize)
+		}
+		clicks = storage.NewClickLog(clickStore, storage.ClickLogOptions{Retention: *clickRetention}, registry)
+	}
+
+	// Take online backups of the database
+	var backuper storage.Backuper
+	backupOpts := storage.BackupOptions{Dir: *backupDir, Keep: *backupKeep}
+	if *backupDir != "" {
+		var ok bool
+		backuper, ok = store.(storage.Backuper)
+		if !ok {
+			logger.Fatal("Backups are only supported for sqlite", zap.String("type", *dbType))
+		}
+		logger.Info("Backups enabled", zap.String("dir", *backupDir), zap.Int("keep", *backupKeep), zap.Duration("interval", *backupInterval))
+	}
+	backupCtx, stopBackups := context.WithCancel(context.Background())
+	defer stopBackups()
+	if backuper != nil && *backupInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(*backupInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-backupCtx.Done():
+					return
+				case <-ticker.C:
+					backup, err := backuper.Backup(backupCtx, backupOpts)
+					if err != nil {
+						logger.Error("Failed to back up database", zap.Error(err))
+						continue
+					}
+					logger.Info("Backed up database", zap.String("name", backup.Name), zap.Int64("size", backup.Size))
+				}
+			}
+		}()
+	}
+
+	// Resolve click locations from a local GeoIP database
+	var resolver *geoip.Resolver
+	if *geoIPDB != "" && clicks != nil {
+		resolver, err = geoip.Open(*geoIPDB)
+		if err != nil {
+			logger.Fatal("Failed to open GeoIP database", zap.Error(err))
+		}
+		defer resolver.Close()
+		logger.Info("Resolving click locations", zap.String("path", *geoIPDB))
+
+		// Pick up a replaced database file on SIGHUP
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+		go func() {
+			for range reload {
+				if err := resolver.Reload(); err != nil {
+					logger.Error("Failed to reload GeoIP database", zap.Error(err))
+					continue
+				}
+				logger.Info("Reloaded GeoIP database", zap.String("path", *geoIPDB))
+			}
+		}()
+	}
+
+	// Serve hot redirects from memory
+	if *cacheSize > 0 {
+		logger.Info("Caching redirects", zap.Int("size", *cacheSize), zap.Duration("ttl", *cacheTTL))
+		store = storage.NewCachedStore(store, storage.CacheOptions{Size: *cacheSize, TTL: *cacheTTL}, registry)
+	}
+
+	// Fetch destination metadata through the cache, so that it sees the
+	// saved details
+	var fetcher *metadata.Fetcher
+	if *fetchMetadata {
+		fetcher = metadata.NewFetcher(store, metadata.Options{
+			Workers:      *metadataWorkers,
+			Timeout:      *metadataTimeout,
+			MaxBytes:     *metadataMaxBytes,
+			MaxRedirects: *metadataMaxRedirects,
+		}, registry)
+		logger.Info("Fetching destination metadata", zap.Int("workers", *metadataWorkers), zap.Duration("timeout", *metadataTimeout))
+	}
+
+	// Start the expired URL reaper
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	defer stopReaper()
+	go newReaper(store, clicks, *reapInterval, *expiredRetention, registry, logger).run(reaperCtx)
+
+	// Check destinations for broken links
+	healthCtx, stopHealthChecks := context.WithCancel(context.Background())
+	defer stopHealthChecks()
+	if *healthInterval > 0 {
+		logger.Info("Checking link health", zap.Duration("interval", *healthInterval), zap.Int("workers", *healthWorkers))
+		go newHealthChecker(store, *healthInterval, *healthTimeout, *healthWorkers, *healthAllowPrivate, registry, logger).run(healthCtx)
+	}
 
 	// Create handler with store and prometheus registry
 	urlHandler := handler.NewURLHandler(store, registry)
+	urlHandler.SetStoreTimeout(*storeTimeout)
+	urlHandler.SetDedup(*dedup)
+	urlHandler.SetClickLog(clicks)
+	urlHandler.SetGeoIP(resolver)
+	urlHandler.SetMetadataFetcher(fetcher)
+	urlHandler.SetBackups(backuper, backupOpts)
+	urlHandler.SetAdminToken(*adminToken)
+	urlHandler.SetLowercaseIDs(storage.LowercaseIDs(generator))
+	if *domains != "" {
+		if *unknownHost != handler.UnknownHostDefault && *unknownHost != handler.UnknownHostReject {
+			if target, err := url.Parse(*unknownHost); err != nil || !target.IsAbs() {
+				logger.Fatal("Invalid --unknown-host, want default, reject or an absolute URL", zap.String("unknown_host", *unknownHost))
+			}
+		}
+		urlHandler.SetDomains(strings.Split(*domains, ","), *unknownHost)
+		logger.Info("Serving custom domains", zap.String("domains", *domains), zap.String("unknown_host", *unknownHost))
+	}
 
 	// Create router
 	router := gin.New()
@@ -84,6 +330,15 @@ func runServer(args []string) {
 	// API routes
 	router.POST("/api/shorten", urlHandler.Shorten)
 	router.GET("/api/stats", urlHandler.GetStats)
+	router.GET("/api/search", urlHandler.Search)
+	router.GET("/api/urls", urlHandler.GetStats)
+	router.GET("/api/urls/:id", urlHandler.GetURL)
+	router.PATCH("/api/urls/:id", urlHandler.UpdateURL)
+	router.DELETE("/api/urls/:id", urlHandler.DeleteURL)
+	router.GET("/api/urls/:id/analytics", urlHandler.GetAnalytics)
+	admin := router.Group("/api/admin", urlHandler.RequireAdmin)
+	admin.POST("/backups", urlHandler.CreateBackup)
+	admin.GET("/backups", urlHandler.ListBackups)
 	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
 	router.GET("/:id", urlHandler.Redirect)
 
@@ -115,6 +370,20 @@ func runServer(args []string) {
 		logger.Fatal("Server forced to shutdown", zap.Error(err))
 	}
 
+	// Stop fetching metadata, then write out queued clicks and buffered hits
+	// before the store is closed
+	if fetcher != nil {
+		fetcher.Close()
+	}
+	if clicks != nil {
+		clicks.Close()
+	}
+	if flusher, ok := store.(storage.Flusher); ok {
+		if err := flusher.Flush(ctx); err != nil {
+			logger.Error("Failed to flush buffered hits", zap.Error(err))
+		}
+	}
+
 	logger.Info("Server exited")
 }
 
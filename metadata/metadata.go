@@ -0,0 +1,423 @@
+// Package metadata fetches the title, description, favicon and Open Graph
+// image of link destinations in the background and stores them with the
+// link, so that listings and previews can show more than a bare URL.
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"go-url-shortener/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+)
+
+// Defaults for the fetcher
+const (
+	DefaultWorkers      = 4
+	DefaultQueueSize    = 1000
+	DefaultTimeout      = 10 * time.Second
+	DefaultMaxBytes     = 1 << 20
+	DefaultMaxRedirects = 5
+)
+
+// Limits on what is kept from a page, matching what the API accepts
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 1000
+	maxURLLength         = 2048
+)
+
+// userAgent identifies the fetcher to destination servers
+const userAgent = "go-url-shortener/1.0 (link preview)"
+
+var (
+	// ErrPrivateAddress is returned when a destination resolves to a
+	// loopback, private or link-local address and Options.AllowPrivate is off
+	ErrPrivateAddress = errors.New("destination resolves to a private address")
+
+	// ErrTooManyRedirects is returned when a destination redirects more
+	// often than Options.MaxRedirects
+	ErrTooManyRedirects = errors.New("too many redirects")
+
+	// ErrNotHTML is returned when a destination is not an HTML page
+	ErrNotHTML = errors.New("destination is not an HTML page")
+)
+
+// Options configures a Fetcher
+type Options struct {
+	// Workers is how many pages are fetched at the same time
+	Workers int
+
+	// QueueSize is how many links may wait to be fetched before new ones are dropped
+	QueueSize int
+
+	// Timeout bounds a whole fetch, from connecting to reading the body
+	Timeout time.Duration
+
+	// MaxBytes is how much of a page is read; the head is at the start, so
+	// a truncated page usually still has everything we look for
+	MaxBytes int64
+
+	// MaxRedirects is how many redirects are followed
+	MaxRedirects int
+
+	// AllowPrivate permits fetching from loopback, private and link-local
+	// addresses. They are refused by default so that shortening a link
+	// cannot be used to probe the network the server runs in.
+	AllowPrivate bool
+}
+
+// Page is what was found on a destination page. URLs are absolute.
+type Page struct {
+	Title       string
+	Description string
+	FaviconURL  string
+	ImageURL    string
+}
+
+// job is a link waiting to be fetched
+type job struct {
+	id       string
+	original string
+}
+
+// Fetcher fetches destination pages with a pool of workers, so that
+// creating a link never waits on the destination, and saves what it finds
+// as the link's details
+type Fetcher struct {
+	store  storage.Store
+	opts   Options
+	client *http.Client
+	queue  chan job
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	fetches *prometheus.CounterVec
+}
+
+// NewFetcher starts the workers and registers the fetcher's metrics
+func NewFetcher(store storage.Store, opts Options, registry *prometheus.Registry) *Fetcher {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = DefaultMaxRedirects
+	}
+
+	fetches := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "url_shortener_metadata_fetches_total",
+			Help: "Total number of destination pages by result (saved, failed or dropped)",
+		},
+		[]string{"result"},
+	)
+	registry.MustRegister(fetches)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Fetcher{
+		store:   store,
+		opts:    opts,
+		client:  newClient(opts),
+		queue:   make(chan job, opts.QueueSize),
+		ctx:     ctx,
+		cancel:  cancel,
+		fetches: fetches,
+	}
+	for i := 0; i < opts.Workers; i++ {
+		f.wg.Add(1)
+		go f.run()
+	}
+	return f
+}
+
+// newClient creates an HTTP client that enforces the timeout, the redirect
+// limit and, unless allowed, refuses private addresses. The address check
+// runs on every connection, so it also covers redirects and DNS answers
+// that change between lookups.
+func newClient(opts Options) *http.Client {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivate {
+		dialer.Control = RefusePrivate
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: opts.Timeout,
+			MaxIdleConns:        opts.Workers,
+			IdleConnTimeout:     time.Minute,
+		},
+		Timeout: opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			return nil
+		},
+	}
+}
+
+// RefusePrivate is a net.Dialer Control function that rejects connections
+// to addresses inside private networks, for any client that requests
+// destinations on behalf of the people who created the links
+func RefusePrivate(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// Enqueue queues a link to be fetched without blocking, dropping it if the
+// queue is full
+func (f *Fetcher) Enqueue(url *storage.URL) {
+	select {
+	case f.queue <- job{id: url.ID, original: url.Original}:
+	default:
+		f.fetches.WithLabelValues("dropped").Inc()
+	}
+}
+
+// run fetches queued links until Close is called
+func (f *Fetcher) run() {
+	defer f.wg.Done()
+
+	for job := range f.queue {
+		if f.ctx.Err() != nil {
+			continue
+		}
+		if err := f.process(job); err != nil {
+			f.fetches.WithLabelValues("failed").Inc()
+			continue
+		}
+		f.fetches.WithLabelValues("saved").Inc()
+	}
+}
+
+// process fetches a link's destination and saves what was found
+func (f *Fetcher) process(job job) error {
+	ctx, cancel := context.WithTimeout(f.ctx, f.opts.Timeout)
+	defer cancel()
+
+	page, err := f.Fetch(ctx, job.original)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel = context.WithTimeout(f.ctx, 10*time.Second)
+	defer cancel()
+	return f.save(ctx, job, page)
+}
+
+// save fills the link's details from a page in one conditional write.
+// Title and description the link already has are kept, so details given by
+// people win over the page, even when they are changed during the fetch.
+func (f *Fetcher) save(ctx context.Context, job job, page Page) error {
+	_, err := f.store.Update(ctx, job.id, "",
+		storage.IfDestination(job.original),
+		storage.FillDetails(storage.Details{
+			Title:       page.Title,
+			Description: page.Description,
+			FaviconURL:  page.FaviconURL,
+			ImageURL:    page.ImageURL,
+		}),
+	)
+
+	// The link was deleted, or its destination changed while the page was
+	// fetched; the new one has been queued in turn
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Fetch downloads the page at rawURL and extracts its metadata
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (Page, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return Page{}, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return Page{}, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Page{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return Page{}, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil &&
+		mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return Page{}, ErrNotHTML
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, f.opts.MaxBytes), contentType)
+	if err != nil {
+		return Page{}, err
+	}
+	// Relative links are resolved against the page we ended up on
+	return parsePage(body, resp.Request.URL), nil
+}
+
+// parsePage reads the metadata from the head of an HTML document. The
+// <title> and description meta tag win over their Open Graph counterparts.
+func parsePage(r io.Reader, base *url.URL) Page {
+	var page Page
+	var ogTitle, ogDescription, icon, touchIcon string
+	var title strings.Builder
+	inTitle := false
+
+	tokenizer := html.NewTokenizer(r)
+	for done := false; !done; {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			done = true
+		case html.TextToken:
+			if inTitle {
+				title.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			switch tokenizer.Token().DataAtom {
+			case atom.Title:
+				inTitle = false
+			case atom.Head:
+				done = true
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.DataAtom {
+			case atom.Title:
+				inTitle = title.Len() == 0
+			case atom.Body:
+				done = true
+			case atom.Meta:
+				key := strings.ToLower(attr(token, "property"))
+				if key == "" {
+					key = strings.ToLower(attr(token, "name"))
+				}
+				content := attr(token, "content")
+				switch key {
+				case "description":
+					setOnce(&page.Description, content)
+				case "og:title":
+					setOnce(&ogTitle, content)
+				case "og:description":
+					setOnce(&ogDescription, content)
+				case "og:image", "og:image:url", "og:image:secure_url":
+					setOnce(&page.ImageURL, resolve(base, content))
+				}
+			case atom.Link:
+				for _, rel := range strings.Fields(strings.ToLower(attr(token, "rel"))) {
+					switch rel {
+					case "icon":
+						setOnce(&icon, resolve(base, attr(token, "href")))
+					case "apple-touch-icon":
+						setOnce(&touchIcon, resolve(base, attr(token, "href")))
+					}
+				}
+			}
+		}
+	}
+
+	page.Title = clean(title.String(), maxTitleLength)
+	if page.Title == "" {
+		page.Title = clean(ogTitle, maxTitleLength)
+	}
+	page.Description = clean(page.Description, maxDescriptionLength)
+	if page.Description == "" {
+		page.Description = clean(ogDescription, maxDescriptionLength)
+	}
+	page.FaviconURL = icon
+	if page.FaviconURL == "" {
+		page.FaviconURL = touchIcon
+	}
+	return page
+}
+
+// attr returns the value of a token's attribute, or "" without it
+func attr(token html.Token, name string) string {
+	for _, a := range token.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// setOnce sets *field to value unless it already has one, so the first
+// matching tag wins
+func setOnce(field *string, value string) {
+	if *field == "" {
+		*field = strings.TrimSpace(value)
+	}
+}
+
+// resolve makes ref absolute against base, returning "" for anything that
+// is not a reasonably sized http or https URL
+func resolve(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	resolved, err := base.Parse(ref)
+	if err != nil || (resolved.Scheme != "http" && resolved.Scheme != "https") {
+		return ""
+	}
+	if s := resolved.String(); len(s) <= maxURLLength {
+		return s
+	}
+	return ""
+}
+
+// clean collapses whitespace and truncates text to at most limit characters
+func clean(text string, limit int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	return strings.TrimSpace(string([]rune(text)[:limit]))
+}
+
+// Close stops the workers, abandoning fetches in progress and links still
+// queued. Enqueue must not be called afterwards.
+func (f *Fetcher) Close() {
+	f.cancel()
+	close(f.queue)
+	f.wg.Wait()
+}
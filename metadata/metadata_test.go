@@ -0,0 +1,225 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testPage = `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>
+		Fish &amp; Chips
+	</title>
+	<meta name="description" content="The best in town">
+	<meta property="og:title" content="Ignored, the title wins">
+	<meta property="og:image" content="/images/cover.png">
+	<link rel="apple-touch-icon" href="touch.png">
+	<link rel="Shortcut Icon" href="favicon.ico">
+</head>
+<body><title>Not the title</title></body>
+</html>`
+
+// newTestServer serves the fixture pages used by the tests
+func newTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/menu/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, testPage)
+	})
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/menu/today", http.StatusFound)
+	})
+	mux.HandleFunc("/og", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Open Graph title"><meta property="og:description" content="From og"></head></html>`)
+	})
+	mux.HandleFunc("/latin1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=iso-8859-1")
+		w.Write([]byte("<title>Caf\xe9</title>"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><head><!-- %s --><title>Too far</title></head></html>", strings.Repeat("x", 4096))
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// newTestFetcher creates a fetcher that may reach the local test server
+func newTestFetcher(t *testing.T, store storage.Store, opts Options) *Fetcher {
+	opts.AllowPrivate = true
+	fetcher := NewFetcher(store, opts, prometheus.NewRegistry())
+	t.Cleanup(fetcher.Close)
+	return fetcher
+}
+
+func TestFetch(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	fetcher := newTestFetcher(t, storage.NewMemoryStore(), Options{Timeout: 200 * time.Millisecond, MaxBytes: 2048, MaxRedirects: 2})
+
+	t.Run("Reads the head", func(t *testing.T) {
+		page, err := fetcher.Fetch(ctx, server.URL+"/moved")
+		if err != nil {
+			t.Fatalf("Failed to fetch: %v", err)
+		}
+		want := Page{
+			Title:       "Fish & Chips",
+			Description: "The best in town",
+			FaviconURL:  server.URL + "/menu/favicon.ico",
+			ImageURL:    server.URL + "/images/cover.png",
+		}
+		if page != want {
+			t.Errorf("Expected %+v, got %+v", want, page)
+		}
+	})
+
+	t.Run("Falls back to Open Graph", func(t *testing.T) {
+		page, err := fetcher.Fetch(ctx, server.URL+"/og")
+		if err != nil {
+			t.Fatalf("Failed to fetch: %v", err)
+		}
+		if page.Title != "Open Graph title" || page.Description != "From og" {
+			t.Errorf("Expected the Open Graph title and description, got %+v", page)
+		}
+	})
+
+	t.Run("Decodes the charset", func(t *testing.T) {
+		page, err := fetcher.Fetch(ctx, server.URL+"/latin1")
+		if err != nil {
+			t.Fatalf("Failed to fetch: %v", err)
+		}
+		if page.Title != "Café" {
+			t.Errorf("Expected the title in UTF-8, got %q", page.Title)
+		}
+	})
+
+	t.Run("Stops at the size limit", func(t *testing.T) {
+		page, err := fetcher.Fetch(ctx, server.URL+"/large")
+		if err != nil {
+			t.Fatalf("Failed to fetch: %v", err)
+		}
+		if page.Title != "" {
+			t.Errorf("Expected nothing past the size limit, got %q", page.Title)
+		}
+	})
+
+	t.Run("Failures", func(t *testing.T) {
+		if _, err := fetcher.Fetch(ctx, server.URL+"/loop"); !errors.Is(err, ErrTooManyRedirects) {
+			t.Errorf("Expected too many redirects, got %v", err)
+		}
+		if _, err := fetcher.Fetch(ctx, server.URL+"/image.png"); err != ErrNotHTML {
+			t.Errorf("Expected not HTML, got %v", err)
+		}
+		if _, err := fetcher.Fetch(ctx, server.URL+"/missing"); err == nil {
+			t.Error("Expected an error for a missing page")
+		}
+
+		start := time.Now()
+		if _, err := fetcher.Fetch(ctx, server.URL+"/slow"); err == nil {
+			t.Error("Expected the slow page to time out")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected the fetch to give up after the timeout, took %v", elapsed)
+		}
+	})
+
+	t.Run("Refuses private addresses", func(t *testing.T) {
+		strict := NewFetcher(storage.NewMemoryStore(), Options{}, prometheus.NewRegistry())
+		defer strict.Close()
+		if _, err := strict.Fetch(ctx, server.URL+"/menu/"); !errors.Is(err, ErrPrivateAddress) {
+			t.Errorf("Expected the loopback address to be refused, got %v", err)
+		}
+	})
+}
+
+func TestFetcherSavesDetails(t *testing.T) {
+	ctx := context.Background()
+	server := newTestServer(t)
+	store := storage.NewMemoryStore()
+	defer store.Close()
+	fetcher := newTestFetcher(t, store, Options{Workers: 2})
+
+	named, _ := store.Create(ctx, server.URL+"/menu/", storage.WithDetails(storage.Details{Title: "Lunch"}))
+	plain, _ := store.Create(ctx, server.URL+"/og")
+	broken, _ := store.Create(ctx, server.URL+"/missing")
+	for _, url := range []*storage.URL{named, plain, broken} {
+		fetcher.Enqueue(url)
+	}
+
+	// Workers run in the background, so wait until all three are done
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(fetcher.fetches.WithLabelValues("saved"))+testutil.ToFloat64(fetcher.fetches.WithLabelValues("failed")) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the fetches")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if failed := testutil.ToFloat64(fetcher.fetches.WithLabelValues("failed")); failed != 1 {
+		t.Errorf("Expected 1 failed fetch, got %v", failed)
+	}
+
+	url, _ := store.Lookup(ctx, named.ID)
+	if url.Title != "Lunch" || url.Description != "The best in town" || url.FaviconURL != server.URL+"/menu/favicon.ico" {
+		t.Errorf("Expected the given title to be kept and the rest filled in, got %+v", url.Details)
+	}
+	url, _ = store.Lookup(ctx, plain.ID)
+	if url.Title != "Open Graph title" {
+		t.Errorf("Expected the page title, got %+v", url.Details)
+	}
+}
+
+func TestFetcherKeepsConcurrentEdits(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	defer store.Close()
+	fetcher := newTestFetcher(t, store, Options{Workers: 1})
+
+	page := Page{Title: "Page title", Description: "Page description", FaviconURL: "https://example.com/favicon.ico"}
+	url, _ := store.CreateWithID(ctx, "edited", "https://example.com/edited")
+
+	// A title given while the page was being fetched wins
+	title := "Given title"
+	store.Update(ctx, url.ID, "", storage.ChangeDetails(storage.DetailsChange{Title: &title}))
+	if err := fetcher.save(ctx, job{id: url.ID, original: url.Original}, page); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	saved, _ := store.Lookup(ctx, url.ID)
+	if saved.Title != "Given title" || saved.Description != "Page description" || saved.FaviconURL != page.FaviconURL {
+		t.Errorf("Expected the given title to be kept and the rest filled in, got %+v", saved.Details)
+	}
+
+	// A page fetched for an old destination is dropped
+	moved, _ := store.CreateWithID(ctx, "moved", "https://example.com/old")
+	store.Update(ctx, moved.ID, "https://example.com/new")
+	if err := fetcher.save(ctx, job{id: moved.ID, original: moved.Original}, page); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	if saved, _ := store.Lookup(ctx, moved.ID); saved.Title != "" || saved.FaviconURL != "" {
+		t.Errorf("Expected the old destination's page to be dropped, got %+v", saved.Details)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"go-url-shortener/storage"
+)
+
+// runMigrate implements the migrate subcommand for SQLite databases:
+//
+//	migrate [--db-path urls.db] status
+//	migrate [--db-path urls.db] [--dry-run] up
+func runMigrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(out)
+	dbPath := flags.String("db-path", "urls.db", "Path to SQLite database")
+	dryRun := flags.Bool("dry-run", false, "Print pending migrations without applying them (only for up)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	action := "status"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args()[1:], " "))
+	}
+
+	migrator, err := storage.OpenSQLiteMigrator(*dbPath)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	switch action {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Format(time.RFC3339)
+			} else if status.Applied {
+				state = "applied (untracked)"
+			}
+			fmt.Fprintf(out, "%04d %-24s %s\n", status.Version, status.Name, state)
+		}
+		return nil
+
+	case "up":
+		if *dryRun {
+			pending, err := migrator.Pending(ctx)
+			if err != nil {
+				return err
+			}
+			if len(pending) == 0 {
+				fmt.Fprintln(out, "No pending migrations")
+			}
+			for _, migration := range pending {
+				fmt.Fprintf(out, "-- %04d %s\n%s\n", migration.Version, migration.Name, strings.TrimSpace(migration.SQL))
+			}
+			return nil
+		}
+
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Fprintf(out, "Applied %04d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(out, "No pending migrations")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate action %q (want status or up)", action)
+	}
+}
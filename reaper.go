@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go-url-shortener/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// reaper periodically purges links that expired longer ago than the retention.
+// Keeping expired links around for a while lets redirects answer 410 Gone
+// instead of 404 Not Found.
+type reaper struct {
+	store     storage.Store
+	clicks    *storage.ClickLog
+	interval  time.Duration
+	retention time.Duration
+	removed   prometheus.Counter
+	logger    *zap.Logger
+}
+
+// newReaper creates a reaper and registers its metrics. clicks may be nil.
+func newReaper(store storage.Store, clicks *storage.ClickLog, interval, retention time.Duration, registry *prometheus.Registry, logger *zap.Logger) *reaper {
+	removed := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "url_shortener_expired_reaped_total",
+			Help: "Total number of expired URLs purged by the reaper",
+		},
+	)
+	registry.MustRegister(removed)
+
+	return &reaper{
+		store:     store,
+		clicks:    clicks,
+		interval:  interval,
+		retention: retention,
+		removed:   removed,
+		logger:    logger,
+	}
+}
+
+// run reaps on every tick until the context is cancelled
+func (r *reaper) run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.reapOnce(ctx, time.Now()); err != nil {
+				r.logger.Error("Failed to reap expired URLs", zap.Error(err))
+			}
+		}
+	}
+}
+
+// reapOnce removes links that expired before now minus the retention, along
+// with their clicks
+func (r *reaper) reapOnce(ctx context.Context, now time.Time) (int, error) {
+	before := now.Add(-r.retention)
+
+	// Clicks kept apart from the store are removed by ID, so find the links
+	// that are going first
+	var expired []string
+	if r.clicks != nil {
+		if _, ok := r.clicks.Store().(storage.ClickPurger); ok {
+			err := r.store.Iterate(ctx, func(url *storage.URL) error {
+				if url.Expired(before) {
+					expired = append(expired, url.ID)
+				}
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	removed, err := r.store.DeleteExpired(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+	if len(expired) > 0 {
+		if err := r.clicks.Forget(ctx, expired...); err != nil {
+			return removed, err
+		}
+	}
+
+	if removed > 0 {
+		r.removed.Add(float64(removed))
+		r.logger.Info("Reaped expired URLs", zap.Int("count", removed))
+	}
+	return removed, nil
+}
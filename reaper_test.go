@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestReaper(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	defer store.Close()
+
+	now := time.Now()
+	old, _ := store.Create(ctx, "https://example.com/old", storage.WithExpiry(now.Add(-2*time.Hour)))
+	recent, _ := store.Create(ctx, "https://example.com/recent", storage.WithExpiry(now.Add(-time.Minute)))
+	_, _ = store.Create(ctx, "https://example.com/forever")
+
+	ring := storage.NewClickRing(10)
+	clicks := storage.NewClickLog(ring, storage.ClickLogOptions{}, prometheus.NewRegistry())
+	defer clicks.Close()
+	ring.RecordClicks(ctx, []storage.Click{{URLID: old.ID, Time: now}, {URLID: recent.ID, Time: now}})
+
+	r := newReaper(store, clicks, time.Minute, time.Hour, prometheus.NewRegistry(), zap.NewNop())
+
+	// Only URLs expired for longer than the retention are purged
+	removed, err := r.reapOnce(ctx, now)
+	if err != nil {
+		t.Fatalf("Failed to reap: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 URL reaped, got %d", removed)
+	}
+	if got := testutil.ToFloat64(r.removed); got != 1 {
+		t.Errorf("Expected reaped counter to be 1, got %v", got)
+	}
+
+	if _, err := store.Get(ctx, old.ID); err != storage.ErrNotFound {
+		t.Errorf("Expected old URL to be purged, got %v", err)
+	}
+	if _, err := store.Get(ctx, recent.ID); err != storage.ErrExpired {
+		t.Errorf("Expected recent URL to still answer expired, got %v", err)
+	}
+
+	// Clicks kept in memory go with the links they belong to
+	if listed, _ := ring.ListClicks(ctx, old.ID, now, now.Add(time.Second)); len(listed) != 0 {
+		t.Errorf("Expected the purged URL's clicks to be gone, got %+v", listed)
+	}
+	if listed, _ := ring.ListClicks(ctx, recent.ID, now, now.Add(time.Second)); len(listed) != 1 {
+		t.Errorf("Expected the remaining URL's clicks to be kept, got %+v", listed)
+	}
+}
@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bucket sizes accepted by AnalyticsOptions
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+)
+
+// MaxAnalyticsBuckets caps how many buckets one report may span
+const MaxAnalyticsBuckets = 2000
+
+// ErrTooManyBuckets is returned when the range holds more than
+// MaxAnalyticsBuckets buckets at the requested interval
+var ErrTooManyBuckets = errors.New("too many buckets")
+
+// AnalyticsOptions selects the clicks and bucketing for a report
+type AnalyticsOptions struct {
+	// From and To bound the click time (inclusive, exclusive)
+	From time.Time
+	To   time.Time
+
+	// Interval is IntervalHour or IntervalDay (default)
+	Interval string
+
+	// Location decides where hours and days begin; UTC when nil
+	Location *time.Location
+}
+
+// Analytics summarizes the clicks on one link over a time range
+type Analytics struct {
+	ID        string    `json:"id"`
+	Interval  string    `json:"interval"`
+	Timezone  string    `json:"timezone"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Total     int       `json:"total"`
+	Series    []Bucket  `json:"series"`
+	Referrers []Count   `json:"referrers"`
+	Browsers  []Count   `json:"browsers"`
+	OS        []Count   `json:"os"`
+	Languages []Count   `json:"languages"`
+	Countries []Count   `json:"countries"`
+}
+
+// Bucket is the number of clicks in the hour or day starting at Start
+type Bucket struct {
+	Start  time.Time `json:"start"`
+	Clicks int       `json:"clicks"`
+}
+
+// Count is the number of clicks sharing one value
+type Count struct {
+	Name   string `json:"name"`
+	Clicks int    `json:"clicks"`
+}
+
+// normalize applies defaults and rejects unknown intervals and empty ranges
+func (o *AnalyticsOptions) normalize() error {
+	if o.Interval == "" {
+		o.Interval = IntervalDay
+	}
+	if o.Interval != IntervalHour && o.Interval != IntervalDay {
+		return ErrInvalid
+	}
+	if o.Location == nil {
+		o.Location = time.UTC
+	}
+	if !o.From.Before(o.To) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// bucketStart returns the start of the bucket holding t, in the options' location
+func (o *AnalyticsOptions) bucketStart(t time.Time) time.Time {
+	t = t.In(o.Location)
+	if o.Interval == IntervalDay {
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, o.Location)
+		if start.Day() != t.Day() {
+			// A clock change skipped midnight, so the day starts when it ends
+			_, start = start.ZoneBounds()
+		}
+		return start
+	}
+
+	// Truncate in local time so zones with half-hour offsets line up
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(time.Hour).Add(-shift)
+}
+
+// nextBucket returns the start of the bucket after the one starting at start
+func (o *AnalyticsOptions) nextBucket(start time.Time) time.Time {
+	if o.Interval == IntervalDay {
+		// Go from noon, which is on the right day even when midnight was
+		// skipped, and past days that were skipped altogether
+		for days := 1; ; days++ {
+			next := o.bucketStart(time.Date(start.Year(), start.Month(), start.Day()+days, 12, 0, 0, 0, o.Location))
+			if next.After(start) {
+				return next
+			}
+		}
+	}
+	next := o.bucketStart(start.Add(time.Hour))
+	if !next.After(start) {
+		next = start.Add(time.Hour)
+	}
+	return next
+}
+
+// Analyze buckets clicks over time and breaks them down by referrer domain,
+// browser, operating system, language and country. Clicks outside the range are ignored.
+func Analyze(id string, clicks []Click, opts AnalyticsOptions) (*Analytics, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+
+	// Lay out every bucket, including empty ones, so charts have no gaps
+	var series []Bucket
+	index := make(map[int64]int)
+	for start := opts.bucketStart(opts.From); start.Before(opts.To); start = opts.nextBucket(start) {
+		if len(series) == MaxAnalyticsBuckets {
+			return nil, ErrTooManyBuckets
+		}
+		index[start.Unix()] = len(series)
+		series = append(series, Bucket{Start: start})
+	}
+
+	report := &Analytics{
+		ID:       id,
+		Interval: opts.Interval,
+		Timezone: opts.Location.String(),
+		From:     opts.From.In(opts.Location),
+		To:       opts.To.In(opts.Location),
+		Series:   series,
+	}
+	referrers := make(map[string]int)
+	browsers := make(map[string]int)
+	systems := make(map[string]int)
+	languages := make(map[string]int)
+	countries := make(map[string]int)
+	for _, click := range clicks {
+		if click.Time.Before(opts.From) || !click.Time.Before(opts.To) {
+			continue
+		}
+		bucket, ok := index[opts.bucketStart(click.Time).Unix()]
+		if !ok {
+			return nil, fmt.Errorf("no bucket for click at %s", click.Time.Format(time.RFC3339Nano))
+		}
+		report.Total++
+		report.Series[bucket].Clicks++
+		referrers[ReferrerDomain(click.Referrer)]++
+		browser, system := UserAgentFamily(click.UserAgent)
+		browsers[browser]++
+		systems[system]++
+		languages[PrimaryLanguage(click.Language)]++
+		countries[countryOf(click)]++
+	}
+
+	report.Referrers = rankCounts(referrers)
+	report.Browsers = rankCounts(browsers)
+	report.OS = rankCounts(systems)
+	report.Languages = rankCounts(languages)
+	report.Countries = rankCounts(countries)
+	return report, nil
+}
+
+// countryOf returns the click's country code, or "unknown" when it was not resolved
+func countryOf(click Click) string {
+	if click.Country == "" {
+		return "unknown"
+	}
+	return click.Country
+}
+
+// rankCounts orders counts by clicks, most first, then by name
+func rankCounts(counts map[string]int) []Count {
+	ranked := make([]Count, 0, len(counts))
+	for name, clicks := range counts {
+		ranked = append(ranked, Count{Name: name, Clicks: clicks})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Clicks != ranked[j].Clicks {
+			return ranked[i].Clicks > ranked[j].Clicks
+		}
+		return ranked[i].Name < ranked[j].Name
+	})
+	return ranked
+}
+
+// ReferrerDomain returns the host a click came from without a leading "www.",
+// or "direct" when there was no usable referrer
+func ReferrerDomain(referrer string) string {
+	parsed, err := url.Parse(referrer)
+	if err != nil || parsed.Hostname() == "" {
+		return "direct"
+	}
+	return strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www.")
+}
+
+// PrimaryLanguage returns the primary subtag of the first language in an
+// Accept-Language header, such as "de" for "de-CH,de;q=0.9", or "unknown"
+func PrimaryLanguage(header string) string {
+	first, _, _ := strings.Cut(header, ",")
+	tag, _, _ := strings.Cut(first, ";")
+	primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+	primary = strings.ToLower(primary)
+	if primary == "" || primary == "*" {
+		return "unknown"
+	}
+	return primary
+}
+
+// browserFamilies maps User-Agent tokens to browser families. Order matters:
+// most browsers also claim to be Safari or Chrome.
+var browserFamilies = []struct{ token, family string }{
+	{"bot", "Bot"},
+	{"crawler", "Bot"},
+	{"spider", "Bot"},
+	{"edg/", "Edge"},
+	{"edga/", "Edge"},
+	{"edgios/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"samsungbrowser", "Samsung Internet"},
+	{"firefox", "Firefox"},
+	{"fxios", "Firefox"},
+	{"chrome", "Chrome"},
+	{"crios", "Chrome"},
+	{"chromium", "Chrome"},
+	{"safari", "Safari"},
+	{"msie", "Internet Explorer"},
+	{"trident/", "Internet Explorer"},
+	{"curl/", "curl"},
+}
+
+// osFamilies maps User-Agent tokens to operating system families. Android
+// and ChromeOS come before Linux, and iOS before macOS, because their User-Agents
+// mention both.
+var osFamilies = []struct{ token, family string }{
+	{"windows", "Windows"},
+	{"android", "Android"},
+	{"iphone", "iOS"},
+	{"ipad", "iOS"},
+	{"ipod", "iOS"},
+	{"cros ", "ChromeOS"},
+	{"mac os x", "macOS"},
+	{"macintosh", "macOS"},
+	{"linux", "Linux"},
+}
+
+// UserAgentFamily returns the browser and operating system families named in
+// a User-Agent header, or "Other" for each one it does not recognize
+func UserAgentFamily(userAgent string) (browser, os string) {
+	userAgent = strings.ToLower(userAgent)
+	browser, os = "Other", "Other"
+	for _, candidate := range browserFamilies {
+		if strings.Contains(userAgent, candidate.token) {
+			browser = candidate.family
+			break
+		}
+	}
+	for _, candidate := range osFamilies {
+		if strings.Contains(userAgent, candidate.token) {
+			os = candidate.family
+			break
+		}
+	}
+	return browser, os
+}
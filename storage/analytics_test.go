@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAnalyze(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("Time zone data unavailable: %v", err)
+	}
+
+	t.Run("buckets days in the requested time zone", func(t *testing.T) {
+		// 23:30 UTC on March 1st is already March 2nd in Berlin
+		clicks := []Click{
+			{Time: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)},
+			{Time: time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)},
+			{Time: time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)},
+			{Time: time.Date(2024, 3, 9, 8, 0, 0, 0, time.UTC)},
+		}
+		report, err := Analyze("abc", clicks, AnalyticsOptions{
+			From:     time.Date(2024, 3, 1, 0, 0, 0, 0, berlin),
+			To:       time.Date(2024, 3, 4, 0, 0, 0, 0, berlin),
+			Interval: IntervalDay,
+			Location: berlin,
+		})
+		if err != nil {
+			t.Fatalf("Failed to analyze clicks: %v", err)
+		}
+
+		if report.Total != 3 {
+			t.Errorf("Expected 3 clicks in range, got %d", report.Total)
+		}
+		expected := []int{1, 2, 0}
+		if len(report.Series) != len(expected) {
+			t.Fatalf("Expected %d buckets, got %d", len(expected), len(report.Series))
+		}
+		for i, bucket := range report.Series {
+			if bucket.Clicks != expected[i] {
+				t.Errorf("Bucket %d: expected %d clicks, got %d", i, expected[i], bucket.Clicks)
+			}
+			if bucket.Start.Hour() != 0 || bucket.Start.Location() != berlin {
+				t.Errorf("Bucket %d should start at local midnight, got %v", i, bucket.Start)
+			}
+		}
+	})
+
+	t.Run("hour buckets follow daylight saving changes", func(t *testing.T) {
+		// Clocks in Berlin jump from 02:00 to 03:00 on March 31st, 2024
+		report, err := Analyze("abc", nil, AnalyticsOptions{
+			From:     time.Date(2024, 3, 31, 0, 0, 0, 0, berlin),
+			To:       time.Date(2024, 3, 31, 5, 0, 0, 0, berlin),
+			Interval: IntervalHour,
+			Location: berlin,
+		})
+		if err != nil {
+			t.Fatalf("Failed to analyze clicks: %v", err)
+		}
+		if len(report.Series) != 4 {
+			t.Fatalf("Expected 4 hourly buckets, got %d", len(report.Series))
+		}
+		if hour := report.Series[2].Start.Hour(); hour != 3 {
+			t.Errorf("Expected the third bucket to start at 03:00, got %02d:00", hour)
+		}
+	})
+
+	t.Run("aligns hours in half-hour zones", func(t *testing.T) {
+		kolkata, err := time.LoadLocation("Asia/Kolkata")
+		if err != nil {
+			t.Skipf("Time zone data unavailable: %v", err)
+		}
+		report, err := Analyze("abc", nil, AnalyticsOptions{
+			From:     time.Date(2024, 3, 1, 10, 15, 0, 0, kolkata),
+			To:       time.Date(2024, 3, 1, 12, 0, 0, 0, kolkata),
+			Interval: IntervalHour,
+			Location: kolkata,
+		})
+		if err != nil {
+			t.Fatalf("Failed to analyze clicks: %v", err)
+		}
+		if len(report.Series) != 2 || report.Series[0].Start.Minute() != 0 || report.Series[0].Start.Hour() != 10 {
+			t.Errorf("Expected buckets at 10:00 and 11:00 local time, got %+v", report.Series)
+		}
+	})
+
+	t.Run("starts days skipped at midnight when the clocks change", func(t *testing.T) {
+		saoPaulo, err := time.LoadLocation("America/Sao_Paulo")
+		if err != nil {
+			t.Skipf("Time zone data unavailable: %v", err)
+		}
+
+		// Clocks went from 00:00 straight to 01:00 on 17 October 2010
+		clicks := []Click{{Time: time.Date(2010, 10, 17, 1, 30, 0, 0, saoPaulo)}, {Time: time.Date(2010, 10, 17, 23, 0, 0, 0, saoPaulo)}}
+		report, err := Analyze("abc", clicks, AnalyticsOptions{
+			From:     time.Date(2010, 10, 16, 0, 0, 0, 0, saoPaulo),
+			To:       time.Date(2010, 10, 19, 0, 0, 0, 0, saoPaulo),
+			Location: saoPaulo,
+		})
+		if err != nil {
+			t.Fatalf("Failed to analyze clicks: %v", err)
+		}
+		if len(report.Series) != 3 || report.Series[1].Clicks != 2 {
+			t.Fatalf("Expected 3 daily buckets with both clicks on the second, got %+v", report.Series)
+		}
+		if start := report.Series[1].Start; start.Day() != 17 || start.Hour() != 1 {
+			t.Errorf("Expected the second day to start at 01:00 on the 17th, got %v", start)
+		}
+	})
+
+	t.Run("breaks clicks down", func(t *testing.T) {
+		now := time.Now()
+		clicks := []Click{
+			{Time: now, Referrer: "https://www.Example.org/a", UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", Language: "de-DE,de;q=0.9", Country: "DE"},
+			{Time: now, Referrer: "https://example.org/b", UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", Language: "en-US", Country: "DE"},
+			{Time: now, UserAgent: "curl/8.4.0"},
+		}
+		report, err := Analyze("abc", clicks, AnalyticsOptions{From: now.Add(-time.Hour), To: now.Add(time.Hour), Interval: IntervalHour})
+		if err != nil {
+			t.Fatalf("Failed to analyze clicks: %v", err)
+		}
+
+		if report.Referrers[0] != (Count{Name: "example.org", Clicks: 2}) || report.Referrers[1] != (Count{Name: "direct", Clicks: 1}) {
+			t.Errorf("Unexpected referrers: %+v", report.Referrers)
+		}
+		if len(report.Browsers) != 3 || report.Browsers[0].Name != "Chrome" {
+			t.Errorf("Unexpected browsers: %+v", report.Browsers)
+		}
+		if len(report.Languages) != 3 || report.Languages[0].Clicks != 1 {
+			t.Errorf("Unexpected languages: %+v", report.Languages)
+		}
+		if len(report.Countries) != 2 || report.Countries[0] != (Count{Name: "DE", Clicks: 2}) || report.Countries[1].Name != "unknown" {
+			t.Errorf("Unexpected countries: %+v", report.Countries)
+		}
+	})
+
+	t.Run("rejects ranges with too many buckets", func(t *testing.T) {
+		now := time.Now()
+		_, err := Analyze("abc", nil, AnalyticsOptions{From: now.Add(-365 * 24 * time.Hour), To: now, Interval: IntervalHour})
+		if err != ErrTooManyBuckets {
+			t.Errorf("Expected ErrTooManyBuckets, got %v", err)
+		}
+	})
+}
+
+func TestUserAgentFamily(t *testing.T) {
+	tests := []struct {
+		userAgent, browser, os string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "Edge", "Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", "Safari", "macOS"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", "Firefox", "Linux"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", "Chrome", "Android"},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "Chrome", "ChromeOS"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "Bot", "Other"},
+		{"", "Other", "Other"},
+	}
+	for _, test := range tests {
+		browser, os := UserAgentFamily(test.userAgent)
+		if browser != test.browser || os != test.os {
+			t.Errorf("UserAgentFamily(%q) = %s, %s; expected %s, %s", test.userAgent, browser, os, test.browser, test.os)
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBackupKeep is how many backups a directory keeps by default
+const DefaultBackupKeep = 7
+
+const (
+	backupPrefix = "urls-"
+	backupSuffix = ".db"
+
+	// checksumSuffix names the file holding a backup's SHA-256 in the
+	// format sha256sum reads
+	checksumSuffix = ".sha256"
+
+	// backupTimeLayout sorts lexically in time order. Names are parsed with
+	// backupParseLayout, which also reads the millisecond names of older
+	// versions.
+	backupTimeLayout  = "20060102T150405.000000000Z"
+	backupParseLayout = "20060102T150405.999999999Z"
+)
+
+// ErrNoBackup is returned when a directory has no backup to restore
+var ErrNoBackup = errors.New("no backup found")
+
+// ErrChecksumMismatch is returned when a backup no longer matches its checksum
+var ErrChecksumMismatch = errors.New("backup checksum mismatch")
+
+// BackupOptions configures where backups are written and how many are kept
+type BackupOptions struct {
+	// Dir holds the backups and their checksum files
+	Dir string
+
+	// Keep is how many of the newest backups are kept (0 keeps all)
+	Keep int
+}
+
+// Backup describes one backup file
+type Backup struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+}
+
+// Backuper is implemented by stores that can copy their database while
+// serving traffic
+type Backuper interface {
+	Backup(ctx context.Context, opts BackupOptions) (*Backup, error)
+}
+
+// Backup implements Backuper with VACUUM INTO, which writes a consistent,
+// compacted copy of the database without blocking readers or writers for
+// longer than a normal read transaction. Older backups beyond opts.Keep are
+// removed afterwards.
+func (s *SQLiteStore) Backup(ctx context.Context, opts BackupOptions) (*Backup, error) {
+	// Buffered hits would otherwise be missing from the copy
+	if err := s.hits.flush(ctx); err != nil {
+		return nil, err
+	}
+	return backupDatabase(ctx, s.db, opts)
+}
+
+// BackupDatabase backs up the SQLite database at path like
+// SQLiteStore.Backup, for use while a server may have it open. The database
+// is opened read-only and never migrated, and a missing file is an error.
+func BackupDatabase(ctx context.Context, path string, opts BackupOptions) (*Backup, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := openSQLite("file:" + path + "?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// Make sure it is a URL database and not some other SQLite file
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls").Scan(&count); err != nil {
+		return nil, fmt.Errorf("%s has no urls table: %w", path, err)
+	}
+	return backupDatabase(ctx, db, opts)
+}
+
+// backupDatabase writes a backup of db to opts.Dir and prunes old ones
+func backupDatabase(ctx context.Context, db *sql.DB, opts BackupOptions) (*Backup, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// Write under a temporary name so a half-written copy is never listed.
+	// VACUUM INTO accepts the empty file CreateTemp leaves behind.
+	file, err := os.CreateTemp(opts.Dir, backupPrefix+"*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	temp := file.Name()
+	file.Close()
+	defer os.Remove(temp)
+
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", temp); err != nil {
+		return nil, err
+	}
+	sum, size, err := fileChecksum(temp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Linking never replaces an existing backup, so two backups taken at the
+	// same moment, by the server and the backup command say, both survive
+	var createdAt time.Time
+	var name, path string
+	for {
+		createdAt = time.Now().UTC()
+		name = backupPrefix + createdAt.Format(backupTimeLayout) + backupSuffix
+		path = filepath.Join(opts.Dir, name)
+		err := os.Link(temp, path)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	if err := writeChecksum(path, sum); err != nil {
+		return nil, err
+	}
+
+	if opts.Keep > 0 {
+		if err := pruneBackups(opts.Dir, opts.Keep); err != nil {
+			return nil, err
+		}
+	}
+	return &Backup{Name: name, Path: path, CreatedAt: createdAt, Size: size, SHA256: sum}, nil
+}
+
+// ListBackups returns the backups in dir, oldest first. Checksums are read
+// from the checksum files, not recomputed.
+func ListBackups(dir string) ([]*Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []*Backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		createdAt, err := time.Parse(backupParseLayout, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(dir, name)
+		sum, _ := readChecksum(path)
+		backups = append(backups, &Backup{Name: name, Path: path, CreatedAt: createdAt, Size: info.Size(), SHA256: sum})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].CreatedAt.Before(backups[j].CreatedAt)
+	})
+	return backups, nil
+}
+
+// FindBackup returns the newest backup in dir taken at or before at, or the
+// newest of all when at is zero
+func FindBackup(dir string, at time.Time) (*Backup, error) {
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if at.IsZero() || !backups[i].CreatedAt.After(at) {
+			return backups[i], nil
+		}
+	}
+	return nil, ErrNoBackup
+}
+
+// VerifyBackup checks a backup against its checksum file and runs SQLite's
+// integrity check on it
+func VerifyBackup(ctx context.Context, path string) error {
+	expected, err := readChecksum(path)
+	if err != nil {
+		return err
+	}
+	sum, _, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return ErrChecksumMismatch
+	}
+
+	db, err := openSQLite("file:" + path + "?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("backup integrity check failed: %s", result)
+	}
+
+	// Make sure it is a URL database and not some other SQLite file
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls").Scan(&count); err != nil {
+		return fmt.Errorf("backup has no urls table: %w", err)
+	}
+	return nil
+}
+
+// RestoreBackup verifies a backup and swaps it in as the database at dbPath
+// with a single rename, so that dbPath always holds either the old database
+// or the restored one. The current database is kept as dbPath.pre-restore.
+// Nothing may have the database open while it runs.
+func RestoreBackup(ctx context.Context, backupPath, dbPath string) error {
+	if err := VerifyBackup(ctx, backupPath); err != nil {
+		return err
+	}
+
+	// Copy next to the database so the final rename stays on one file system
+	temp := dbPath + ".restore"
+	if err := copyFile(backupPath, temp); err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		if err := keepPreRestore(ctx, dbPath); err != nil {
+			os.Remove(temp)
+			return err
+		}
+	}
+
+	if err := os.Rename(temp, dbPath); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return syncDir(filepath.Dir(dbPath))
+}
+
+// keepPreRestore folds the write-ahead log of the database at dbPath into
+// the file, which would otherwise be replayed into the restored database,
+// and keeps a copy of it as dbPath.pre-restore
+func keepPreRestore(ctx context.Context, dbPath string) error {
+	db, err := openSQLite("file:" + dbPath)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)")
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// After the checkpoint these hold nothing the database file does not
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	previous := dbPath + ".pre-restore"
+	if err := os.Remove(previous); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(dbPath, previous); err != nil {
+		return copyFile(dbPath, previous)
+	}
+	return nil
+}
+
+// pruneBackups removes all but the newest keep backups in dir
+func pruneBackups(dir string, keep int) error {
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0].Path); err != nil {
+			return err
+		}
+		if err := os.Remove(backups[0].Path + checksumSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// fileChecksum returns the hex SHA-256 and size of a file
+func fileChecksum(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// writeChecksum writes the checksum file for a backup atomically
+func writeChecksum(path, sum string) error {
+	temp := path + checksumSuffix + ".tmp"
+	line := sum + "  " + filepath.Base(path) + "\n"
+	if err := os.WriteFile(temp, []byte(line), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, path+checksumSuffix); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readChecksum reads the checksum recorded for a backup
+func readChecksum(path string) (string, error) {
+	data, err := os.ReadFile(path + checksumSuffix)
+	if err != nil {
+		return "", fmt.Errorf("reading checksum: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file for %s", filepath.Base(path))
+	}
+	return fields[0], nil
+}
+
+// copyFile copies src to dst and fsyncs it
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
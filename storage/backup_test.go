@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteBackup(t *testing.T) {
+	if !SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+
+	store, err := NewSQLiteStore(filepath.Join(dir, "urls.db"))
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store: %v", err)
+	}
+	defer store.Close()
+	store.BufferHits(HitBufferOptions{FlushInterval: time.Hour, FlushSize: 1000})
+
+	if _, err := store.CreateWithID(ctx, "first", "https://example.com/first"); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if _, err := store.Get(ctx, "first"); err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+
+	t.Run("writes a verified copy", func(t *testing.T) {
+		backup, err := store.Backup(ctx, BackupOptions{Dir: backupDir})
+		if err != nil {
+			t.Fatalf("Failed to back up: %v", err)
+		}
+		if len(backup.SHA256) != 64 || backup.Size == 0 {
+			t.Errorf("Unexpected backup: %+v", backup)
+		}
+		if err := VerifyBackup(ctx, backup.Path); err != nil {
+			t.Errorf("Expected the backup to verify: %v", err)
+		}
+
+		// The copy includes buffered hits
+		copied, err := NewSQLiteStore(backup.Path)
+		if err != nil {
+			t.Fatalf("Failed to open backup: %v", err)
+		}
+		defer copied.Close()
+		if url, err := copied.Lookup(ctx, "first"); err != nil || url.Hits != 1 {
+			t.Errorf("Expected the backup to hold the URL with 1 hit, got %+v, %v", url, err)
+		}
+	})
+
+	t.Run("keeps the newest backups", func(t *testing.T) {
+		rotated := filepath.Join(dir, "rotated")
+		var names []string
+		for i := 0; i < 4; i++ {
+			backup, err := store.Backup(ctx, BackupOptions{Dir: rotated, Keep: 2})
+			if err != nil {
+				t.Fatalf("Failed to back up: %v", err)
+			}
+			names = append(names, backup.Name)
+			time.Sleep(2 * time.Millisecond)
+		}
+
+		backups, err := ListBackups(rotated)
+		if err != nil {
+			t.Fatalf("Failed to list backups: %v", err)
+		}
+		if len(backups) != 2 || backups[0].Name != names[2] || backups[1].Name != names[3] {
+			t.Errorf("Expected the last two backups, got %+v", backups)
+		}
+		if _, err := os.Stat(filepath.Join(rotated, names[0]+checksumSuffix)); !os.IsNotExist(err) {
+			t.Errorf("Expected the rotated checksum file to be removed, got %v", err)
+		}
+
+		// Point-in-time lookup picks the newest backup at or before the time
+		found, err := FindBackup(rotated, backups[1].CreatedAt.Add(-time.Nanosecond))
+		if err != nil || found.Name != names[2] {
+			t.Errorf("Expected %s, got %+v, %v", names[2], found, err)
+		}
+		if _, err := FindBackup(rotated, backups[0].CreatedAt.Add(-time.Hour)); err != ErrNoBackup {
+			t.Errorf("Expected ErrNoBackup, got %v", err)
+		}
+	})
+
+	t.Run("never reuses a name", func(t *testing.T) {
+		burst := filepath.Join(dir, "burst")
+		for i := 0; i < 5; i++ {
+			if _, err := store.Backup(ctx, BackupOptions{Dir: burst}); err != nil {
+				t.Fatalf("Failed to back up: %v", err)
+			}
+		}
+		backups, err := ListBackups(burst)
+		if err != nil || len(backups) != 5 {
+			t.Errorf("Expected 5 backups, got %d, %v", len(backups), err)
+		}
+	})
+
+	t.Run("backs up a database by path", func(t *testing.T) {
+		backup, err := BackupDatabase(ctx, filepath.Join(dir, "urls.db"), BackupOptions{Dir: filepath.Join(dir, "by-path")})
+		if err != nil {
+			t.Fatalf("Failed to back up: %v", err)
+		}
+		if err := VerifyBackup(ctx, backup.Path); err != nil {
+			t.Errorf("Expected the backup to verify: %v", err)
+		}
+
+		// A mistyped path is an error, not a new empty database
+		missing := filepath.Join(dir, "missing.db")
+		if _, err := BackupDatabase(ctx, missing, BackupOptions{Dir: filepath.Join(dir, "by-path")}); err == nil {
+			t.Error("Expected an error for a missing database")
+		}
+		if _, err := os.Stat(missing); !os.IsNotExist(err) {
+			t.Errorf("Expected the missing database not to be created, got %v", err)
+		}
+	})
+
+	t.Run("detects damaged backups", func(t *testing.T) {
+		backup, err := store.Backup(ctx, BackupOptions{Dir: filepath.Join(dir, "damaged")})
+		if err != nil {
+			t.Fatalf("Failed to back up: %v", err)
+		}
+		file, err := os.OpenFile(backup.Path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("Failed to open backup: %v", err)
+		}
+		file.WriteAt([]byte("garbage"), 200)
+		file.Close()
+
+		if err := VerifyBackup(ctx, backup.Path); err != ErrChecksumMismatch {
+			t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+		}
+		if err := RestoreBackup(ctx, backup.Path, filepath.Join(dir, "restored.db")); err != ErrChecksumMismatch {
+			t.Errorf("Expected restore to refuse the backup, got %v", err)
+		}
+	})
+}
+
+func TestRestoreBackup(t *testing.T) {
+	if !SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "urls.db")
+
+	store, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store: %v", err)
+	}
+	store.CreateWithID(ctx, "kept", "https://example.com/kept")
+	backup, err := store.Backup(ctx, BackupOptions{Dir: filepath.Join(dir, "backups")})
+	if err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	store.CreateWithID(ctx, "later", "https://example.com/later")
+	store.Close()
+
+	if err := RestoreBackup(ctx, backup.Path, dbPath); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+
+	restored, err := NewSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open restored database: %v", err)
+	}
+	defer restored.Close()
+	if _, err := restored.Lookup(ctx, "kept"); err != nil {
+		t.Errorf("Expected the backed up URL, got %v", err)
+	}
+	if _, err := restored.Lookup(ctx, "later"); err != ErrNotFound {
+		t.Errorf("Expected URLs created after the backup to be gone, got %v", err)
+	}
+
+	// The previous database is kept whole, including what was still in its
+	// write-ahead log
+	previous, err := NewSQLiteStore(dbPath + ".pre-restore")
+	if err != nil {
+		t.Fatalf("Expected the previous database to be kept: %v", err)
+	}
+	defer previous.Close()
+	if _, err := previous.Lookup(ctx, "later"); err != nil {
+		t.Errorf("Expected the previous database to hold every URL, got %v", err)
+	}
+}
@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"context"
 	"os"
 	"testing"
 )
 
 // BenchmarkMemoryStoreCreate benchmarks the Create operation in MemoryStore
 func BenchmarkMemoryStoreCreate(b *testing.B) {
+	ctx := context.Background()
 	store := NewMemoryStore()
 	defer store.Close()
 	
@@ -14,7 +16,7 @@ func BenchmarkMemoryStoreCreate(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		// Create URL with unique name to avoid collisions
 		url := "https://example.com/benchmark-" + string(rune(i%26+97))
-		_, err := store.Create(url)
+		_, err := store.Create(ctx, url)
 		if err != nil {
 			b.Fatalf("Error creating URL: %v", err)
 		}
@@ -23,18 +25,19 @@ func BenchmarkMemoryStoreCreate(b *testing.B) {
 
 // BenchmarkMemoryStoreGet benchmarks the Get operation in MemoryStore
 func BenchmarkMemoryStoreGet(b *testing.B) {
+	ctx := context.Background()
 	store := NewMemoryStore()
 	defer store.Close()
-	
+
 	// Create a URL to retrieve during benchmark
-	url, err := store.Create("https://example.com/benchmark-get")
+	url, err := store.Create(ctx, "https://example.com/benchmark-get")
 	if err != nil {
 		b.Fatalf("Error creating URL: %v", err)
 	}
-	
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := store.Get(url.ID)
+		_, err := store.Get(ctx, url.ID)
 		if err != nil {
 			b.Fatalf("Error getting URL: %v", err)
 		}
@@ -43,13 +46,14 @@ func BenchmarkMemoryStoreGet(b *testing.B) {
 
 // BenchmarkMemoryStoreGetStats benchmarks the GetStats operation in MemoryStore
 func BenchmarkMemoryStoreGetStats(b *testing.B) {
+	ctx := context.Background()
 	store := NewMemoryStore()
 	defer store.Close()
 	
 	// Create some URLs for stats
 	for i := 0; i < 100; i++ {
 		url := "https://example.com/benchmark-stats-" + string(rune(i%26+97))
-		_, err := store.Create(url)
+		_, err := store.Create(ctx, url)
 		if err != nil {
 			b.Fatalf("Error creating URL: %v", err)
 		}
@@ -57,7 +61,7 @@ func BenchmarkMemoryStoreGetStats(b *testing.B) {
 	
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := store.GetStats()
+		_, err := store.GetStats(ctx)
 		if err != nil {
 			b.Fatalf("Error getting stats: %v", err)
 		}
@@ -66,6 +70,10 @@ func BenchmarkMemoryStoreGetStats(b *testing.B) {
 
 // BenchmarkSQLiteStoreCreate benchmarks the Create operation in SQLiteStore
 func BenchmarkSQLiteStoreCreate(b *testing.B) {
+	if !SQLiteAvailable {
+		b.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
 	// Create temporary file for SQLite
 	tmpFile, err := os.CreateTemp("", "bench-urls-*.db")
 	if err != nil {
@@ -86,7 +94,7 @@ func BenchmarkSQLiteStoreCreate(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		// Create URL with unique name to avoid collisions
 		url := "https://example.com/benchmark-" + string(rune(i%26+97))
-		_, err := store.Create(url)
+		_, err := store.Create(ctx, url)
 		if err != nil {
 			b.Fatalf("Error creating URL: %v", err)
 		}
@@ -95,6 +103,10 @@ func BenchmarkSQLiteStoreCreate(b *testing.B) {
 
 // BenchmarkSQLiteStoreGet benchmarks the Get operation in SQLiteStore
 func BenchmarkSQLiteStoreGet(b *testing.B) {
+	if !SQLiteAvailable {
+		b.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
 	// Create temporary file for SQLite
 	tmpFile, err := os.CreateTemp("", "bench-urls-get-*.db")
 	if err != nil {
@@ -103,23 +115,23 @@ func BenchmarkSQLiteStoreGet(b *testing.B) {
 	tmpFileName := tmpFile.Name()
 	tmpFile.Close()
 	defer os.Remove(tmpFileName)
-	
+
 	// Create store
 	store, err := NewSQLiteStore(tmpFileName)
 	if err != nil {
 		b.Fatalf("Failed to create SQLite store: %v", err)
 	}
 	defer store.Close()
-	
+
 	// Create a URL to retrieve during benchmark
-	url, err := store.Create("https://example.com/benchmark-get")
+	url, err := store.Create(ctx, "https://example.com/benchmark-get")
 	if err != nil {
 		b.Fatalf("Error creating URL: %v", err)
 	}
-	
+
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, err := store.Get(url.ID)
+		_, err := store.Get(ctx, url.ID)
 		if err != nil {
 			b.Fatalf("Error getting URL: %v", err)
 		}
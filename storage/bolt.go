@@ -0,0 +1,549 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bucket and key names used by BoltStore
+var (
+	boltURLsBucket  = []byte("urls")
+	boltHitsBucket  = []byte("hits")
+	boltMetaBucket  = []byte("meta")
+	boltHashBucket  = []byte("url_hashes")
+	boltCountKey    = []byte("count")
+	boltTotalHitKey = []byte("total_hits")
+)
+
+// BoltStore implements Store using an embedded bbolt database. It is pure Go,
+// so it works in binaries built with CGO_ENABLED=0.
+//
+// Records live in the urls bucket and hit counters in the hits bucket, so a
+// redirect only rewrites an 8-byte counter. The meta bucket keeps running
+// totals for GetTotalCount and GetTotalHits, and the url_hashes bucket
+// indexes IDs by URLHash as "<hash>/<id>" keys for deduplication.
+type BoltStore struct {
+	idAllocator
+	db *bolt.DB
+}
+
+// NewBoltStore opens or creates the bbolt database at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create buckets if not exist
+	err = db.Update(func(tx *bolt.Tx) error {
+		indexed := tx.Bucket(boltHashBucket) != nil
+		for _, name := range [][]byte{boltURLsBucket, boltHitsBucket, boltMetaBucket, boltHashBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		// Index records written before the hash index existed
+		if indexed {
+			return nil
+		}
+		return tx.Bucket(boltURLsBucket).ForEach(func(k, v []byte) error {
+			var url URL
+			if err := json.Unmarshal(v, &url); err != nil {
+				return err
+			}
+			return tx.Bucket(boltHashBucket).Put(boltHashKey(url.Original, url.ID), nil)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// getCounter reads a big-endian counter, treating a missing key as zero
+func getCounter(bucket *bolt.Bucket, key []byte) int {
+	value := bucket.Get(key)
+	if len(value) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(value))
+}
+
+// addCounter adds delta to a big-endian counter and returns the new value
+func addCounter(bucket *bolt.Bucket, key []byte, delta int) (int, error) {
+	value := getCounter(bucket, key) + delta
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(value))
+	return value, bucket.Put(key, buf)
+}
+
+// boltHashKey returns the url_hashes key for id
+func boltHashKey(original, id string) []byte {
+	return []byte(URLHash(original) + "/" + id)
+}
+
+// findBoltDuplicate returns an existing link that can stand in for record, or nil
+func findBoltDuplicate(tx *bolt.Tx, record *URL) (*URL, error) {
+	prefix := []byte(URLHash(record.Original) + "/")
+
+	var candidates []*URL
+	cursor := tx.Bucket(boltHashBucket).Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		url, err := readURL(tx, string(k[len(prefix):]))
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, url)
+	}
+	return findReusable(candidates, record), nil
+}
+
+// readURL decodes the record for id with its hit counter, or returns ErrNotFound
+func readURL(tx *bolt.Tx, id string) (*URL, error) {
+	data := tx.Bucket(boltURLsBucket).Get([]byte(id))
+	if data == nil {
+		return nil, ErrNotFound
+	}
+
+	var url URL
+	if err := json.Unmarshal(data, &url); err != nil {
+		return nil, err
+	}
+	url.Hits = getCounter(tx.Bucket(boltHitsBucket), []byte(id))
+	return &url, nil
+}
+
+// writeURL encodes the record for url; hits are stored separately
+func writeURL(tx *bolt.Tx, url *URL) error {
+	record := *url
+	record.Hits = 0
+	data, err := json.Marshal(&record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltURLsBucket).Put([]byte(url.ID), data)
+}
+
+// Create implements Store.Create
+func (s *BoltStore) Create(ctx context.Context, original string, opts ...CreateOption) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Validate URL
+	if err := validateURL(original); err != nil {
+		return nil, err
+	}
+
+	// Generate a short ID, retrying on collisions
+	return s.allocate(original, createDomain(opts), func(id string, extra ...CreateOption) (*URL, error) {
+		return s.CreateWithID(ctx, id, original, append(extra, opts...)...)
+	})
+}
+
+// CreateWithID implements Store.CreateWithID
+func (s *BoltStore) CreateWithID(ctx context.Context, id, original string, opts ...CreateOption) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Validate URL
+	if err := validateURL(original); err != nil {
+		return nil, err
+	}
+
+	// Strip the monotonic clock reading so the record matches what is read back
+	record := &URL{
+		ID:        id,
+		Original:  original,
+		CreatedAt: time.Now().Round(0),
+		Hits:      0,
+	}
+	for _, opt := range opts {
+		opt(record)
+	}
+
+	created := record
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if record.dedup {
+			existing, err := findBoltDuplicate(tx, record)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				created = existing
+				return nil
+			}
+		}
+
+		if tx.Bucket(boltURLsBucket).Get([]byte(id)) != nil {
+			return ErrConflict
+		}
+		if err := writeURL(tx, record); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltHashBucket).Put(boltHashKey(original, id), nil); err != nil {
+			return err
+		}
+		if record.Hits > 0 {
+			if _, err := addCounter(tx.Bucket(boltHitsBucket), []byte(id), record.Hits); err != nil {
+				return err
+			}
+			if _, err := addCounter(tx.Bucket(boltMetaBucket), boltTotalHitKey, record.Hits); err != nil {
+				return err
+			}
+		}
+		_, err := addCounter(tx.Bucket(boltMetaBucket), boltCountKey, 1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// Get implements Store.Get
+func (s *BoltStore) Get(ctx context.Context, id string) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var url *URL
+
+	// Update transactions are serialized, so the checks and the increment are atomic
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		url, err = readURL(tx, id)
+		if err != nil {
+			return err
+		}
+		if url.Expired(time.Now()) {
+			return ErrExpired
+		}
+		if url.Exhausted() {
+			return ErrExhausted
+		}
+
+		// Increment hits
+		if url.Hits, err = addCounter(tx.Bucket(boltHitsBucket), []byte(id), 1); err != nil {
+			return err
+		}
+		_, err = addCounter(tx.Bucket(boltMetaBucket), boltTotalHitKey, 1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return url, nil
+}
+
+// RecordHit implements HitRecorder.RecordHit
+func (s *BoltStore) RecordHit(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltURLsBucket).Get([]byte(id)) == nil {
+			return nil
+		}
+		if _, err := addCounter(tx.Bucket(boltHitsBucket), []byte(id), 1); err != nil {
+			return err
+		}
+		_, err := addCounter(tx.Bucket(boltMetaBucket), boltTotalHitKey, 1)
+		return err
+	})
+}
+
+// Lookup implements Store.Lookup
+func (s *BoltStore) Lookup(ctx context.Context, id string) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var url *URL
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		url, err = readURL(tx, id)
+		return err
+	})
+	return url, err
+}
+
+// Update implements Store.Update
+func (s *BoltStore) Update(ctx context.Context, id, original string, opts ...UpdateOption) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Validate URL
+	if original != "" {
+		if err := validateURL(original); err != nil {
+			return nil, err
+		}
+	}
+	o := collectUpdate(opts)
+
+	var url *URL
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		url, err = readURL(tx, id)
+		if err != nil {
+			return err
+		}
+		if o.destination != "" && url.Original != o.destination {
+			return ErrNotFound
+		}
+		if original != "" {
+			if err := tx.Bucket(boltHashBucket).Delete(boltHashKey(url.Original, id)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltHashBucket).Put(boltHashKey(original, id), nil); err != nil {
+				return err
+			}
+			url.Original = original
+			url.Health = nil
+		}
+		url.Details = o.details(url.Details)
+		return writeURL(tx, url)
+	})
+	return url, err
+}
+
+// SetDetails implements Store.SetDetails
+func (s *BoltStore) SetDetails(ctx context.Context, id string, details Details) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var url *URL
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		url, err = readURL(tx, id)
+		if err != nil {
+			return err
+		}
+		url.Details = details.normalize()
+		return writeURL(tx, url)
+	})
+	return url, err
+}
+
+// SetHealth implements Store.SetHealth
+func (s *BoltStore) SetHealth(ctx context.Context, id string, health Health) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		url, err := readURL(tx, id)
+		if err != nil {
+			return err
+		}
+		url.Health = health.normalize()
+		return writeURL(tx, url)
+	})
+}
+
+// Delete implements Store.Delete
+func (s *BoltStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteURL(tx, id)
+	})
+}
+
+// deleteURL removes a record and its counter, keeping the totals in step
+func deleteURL(tx *bolt.Tx, id string) error {
+	key := []byte(id)
+	url, err := readURL(tx, id)
+	if err != nil {
+		return err
+	}
+
+	hits := url.Hits
+	if err := tx.Bucket(boltHashBucket).Delete(boltHashKey(url.Original, id)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltURLsBucket).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltHitsBucket).Delete(key); err != nil {
+		return err
+	}
+
+	meta := tx.Bucket(boltMetaBucket)
+	if _, err := addCounter(meta, boltCountKey, -1); err != nil {
+		return err
+	}
+	_, err = addCounter(meta, boltTotalHitKey, -hits)
+	return err
+}
+
+// DeleteExpired implements Store.DeleteExpired
+func (s *BoltStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Collect first; deleting while iterating a bucket skips keys
+		var expired []string
+		err := tx.Bucket(boltURLsBucket).ForEach(func(k, v []byte) error {
+			var url URL
+			if err := json.Unmarshal(v, &url); err != nil {
+				return err
+			}
+			if url.Expired(before) {
+				expired = append(expired, url.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, id := range expired {
+			if err := deleteURL(tx, id); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return removed, nil
+}
+
+// GetStats implements Store.GetStats
+func (s *BoltStore) GetStats(ctx context.Context) ([]*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var urls []*URL
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hits := tx.Bucket(boltHitsBucket)
+		return tx.Bucket(boltURLsBucket).ForEach(func(k, v []byte) error {
+			var url URL
+			if err := json.Unmarshal(v, &url); err != nil {
+				return err
+			}
+			url.Hits = getCounter(hits, k)
+			urls = append(urls, &url)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// List implements Store.List
+func (s *BoltStore) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	urls, err := s.GetStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return listInMemory(urls, opts)
+}
+
+// Iterate implements Store.Iterate, reading each batch in its own
+// transaction so that writers are not held up
+func (s *BoltStore) Iterate(ctx context.Context, fn func(*URL) error) error {
+	var after []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var batch []*URL
+		err := s.db.View(func(tx *bolt.Tx) error {
+			cursor := tx.Bucket(boltURLsBucket).Cursor()
+			k, _ := cursor.First()
+			if after != nil {
+				// Seek lands on the last key of the previous batch, if it still exists
+				k, _ = cursor.Seek(after)
+				if k != nil && bytes.Equal(k, after) {
+					k, _ = cursor.Next()
+				}
+			}
+			for ; k != nil && len(batch) < iterateBatchSize; k, _ = cursor.Next() {
+				url, err := readURL(tx, string(k))
+				if err != nil {
+					return err
+				}
+				batch = append(batch, url)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, url := range batch {
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+		if len(batch) < iterateBatchSize {
+			return nil
+		}
+		after = []byte(batch[len(batch)-1].ID)
+	}
+}
+
+// GetTotalCount implements Store.GetTotalCount
+func (s *BoltStore) GetTotalCount(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var count int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = getCounter(tx.Bucket(boltMetaBucket), boltCountKey)
+		return nil
+	})
+	return count, err
+}
+
+// GetTotalHits implements Store.GetTotalHits
+func (s *BoltStore) GetTotalHits(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		total = getCounter(tx.Bucket(boltMetaBucket), boltTotalHitKey)
+		return nil
+	})
+	return total, err
+}
+
+// Close implements Store.Close
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults for the redirect cache
+const (
+	DefaultCacheSize        = 10000
+	DefaultCacheTTL         = time.Minute
+	DefaultNegativeCacheTTL = 5 * time.Second
+
+	// cacheLoadTimeout bounds a read shared by concurrent misses, which
+	// outlives the caller that started it
+	cacheLoadTimeout = 10 * time.Second
+)
+
+// CacheOptions configures a CachedStore
+type CacheOptions struct {
+	// Size is the maximum number of cached IDs (DefaultCacheSize when zero)
+	Size int
+
+	// TTL is how long a cached URL is served before it is read again
+	TTL time.Duration
+
+	// NegativeTTL is how long an unknown ID keeps answering ErrNotFound
+	// from the cache. It is capped at TTL.
+	NegativeTTL time.Duration
+}
+
+// CachedStore wraps a Store and serves redirects for hot IDs from a bounded
+// LRU cache. Hits are still counted in the wrapped store on every redirect,
+// through HitRecorder when it is available. Links with a hit limit bypass
+// the cache so the limit holds exactly.
+//
+// Writes made through the CachedStore invalidate the cache; writes made by
+// other replicas become visible once the TTL runs out.
+type CachedStore struct {
+	Store
+	recorder HitRecorder
+	opts     CacheOptions
+	group    singleflight.Group
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+}
+
+// cacheEntry is a cached URL, or a cached miss when url is nil
+type cacheEntry struct {
+	id      string
+	url     *URL
+	expires time.Time
+}
+
+// NewCachedStore wraps store with a cache and registers its metrics
+func NewCachedStore(store Store, opts CacheOptions, registry *prometheus.Registry) *CachedStore {
+	if opts.Size <= 0 {
+		opts.Size = DefaultCacheSize
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultCacheTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = DefaultNegativeCacheTTL
+	}
+	if opts.NegativeTTL > opts.TTL {
+		opts.NegativeTTL = opts.TTL
+	}
+
+	hits := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "url_shortener_cache_hits_total",
+			Help: "Total number of redirects served from the cache",
+		},
+	)
+	misses := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "url_shortener_cache_misses_total",
+			Help: "Total number of redirects that had to read the store",
+		},
+	)
+	evictions := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "url_shortener_cache_evictions_total",
+			Help: "Total number of cached IDs evicted to stay within the cache size",
+		},
+	)
+	registry.MustRegister(hits, misses, evictions)
+
+	recorder, _ := store.(HitRecorder)
+	return &CachedStore{
+		Store:     store,
+		recorder:  recorder,
+		opts:      opts,
+		entries:   make(map[string]*list.Element),
+		order:     list.New(),
+		hits:      hits,
+		misses:    misses,
+		evictions: evictions,
+	}
+}
+
+// Get implements Store.Get
+func (c *CachedStore) Get(ctx context.Context, id string) (*URL, error) {
+	// Without a way to count hits on their own, every redirect has to go
+	// through the store
+	if c.recorder == nil {
+		return c.Store.Get(ctx, id)
+	}
+
+	url, err := c.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if url.MaxHits > 0 {
+		return c.Store.Get(ctx, id)
+	}
+	if url.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+
+	if err := c.recorder.RecordHit(ctx, id); err != nil {
+		return nil, err
+	}
+	url.Hits = c.countCachedHit(id, url.Hits+1)
+
+	return url, nil
+}
+
+// countCachedHit keeps the cached hit count in step with the store, so that
+// redirects served from the cache report the same count the store would
+func (c *CachedStore) countCachedHit(id string, hits int) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[id]
+	if !ok {
+		return hits
+	}
+	url := element.Value.(*cacheEntry).url
+	if url == nil {
+		return hits
+	}
+	url.Hits++
+	return url.Hits
+}
+
+// load returns a copy of the cached URL, reading it from the store on a miss.
+// Concurrent misses for the same ID share one read.
+func (c *CachedStore) load(ctx context.Context, id string) (*URL, error) {
+	if url, ok := c.lookupCache(id); ok {
+		c.hits.Inc()
+		if url == nil {
+			return nil, ErrNotFound
+		}
+		return url, nil
+	}
+	c.misses.Inc()
+
+	// The shared read must not fail because the caller that started it gave
+	// up, so it runs detached and each caller waits only as long as it may
+	loads := c.group.DoChan(id, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cacheLoadTimeout)
+		defer cancel()
+
+		url, err := c.Store.Lookup(loadCtx, id)
+		switch {
+		case err == ErrNotFound:
+			c.put(id, nil, c.opts.NegativeTTL)
+		case err == nil:
+			c.put(id, url, c.opts.TTL)
+		}
+		return url, err
+	})
+
+	var result singleflight.Result
+	select {
+	case result = <-loads:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	// Callers sharing the read must not share the record
+	record := *result.Val.(*URL)
+	return &record, nil
+}
+
+// lookupCache returns a copy of a fresh cache entry and marks it recently used
+func (c *CachedStore) lookupCache(id string) (*URL, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeElement(element)
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	if entry.url == nil {
+		return nil, true
+	}
+	record := *entry.url
+	return &record, true
+}
+
+// put caches url (nil for a miss) for ttl, evicting the least recently used
+// entries beyond the cache size
+func (c *CachedStore) put(id string, url *URL, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var record *URL
+	if url != nil {
+		copied := *url
+		record = &copied
+	}
+	entry := &cacheEntry{id: id, url: record, expires: time.Now().Add(ttl)}
+
+	if element, ok := c.entries[id]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[id] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.opts.Size {
+		c.removeElement(c.order.Back())
+		c.evictions.Inc()
+	}
+}
+
+// invalidate drops id from the cache
+func (c *CachedStore) invalidate(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, ok := c.entries[id]; ok {
+		c.removeElement(element)
+	}
+}
+
+// removeElement drops an entry; the caller holds the mutex
+func (c *CachedStore) removeElement(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).id)
+}
+
+// Create implements Store.Create
+func (c *CachedStore) Create(ctx context.Context, original string, opts ...CreateOption) (*URL, error) {
+	url, err := c.Store.Create(ctx, original, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new ID may have been cached as unknown
+	c.invalidate(url.ID)
+	return url, nil
+}
+
+// CreateWithID implements Store.CreateWithID
+func (c *CachedStore) CreateWithID(ctx context.Context, id, original string, opts ...CreateOption) (*URL, error) {
+	url, err := c.Store.CreateWithID(ctx, id, original, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The alias may have been cached as unknown
+	c.invalidate(id)
+	return url, nil
+}
+
+// Update implements Store.Update
+func (c *CachedStore) Update(ctx context.Context, id, original string, opts ...UpdateOption) (*URL, error) {
+	url, err := c.Store.Update(ctx, id, original, opts...)
+	c.invalidate(id)
+	return url, err
+}
+
+// SetDetails implements Store.SetDetails
+func (c *CachedStore) SetDetails(ctx context.Context, id string, details Details) (*URL, error) {
+	url, err := c.Store.SetDetails(ctx, id, details)
+	c.invalidate(id)
+	return url, err
+}
+
+// SetHealth implements Store.SetHealth
+func (c *CachedStore) SetHealth(ctx context.Context, id string, health Health) error {
+	err := c.Store.SetHealth(ctx, id, health)
+	c.invalidate(id)
+	return err
+}
+
+// Delete implements Store.Delete
+func (c *CachedStore) Delete(ctx context.Context, id string) error {
+	err := c.Store.Delete(ctx, id)
+	c.invalidate(id)
+	return err
+}
+
+// DeleteExpired implements Store.DeleteExpired
+func (c *CachedStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	removed, err := c.Store.DeleteExpired(ctx, before)
+	if err != nil {
+		return 0, err
+	}
+
+	// Drop cached URLs the store has just purged
+	c.mutex.Lock()
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		if url := element.Value.(*cacheEntry).url; url != nil && url.Expired(before) {
+			c.removeElement(element)
+		}
+		element = next
+	}
+	c.mutex.Unlock()
+
+	return removed, nil
+}
+
+// Search implements Searcher with the wrapped store, bypassing the cache
+func (c *CachedStore) Search(ctx context.Context, opts SearchOptions) ([]*URL, error) {
+	return Search(ctx, c.Store, opts)
+}
+
+// Flush implements Flusher by flushing the wrapped store, if it buffers writes
+func (c *CachedStore) Flush(ctx context.Context) error {
+	if flusher, ok := c.Store.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
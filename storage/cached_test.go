@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingStore counts Lookup calls and can hold them until released
+type countingStore struct {
+	Store
+	lookups atomic.Int32
+	release chan struct{}
+}
+
+func (s *countingStore) Lookup(ctx context.Context, id string) (*URL, error) {
+	s.lookups.Add(1)
+	if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return s.Store.Lookup(ctx, id)
+}
+
+func (s *countingStore) RecordHit(ctx context.Context, id string) error {
+	return s.Store.(HitRecorder).RecordHit(ctx, id)
+}
+
+func TestCachedStoreCaching(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("serves repeated redirects from the cache", func(t *testing.T) {
+		backing := &countingStore{Store: NewMemoryStore()}
+		store := NewCachedStore(backing, CacheOptions{Size: 10, TTL: time.Minute}, prometheus.NewRegistry())
+
+		url, err := store.Create(ctx, "https://example.com/cached")
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if _, err := store.Get(ctx, url.ID); err != nil {
+				t.Fatalf("Failed to get URL: %v", err)
+			}
+		}
+
+		if lookups := backing.lookups.Load(); lookups != 1 {
+			t.Errorf("Expected 1 store lookup, got %d", lookups)
+		}
+		if hits := testutil.ToFloat64(store.hits); hits != 4 {
+			t.Errorf("Expected 4 cache hits, got %v", hits)
+		}
+		if misses := testutil.ToFloat64(store.misses); misses != 1 {
+			t.Errorf("Expected 1 cache miss, got %v", misses)
+		}
+
+		// Every redirect was still counted
+		looked, err := store.Lookup(ctx, url.ID)
+		if err != nil {
+			t.Fatalf("Failed to look up URL: %v", err)
+		}
+		if looked.Hits != 5 {
+			t.Errorf("Expected 5 hits, got %d", looked.Hits)
+		}
+	})
+
+	t.Run("caches unknown IDs until they are created", func(t *testing.T) {
+		backing := &countingStore{Store: NewMemoryStore()}
+		store := NewCachedStore(backing, CacheOptions{Size: 10, TTL: time.Minute}, prometheus.NewRegistry())
+
+		for i := 0; i < 3; i++ {
+			if _, err := store.Get(ctx, "later"); err != ErrNotFound {
+				t.Fatalf("Expected ErrNotFound, got %v", err)
+			}
+		}
+		if lookups := backing.lookups.Load(); lookups != 1 {
+			t.Errorf("Expected 1 store lookup, got %d", lookups)
+		}
+
+		if _, err := store.CreateWithID(ctx, "later", "https://example.com/later"); err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		if _, err := store.Get(ctx, "later"); err != nil {
+			t.Errorf("Expected created alias to resolve, got %v", err)
+		}
+	})
+
+	t.Run("invalidates on update and delete", func(t *testing.T) {
+		store := NewCachedStore(NewMemoryStore(), CacheOptions{Size: 10, TTL: time.Minute}, prometheus.NewRegistry())
+
+		url, err := store.Create(ctx, "https://example.com/before")
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		if _, err := store.Get(ctx, url.ID); err != nil {
+			t.Fatalf("Failed to get URL: %v", err)
+		}
+
+		if _, err := store.Update(ctx, url.ID, "https://example.com/after"); err != nil {
+			t.Fatalf("Failed to update URL: %v", err)
+		}
+		got, err := store.Get(ctx, url.ID)
+		if err != nil {
+			t.Fatalf("Failed to get URL: %v", err)
+		}
+		if got.Original != "https://example.com/after" {
+			t.Errorf("Expected updated destination, got %s", got.Original)
+		}
+
+		if err := store.Delete(ctx, url.ID); err != nil {
+			t.Fatalf("Failed to delete URL: %v", err)
+		}
+		if _, err := store.Get(ctx, url.ID); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound after delete, got %v", err)
+		}
+	})
+
+	t.Run("evicts least recently used IDs", func(t *testing.T) {
+		store := NewCachedStore(NewMemoryStore(), CacheOptions{Size: 2, TTL: time.Minute}, prometheus.NewRegistry())
+
+		var ids []string
+		for i := 0; i < 3; i++ {
+			url, err := store.Create(ctx, "https://example.com/evict")
+			if err != nil {
+				t.Fatalf("Failed to create URL: %v", err)
+			}
+			if _, err := store.Get(ctx, url.ID); err != nil {
+				t.Fatalf("Failed to get URL: %v", err)
+			}
+			ids = append(ids, url.ID)
+		}
+
+		if evictions := testutil.ToFloat64(store.evictions); evictions != 1 {
+			t.Errorf("Expected 1 eviction, got %v", evictions)
+		}
+		if _, ok := store.lookupCache(ids[0]); ok {
+			t.Error("Expected the oldest ID to be evicted")
+		}
+		if _, ok := store.lookupCache(ids[2]); !ok {
+			t.Error("Expected the newest ID to be cached")
+		}
+	})
+
+	t.Run("shares concurrent misses", func(t *testing.T) {
+		backing := &countingStore{Store: NewMemoryStore(), release: make(chan struct{})}
+		store := NewCachedStore(backing, CacheOptions{Size: 10, TTL: time.Minute}, prometheus.NewRegistry())
+
+		if _, err := store.CreateWithID(ctx, "hot", "https://example.com/hot"); err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := store.Get(ctx, "hot"); err != nil {
+					t.Errorf("Failed to get URL: %v", err)
+				}
+			}()
+		}
+
+		// Let the first lookup through once every caller is waiting on it
+		for testutil.ToFloat64(store.misses) < 10 {
+			time.Sleep(time.Millisecond)
+		}
+		close(backing.release)
+		wg.Wait()
+
+		if lookups := backing.lookups.Load(); lookups != 1 {
+			t.Errorf("Expected 1 shared store lookup, got %d", lookups)
+		}
+		looked, err := store.Lookup(ctx, "hot")
+		if err != nil {
+			t.Fatalf("Failed to look up URL: %v", err)
+		}
+		if looked.Hits != 10 {
+			t.Errorf("Expected 10 hits, got %d", looked.Hits)
+		}
+	})
+	t.Run("a cancelled caller does not fail the others", func(t *testing.T) {
+		backing := &countingStore{Store: NewMemoryStore(), release: make(chan struct{})}
+		store := NewCachedStore(backing, CacheOptions{Size: 10, TTL: time.Minute}, prometheus.NewRegistry())
+
+		if _, err := store.CreateWithID(ctx, "shared", "https://example.com/shared"); err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+
+		cancelled, cancel := context.WithCancel(ctx)
+		first := make(chan error, 1)
+		go func() {
+			_, err := store.Get(cancelled, "shared")
+			first <- err
+		}()
+		for testutil.ToFloat64(store.misses) < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		second := make(chan error, 1)
+		go func() {
+			_, err := store.Get(ctx, "shared")
+			second <- err
+		}()
+		for testutil.ToFloat64(store.misses) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// The first caller gives up without waiting for the read
+		cancel()
+		if err := <-first; err != context.Canceled {
+			t.Errorf("Expected the cancelled caller to get context.Canceled, got %v", err)
+		}
+		close(backing.release)
+		if err := <-second; err != nil {
+			t.Errorf("Expected the other caller to get the URL, got %v", err)
+		}
+		if lookups := backing.lookups.Load(); lookups != 1 {
+			t.Errorf("Expected 1 shared store lookup, got %d", lookups)
+		}
+	})
+}
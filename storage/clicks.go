@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for the click event log
+const (
+	DefaultClickRetention  = 90 * 24 * time.Hour
+	DefaultClickRingSize   = 100000
+	DefaultClickQueueSize  = 10000
+	DefaultClickBatchSize  = 100
+	DefaultClickFlushDelay = time.Second
+	clickPruneInterval     = time.Hour
+)
+
+// Click is a single redirect, recorded for analytics
+type Click struct {
+	URLID     string    `json:"url_id"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Language  string    `json:"language,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Country   string    `json:"country,omitempty"`
+	City      string    `json:"city,omitempty"`
+}
+
+// ClickStore stores click events
+type ClickStore interface {
+	// RecordClicks stores a batch of clicks
+	RecordClicks(ctx context.Context, clicks []Click) error
+
+	// ListClicks returns the clicks for id in [from, to), oldest first
+	ListClicks(ctx context.Context, id string, from, to time.Time) ([]Click, error)
+
+	// DeleteClicksBefore removes clicks older than before and returns how many
+	DeleteClicksBefore(ctx context.Context, before time.Time) (int, error)
+}
+
+// ClickPurger is implemented by click stores kept apart from the links, which
+// have to be told when links go away. Stores with a clicks table remove the
+// clicks along with the links instead.
+type ClickPurger interface {
+	// DeleteClicksFor removes every click on the given links and returns how many
+	DeleteClicksFor(ctx context.Context, ids []string) (int, error)
+}
+
+// ClickRing implements ClickStore in memory, keeping only the most recent
+// clicks once it is full
+type ClickRing struct {
+	mutex  sync.RWMutex
+	clicks []Click
+	next   int
+	full   bool
+}
+
+// NewClickRing creates a ring that holds up to size clicks
+func NewClickRing(size int) *ClickRing {
+	if size <= 0 {
+		size = DefaultClickRingSize
+	}
+	return &ClickRing{clicks: make([]Click, size)}
+}
+
+// RecordClicks implements ClickStore.RecordClicks
+func (r *ClickRing) RecordClicks(ctx context.Context, clicks []Click) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, click := range clicks {
+		r.clicks[r.next] = click
+		r.next = (r.next + 1) % len(r.clicks)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	return nil
+}
+
+// ordered returns the stored clicks in insertion order; the caller holds the lock
+func (r *ClickRing) ordered() []Click {
+	if !r.full {
+		return r.clicks[:r.next]
+	}
+	return append(append([]Click(nil), r.clicks[r.next:]...), r.clicks[:r.next]...)
+}
+
+// ListClicks implements ClickStore.ListClicks
+func (r *ClickRing) ListClicks(ctx context.Context, id string, from, to time.Time) ([]Click, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var clicks []Click
+	for _, click := range r.ordered() {
+		if click.URLID == id && !click.Time.Before(from) && click.Time.Before(to) {
+			clicks = append(clicks, click)
+		}
+	}
+	return clicks, nil
+}
+
+// DeleteClicksBefore implements ClickStore.DeleteClicksBefore
+func (r *ClickRing) DeleteClicksBefore(ctx context.Context, before time.Time) (int, error) {
+	return r.remove(func(click Click) bool { return click.Time.Before(before) }), nil
+}
+
+// DeleteClicksFor implements ClickPurger.DeleteClicksFor
+func (r *ClickRing) DeleteClicksFor(ctx context.Context, ids []string) (int, error) {
+	deleted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	return r.remove(func(click Click) bool { return deleted[click.URLID] }), nil
+}
+
+// remove drops the clicks matching drop, keeping the rest in order
+func (r *ClickRing) remove(drop func(Click) bool) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	kept := make([]Click, 0, len(r.clicks))
+	removed := 0
+	for _, click := range r.ordered() {
+		if drop(click) {
+			removed++
+			continue
+		}
+		kept = append(kept, click)
+	}
+
+	r.next = len(kept) % len(r.clicks)
+	r.full = len(kept) == len(r.clicks)
+	r.clicks = kept[:cap(kept)]
+	return removed
+}
+
+// ClickLogOptions configures a ClickLog
+type ClickLogOptions struct {
+	// QueueSize is how many clicks may wait to be written before new ones are dropped
+	QueueSize int
+
+	// BatchSize is how many clicks are written at once
+	BatchSize int
+
+	// FlushDelay is the longest a click waits for its batch to fill up
+	FlushDelay time.Duration
+
+	// Retention is how long clicks are kept; zero keeps them forever
+	Retention time.Duration
+}
+
+// ClickLog records clicks asynchronously, so that redirects never wait on
+// the click store, and prunes clicks older than the retention
+type ClickLog struct {
+	store ClickStore
+	opts  ClickLogOptions
+	queue chan Click
+	done  chan struct{}
+
+	recorded prometheus.Counter
+	dropped  prometheus.Counter
+	pruned   prometheus.Counter
+}
+
+// NewClickLog starts writing clicks to store and registers its metrics
+func NewClickLog(store ClickStore, opts ClickLogOptions, registry *prometheus.Registry) *ClickLog {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultClickQueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultClickBatchSize
+	}
+	if opts.FlushDelay <= 0 {
+		opts.FlushDelay = DefaultClickFlushDelay
+	}
+
+	recorded := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "url_shortener_clicks_recorded_total",
+			Help: "Total number of click events written to the click store",
+		},
+	)
+	dropped := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "url_shortener_clicks_dropped_total",
+			Help: "Total number of click events lost because the queue was full or the write failed",
+		},
+	)
+	pruned := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "url_shortener_clicks_pruned_total",
+			Help: "Total number of click events removed after the retention window",
+		},
+	)
+	registry.MustRegister(recorded, dropped, pruned)
+
+	l := &ClickLog{
+		store:    store,
+		opts:     opts,
+		queue:    make(chan Click, opts.QueueSize),
+		done:     make(chan struct{}),
+		recorded: recorded,
+		dropped:  dropped,
+		pruned:   pruned,
+	}
+	go l.run()
+	return l
+}
+
+// Store returns the click store the log writes to
+func (l *ClickLog) Store() ClickStore {
+	return l.store
+}
+
+// Record queues a click without blocking, dropping it if the queue is full
+func (l *ClickLog) Record(click Click) {
+	select {
+	case l.queue <- click:
+	default:
+		l.dropped.Inc()
+	}
+}
+
+// run writes batches until Close is called, then writes what is left
+func (l *ClickLog) run() {
+	defer close(l.done)
+
+	flush := time.NewTicker(l.opts.FlushDelay)
+	defer flush.Stop()
+	prune := time.NewTicker(clickPruneInterval)
+	defer prune.Stop()
+
+	l.prune(time.Now())
+
+	batch := make([]Click, 0, l.opts.BatchSize)
+	for {
+		select {
+		case click, ok := <-l.queue:
+			if !ok {
+				l.write(batch)
+				return
+			}
+			batch = append(batch, click)
+			if len(batch) >= l.opts.BatchSize {
+				l.write(batch)
+				batch = batch[:0]
+			}
+		case <-flush.C:
+			l.write(batch)
+			batch = batch[:0]
+		case <-prune.C:
+			l.prune(time.Now())
+		}
+	}
+}
+
+// write stores a batch, counting it as dropped if that fails
+func (l *ClickLog) write(batch []Click) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := l.store.RecordClicks(ctx, batch); err != nil {
+		l.dropped.Add(float64(len(batch)))
+		return
+	}
+	l.recorded.Add(float64(len(batch)))
+}
+
+// prune removes clicks older than the retention window
+func (l *ClickLog) prune(now time.Time) (int, error) {
+	if l.opts.Retention <= 0 {
+		return 0, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	removed, err := l.store.DeleteClicksBefore(ctx, now.Add(-l.opts.Retention))
+	if err != nil {
+		return 0, err
+	}
+	l.pruned.Add(float64(removed))
+	return removed, nil
+}
+
+// Forget removes the clicks on deleted links from a click store that does
+// not remove them along with the links
+func (l *ClickLog) Forget(ctx context.Context, ids ...string) error {
+	purger, ok := l.store.(ClickPurger)
+	if !ok || len(ids) == 0 {
+		return nil
+	}
+	_, err := purger.DeleteClicksFor(ctx, ids)
+	return err
+}
+
+// Close stops accepting clicks and waits until queued ones are written.
+// Record must not be called afterwards.
+func (l *ClickLog) Close() {
+	close(l.queue)
+	<-l.done
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// runClickStoreTests exercises a ClickStore with clicks one minute apart
+func runClickStoreTests(t *testing.T, store ClickStore) {
+	ctx := context.Background()
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	var clicks []Click
+	for i := 0; i < 5; i++ {
+		clicks = append(clicks, Click{
+			URLID:     "clicked",
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Referrer:  "https://example.org/",
+			UserAgent: "test-agent",
+			Language:  "en",
+			ClientIP:  "192.0.2.0",
+			Country:   "DE",
+			City:      "Berlin",
+		})
+	}
+	clicks = append(clicks, Click{URLID: "other", Time: start})
+	if err := store.RecordClicks(ctx, clicks); err != nil {
+		t.Fatalf("Failed to record clicks: %v", err)
+	}
+
+	listed, err := store.ListClicks(ctx, "clicked", start.Add(time.Minute), start.Add(4*time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to list clicks: %v", err)
+	}
+	if len(listed) != 3 {
+		t.Fatalf("Expected 3 clicks in range, got %d", len(listed))
+	}
+	if !listed[0].Time.Equal(start.Add(time.Minute)) || listed[0].Referrer != "https://example.org/" || listed[0].ClientIP != "192.0.2.0" || listed[0].City != "Berlin" {
+		t.Errorf("Unexpected first click: %+v", listed[0])
+	}
+
+	removed, err := store.DeleteClicksBefore(ctx, start.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to prune clicks: %v", err)
+	}
+	if removed != 3 {
+		t.Errorf("Expected 3 pruned clicks, got %d", removed)
+	}
+	listed, err = store.ListClicks(ctx, "clicked", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to list clicks: %v", err)
+	}
+	if len(listed) != 3 {
+		t.Errorf("Expected 3 clicks after pruning, got %d", len(listed))
+	}
+}
+
+func TestClickRing(t *testing.T) {
+	runClickStoreTests(t, NewClickRing(100))
+
+	t.Run("keeps the most recent clicks", func(t *testing.T) {
+		ctx := context.Background()
+		ring := NewClickRing(3)
+		start := time.Now()
+
+		for i := 0; i < 5; i++ {
+			click := Click{URLID: "full", Time: start.Add(time.Duration(i) * time.Second)}
+			if err := ring.RecordClicks(ctx, []Click{click}); err != nil {
+				t.Fatalf("Failed to record click: %v", err)
+			}
+		}
+
+		listed, _ := ring.ListClicks(ctx, "full", start, start.Add(time.Minute))
+		if len(listed) != 3 || !listed[0].Time.Equal(start.Add(2*time.Second)) {
+			t.Fatalf("Expected the 3 newest clicks in order, got %+v", listed)
+		}
+
+		// Pruning a full ring leaves room for new clicks
+		if removed, _ := ring.DeleteClicksBefore(ctx, start.Add(4*time.Second)); removed != 2 {
+			t.Errorf("Expected 2 pruned clicks, got %d", removed)
+		}
+		ring.RecordClicks(ctx, []Click{{URLID: "full", Time: start.Add(5 * time.Second)}})
+		listed, _ = ring.ListClicks(ctx, "full", start, start.Add(time.Minute))
+		if len(listed) != 2 || !listed[1].Time.Equal(start.Add(5*time.Second)) {
+			t.Errorf("Unexpected clicks after pruning: %+v", listed)
+		}
+	})
+
+	t.Run("forgets deleted links", func(t *testing.T) {
+		ctx := context.Background()
+		ring := NewClickRing(10)
+		log := NewClickLog(ring, ClickLogOptions{}, prometheus.NewRegistry())
+		defer log.Close()
+		now := time.Now()
+		ring.RecordClicks(ctx, []Click{{URLID: "gone", Time: now}, {URLID: "kept", Time: now}, {URLID: "gone", Time: now}})
+
+		if err := log.Forget(ctx, "gone"); err != nil {
+			t.Fatalf("Failed to forget clicks: %v", err)
+		}
+		if listed, _ := ring.ListClicks(ctx, "gone", now, now.Add(time.Second)); len(listed) != 0 {
+			t.Errorf("Expected the deleted link's clicks to be gone, got %+v", listed)
+		}
+		if listed, _ := ring.ListClicks(ctx, "kept", now, now.Add(time.Second)); len(listed) != 1 {
+			t.Errorf("Expected other clicks to be kept, got %+v", listed)
+		}
+	})
+}
+
+func TestSQLiteClicks(t *testing.T) {
+	if !SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "clicks.db"))
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store: %v", err)
+	}
+	defer store.Close()
+
+	runClickStoreTests(t, store)
+
+	// Deleting a link, or purging it once expired, removes its history
+	now := time.Now()
+	if _, err := store.CreateWithID(ctx, "clicked", "https://example.com/clicked"); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if _, err := store.CreateWithID(ctx, "lapsed", "https://example.com/lapsed", WithExpiry(now.Add(-time.Hour))); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	store.RecordClicks(ctx, []Click{{URLID: "clicked", Time: now}, {URLID: "lapsed", Time: now}})
+	if err := store.Delete(ctx, "clicked"); err != nil {
+		t.Fatalf("Failed to delete URL: %v", err)
+	}
+	if removed, err := store.DeleteExpired(ctx, now); err != nil || removed != 1 {
+		t.Fatalf("Expected 1 expired URL deleted, got %d, %v", removed, err)
+	}
+	for _, id := range []string{"clicked", "lapsed"} {
+		listed, err := store.ListClicks(ctx, id, time.Time{}, now.Add(time.Second))
+		if err != nil {
+			t.Fatalf("Failed to list clicks: %v", err)
+		}
+		if len(listed) != 0 {
+			t.Errorf("Expected no clicks on %s after delete, got %d", id, len(listed))
+		}
+	}
+}
+
+func TestClickLog(t *testing.T) {
+	t.Run("writes queued clicks in batches", func(t *testing.T) {
+		ring := NewClickRing(100)
+		log := NewClickLog(ring, ClickLogOptions{BatchSize: 2, FlushDelay: time.Hour}, prometheus.NewRegistry())
+
+		now := time.Now()
+		for i := 0; i < 5; i++ {
+			log.Record(Click{URLID: "queued", Time: now})
+		}
+		log.Close()
+
+		listed, _ := ring.ListClicks(context.Background(), "queued", now, now.Add(time.Second))
+		if len(listed) != 5 {
+			t.Errorf("Expected 5 clicks after close, got %d", len(listed))
+		}
+		if recorded := testutil.ToFloat64(log.recorded); recorded != 5 {
+			t.Errorf("Expected 5 recorded clicks, got %v", recorded)
+		}
+	})
+
+	t.Run("drops clicks when the queue is full", func(t *testing.T) {
+		log := &ClickLog{
+			queue:   make(chan Click, 1),
+			dropped: prometheus.NewCounter(prometheus.CounterOpts{Name: "dropped"}),
+		}
+
+		log.Record(Click{URLID: "a"})
+		log.Record(Click{URLID: "b"})
+		if dropped := testutil.ToFloat64(log.dropped); dropped != 1 {
+			t.Errorf("Expected 1 dropped click, got %v", dropped)
+		}
+	})
+
+	t.Run("prunes clicks past the retention", func(t *testing.T) {
+		ctx := context.Background()
+		ring := NewClickRing(100)
+		now := time.Now()
+		ring.RecordClicks(ctx, []Click{
+			{URLID: "old", Time: now.Add(-48 * time.Hour)},
+			{URLID: "new", Time: now.Add(-time.Hour)},
+		})
+
+		// The log prunes once when it starts
+		log := NewClickLog(ring, ClickLogOptions{Retention: 24 * time.Hour}, prometheus.NewRegistry())
+		log.Close()
+
+		if listed, _ := ring.ListClicks(ctx, "old", now.Add(-72*time.Hour), now); len(listed) != 0 {
+			t.Errorf("Expected old clicks to be pruned, got %d", len(listed))
+		}
+		if listed, _ := ring.ListClicks(ctx, "new", now.Add(-72*time.Hour), now); len(listed) != 1 {
+			t.Errorf("Expected recent clicks to be kept, got %d", len(listed))
+		}
+		if pruned := testutil.ToFloat64(log.pruned); pruned != 1 {
+			t.Errorf("Expected 1 pruned click, got %v", pruned)
+		}
+	})
+}
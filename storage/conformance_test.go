@@ -0,0 +1,110 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+	"go-url-shortener/storage/storagetest"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMemoryStoreConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+		return storage.NewMemoryStore()
+	})
+}
+
+func TestPersistentMemoryStoreConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+		store, err := storage.OpenMemoryStore(storage.PersistenceOptions{Dir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Failed to open memory store: %v", err)
+		}
+		return store
+	})
+}
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	if !storage.SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+		store, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "urls.db"))
+		if err != nil {
+			t.Fatalf("Failed to create SQLite store: %v", err)
+		}
+		return store
+	})
+
+	t.Run("BufferedHits", func(t *testing.T) {
+		storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+			store, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "urls.db"))
+			if err != nil {
+				t.Fatalf("Failed to create SQLite store: %v", err)
+			}
+			store.BufferHits(storage.HitBufferOptions{FlushInterval: time.Hour, FlushSize: 1000})
+			return store
+		})
+	})
+}
+
+func TestBoltStoreConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+		store, err := storage.NewBoltStore(filepath.Join(t.TempDir(), "urls.bolt"))
+		if err != nil {
+			t.Fatalf("Failed to create bbolt store: %v", err)
+		}
+		return store
+	})
+}
+
+func TestRedisStoreConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+		server := miniredis.RunT(t)
+		store, err := storage.NewRedisStore("redis://" + server.Addr())
+		if err != nil {
+			t.Fatalf("Failed to create Redis store: %v", err)
+		}
+		return store
+	})
+}
+
+func TestCachedStoreConformance(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+		return storage.NewCachedStore(storage.NewMemoryStore(), storage.CacheOptions{Size: 100, TTL: time.Minute}, prometheus.NewRegistry())
+	})
+}
+
+// TestPostgresStoreConformance runs against the database in POSTGRES_TEST_DSN,
+// emptying its tables before every subtest. make test-postgres starts a
+// container for it.
+func TestPostgresStoreConformance(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN not set; run make test-postgres")
+	}
+
+	storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+		store, err := storage.NewPostgresStore(dsn, 4)
+		if err != nil {
+			t.Fatalf("Failed to create PostgreSQL store: %v", err)
+		}
+
+		db, err := sql.Open("pgx", dsn)
+		if err != nil {
+			t.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		}
+		defer db.Close()
+		if _, err := db.ExecContext(context.Background(), "TRUNCATE urls, clicks"); err != nil {
+			t.Fatalf("Failed to truncate tables: %v", err)
+		}
+		return store
+	})
+}
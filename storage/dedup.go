@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dedupTTLSlack is how far the lifetime of a link may be from a requested
+// TTL for the link to be reused, since its expiry was computed just before
+// it was stored
+const dedupTTLSlack = time.Second
+
+// WithDedup makes Create return an existing link for the same destination,
+// with the same expiry or TTL and hit limit, instead of creating another.
+// Links that have expired or used up their hits are never reused. The link
+// is returned as it is: details given with the new one are not applied.
+// With CreateWithID the existing link keeps its own ID.
+func WithDedup() CreateOption {
+	return func(u *URL) {
+		u.dedup = true
+	}
+}
+
+// NormalizeURL returns the form of original used to detect duplicates:
+// scheme and host are lowercased, default ports dropped and an empty path
+// becomes "/". Paths, queries and fragments are kept as they are.
+func NormalizeURL(original string) string {
+	parsedURL, err := url.Parse(original)
+	if err != nil {
+		return original
+	}
+
+	parsedURL.Scheme = strings.ToLower(parsedURL.Scheme)
+	host, port := strings.ToLower(parsedURL.Hostname()), parsedURL.Port()
+	if (parsedURL.Scheme == "http" && port == "80") || (parsedURL.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	switch {
+	case port != "":
+		parsedURL.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		parsedURL.Host = "[" + host + "]"
+	default:
+		parsedURL.Host = host
+	}
+	if parsedURL.Path == "" && parsedURL.RawPath == "" {
+		parsedURL.Path = "/"
+	}
+
+	return parsedURL.String()
+}
+
+// URLHash returns the hex SHA-256 of the normalized URL, which stores index
+// to find duplicates
+func URLHash(original string) string {
+	digest := sha256.Sum256([]byte(NormalizeURL(original)))
+	return hex.EncodeToString(digest[:])
+}
+
+// reusable reports whether existing can be handed out in place of record
+func reusable(existing, record *URL, now time.Time) bool {
+	if existing.Expired(now) || existing.Exhausted() || existing.MaxHits != record.MaxHits {
+		return false
+	}
+	if record.ttl > 0 {
+		if existing.ExpiresAt == nil {
+			return false
+		}
+		lifetime := existing.ExpiresAt.Sub(existing.CreatedAt)
+		return lifetime > record.ttl-dedupTTLSlack && lifetime < record.ttl+dedupTTLSlack
+	}
+	if existing.ExpiresAt == nil || record.ExpiresAt == nil {
+		return existing.ExpiresAt == nil && record.ExpiresAt == nil
+	}
+	return existing.ExpiresAt.Equal(*record.ExpiresAt)
+}
+
+// findReusable returns the oldest of candidates on the same domain that can
+// stand in for record
+func findReusable(candidates []*URL, record *URL) *URL {
+	now := time.Now()
+	var found *URL
+	for _, candidate := range candidates {
+		if candidate.Domain() != record.Domain() || NormalizeURL(candidate.Original) != NormalizeURL(record.Original) || !reusable(candidate, record, now) {
+			continue
+		}
+		if found == nil || candidate.CreatedAt.Before(found.CreatedAt) {
+			found = candidate
+		}
+	}
+	return found
+}
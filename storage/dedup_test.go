@@ -0,0 +1,23 @@
+package storage
+
+import "testing"
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		original string
+		expected string
+	}{
+		{"https://example.com", "https://example.com/"},
+		{"HTTPS://Example.COM:443/Path?Q=1", "https://example.com/Path?Q=1"},
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"http://example.com:8080/a", "http://example.com:8080/a"},
+		{"https://[::1]:443/", "https://[::1]/"},
+		{"https://example.com/a#frag", "https://example.com/a#frag"},
+	}
+
+	for _, tt := range tests {
+		if got := NormalizeURL(tt.original); got != tt.expected {
+			t.Errorf("NormalizeURL(%q) = %q, want %q", tt.original, got, tt.expected)
+		}
+	}
+}
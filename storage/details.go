@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+// Details describe a link for people looking for it in the directory.
+// FaviconURL and ImageURL (the Open Graph image) come from the destination
+// page, as do the title and description when the link was created without.
+type Details struct {
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	FaviconURL  string   `json:"favicon_url,omitempty"`
+	ImageURL    string   `json:"image_url,omitempty"`
+}
+
+// WithDetails sets the title, description and tags of the URL
+func WithDetails(details Details) CreateOption {
+	return func(u *URL) {
+		u.Details = details.normalize()
+	}
+}
+
+// DetailsChange lists the details to change on a link; nil fields are left
+// as they are
+type DetailsChange struct {
+	Title       *string
+	Description *string
+	Tags        *[]string
+}
+
+// UpdateOption changes more of a URL record along with its destination
+type UpdateOption func(*updateOptions)
+
+// updateOptions collects the UpdateOptions
+type updateOptions struct {
+	change      DetailsChange
+	fill        *Details
+	destination string
+}
+
+// ChangeDetails sets the details that are not nil in change
+func ChangeDetails(change DetailsChange) UpdateOption {
+	return func(o *updateOptions) {
+		if change.Title != nil {
+			o.change.Title = change.Title
+		}
+		if change.Description != nil {
+			o.change.Description = change.Description
+		}
+		if change.Tags != nil {
+			tags := NormalizeTags(*change.Tags)
+			o.change.Tags = &tags
+		}
+	}
+}
+
+// FillDetails sets the favicon and image from details, and the title and
+// description only where the URL has none, so that details given by people
+// win over those found on the destination page
+func FillDetails(details Details) UpdateOption {
+	return func(o *updateOptions) {
+		o.fill = &details
+	}
+}
+
+// IfDestination makes the update fail with ErrNotFound unless the URL still
+// points to original
+func IfDestination(original string) UpdateOption {
+	return func(o *updateOptions) {
+		o.destination = original
+	}
+}
+
+// collectUpdate collects the changes made by opts
+func collectUpdate(opts []UpdateOption) updateOptions {
+	var o updateOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// changesDetails reports whether the update changes any details
+func (o updateOptions) changesDetails() bool {
+	return o.change.Title != nil || o.change.Description != nil || o.change.Tags != nil || o.fill != nil
+}
+
+// details returns details with the changes made
+func (o updateOptions) details(details Details) Details {
+	if o.change.Title != nil {
+		details.Title = *o.change.Title
+	}
+	if o.change.Description != nil {
+		details.Description = *o.change.Description
+	}
+	if o.change.Tags != nil {
+		details.Tags = *o.change.Tags
+	}
+	if o.fill != nil {
+		if o.change.Title == nil && details.Title == "" {
+			details.Title = o.fill.Title
+		}
+		if o.change.Description == nil && details.Description == "" {
+			details.Description = o.fill.Description
+		}
+		details.FaviconURL = o.fill.FaviconURL
+		details.ImageURL = o.fill.ImageURL
+	}
+	return details
+}
+
+// detailField is a stored detail and its new value
+type detailField struct {
+	name  string
+	value string
+}
+
+// detailFields lists the details the update sets, and those it sets only
+// where they are empty, for the backends that change them field by field
+func (o updateOptions) detailFields() (set, fill []detailField) {
+	if o.change.Title != nil {
+		set = append(set, detailField{"title", *o.change.Title})
+	} else if o.fill != nil {
+		fill = append(fill, detailField{"title", o.fill.Title})
+	}
+	if o.change.Description != nil {
+		set = append(set, detailField{"description", *o.change.Description})
+	} else if o.fill != nil {
+		fill = append(fill, detailField{"description", o.fill.Description})
+	}
+	if o.change.Tags != nil {
+		set = append(set, detailField{"tags", encodeTags(*o.change.Tags)})
+	}
+	if o.fill != nil {
+		set = append(set, detailField{"favicon_url", o.fill.FaviconURL}, detailField{"image_url", o.fill.ImageURL})
+	}
+	return set, fill
+}
+
+// normalize returns a copy of the details with normalized tags, so that
+// stores never share the caller's slice
+func (d Details) normalize() Details {
+	d.Tags = NormalizeTags(d.Tags)
+	return d
+}
+
+// NormalizeTags splits tags at commas, lowercases and trims them, drops empty
+// and repeated ones and sorts the rest. It returns nil when no tags remain.
+func NormalizeTags(tags []string) []string {
+	seen := make(map[string]bool, len(tags))
+	var normalized []string
+	for _, list := range tags {
+		for _, tag := range strings.Split(list, ",") {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" || seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// HasTag reports whether the URL is tagged with tag
+func (d *Details) HasTag(tag string) bool {
+	for _, other := range d.Tags {
+		if other == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+// Links are namespaced by the domain they are served from. The store key of
+// a link is "<domain>/<code>", or just "<code>" for the default domain, so
+// links created before domains existed keep their keys. Codes never contain
+// a slash, which keeps the two forms apart.
+
+// LinkKey returns the store key of code on domain
+func LinkKey(domain, code string) string {
+	if domain == "" {
+		return code
+	}
+	return domain + "/" + code
+}
+
+// SplitLinkKey returns the domain and code of a store key
+func SplitLinkKey(key string) (domain, code string) {
+	if domain, code, ok := strings.Cut(key, "/"); ok {
+		return domain, code
+	}
+	return "", key
+}
+
+// NormalizeDomain lowercases a host name and strips any port and trailing dot,
+// so Host headers and configured domains compare equal
+func NormalizeDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// WithDomain makes Create generate the code within domain. With CreateWithID
+// the domain is already part of the key, see LinkKey.
+func WithDomain(domain string) CreateOption {
+	return func(u *URL) {
+		u.domain = domain
+	}
+}
+
+// createDomain returns the domain set by WithDomain among opts
+func createDomain(opts []CreateOption) string {
+	var record URL
+	for _, opt := range opts {
+		opt(&record)
+	}
+	return record.domain
+}
+
+// Domain returns the domain the link is served from, "" for the default one
+func (u *URL) Domain() string {
+	domain, _ := SplitLinkKey(u.ID)
+	return domain
+}
+
+// urlFields is URL without its JSON methods
+type urlFields URL
+
+// urlJSON is the wire form of URL: the code and domain are separate fields
+// instead of one store key
+type urlJSON struct {
+	*urlFields
+	ID     string `json:"id"`
+	Domain string `json:"domain,omitempty"`
+}
+
+// MarshalJSON writes the store key as separate id and domain fields
+func (u URL) MarshalJSON() ([]byte, error) {
+	domain, code := SplitLinkKey(u.ID)
+	return json.Marshal(urlJSON{urlFields: (*urlFields)(&u), ID: code, Domain: domain})
+}
+
+// UnmarshalJSON joins the id and domain fields back into the store key
+func (u *URL) UnmarshalJSON(data []byte) error {
+	wire := urlJSON{urlFields: (*urlFields)(u)}
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	u.ID = LinkKey(wire.Domain, wire.ID)
+	return nil
+}
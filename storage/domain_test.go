@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLinkKey(t *testing.T) {
+	if key := LinkKey("", "abc"); key != "abc" {
+		t.Errorf("Expected the default domain to keep the bare code, got %q", key)
+	}
+	domain, code := SplitLinkKey(LinkKey("go.team.io", "abc"))
+	if domain != "go.team.io" || code != "abc" {
+		t.Errorf("Expected go.team.io and abc, got %q and %q", domain, code)
+	}
+	for host, expected := range map[string]string{
+		"Go.Team.IO":      "go.team.io",
+		"go.team.io:8080": "go.team.io",
+		"go.team.io.":     "go.team.io",
+		"[::1]:8080":      "::1",
+	} {
+		if normalized := NormalizeDomain(host); normalized != expected {
+			t.Errorf("NormalizeDomain(%q) = %q, expected %q", host, normalized, expected)
+		}
+	}
+}
+
+func TestURLJSON(t *testing.T) {
+	url := &URL{ID: LinkKey("go.team.io", "abc"), Original: "https://example.com", CreatedAt: time.Now().UTC(), Hits: 2}
+
+	data, err := json.Marshal(url)
+	if err != nil {
+		t.Fatalf("Failed to marshal URL: %v", err)
+	}
+	var fields map[string]any
+	json.Unmarshal(data, &fields)
+	if fields["id"] != "abc" || fields["domain"] != "go.team.io" || fields["hits"] != 2.0 {
+		t.Errorf("Expected separate id and domain fields, got %s", data)
+	}
+
+	var decoded URL
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal URL: %v", err)
+	}
+	if decoded.ID != url.ID || decoded.Hits != 2 || !decoded.CreatedAt.Equal(url.CreatedAt) {
+		t.Errorf("Expected %+v, got %+v", url, decoded)
+	}
+
+	// Links on the default domain look as they always have
+	data, _ = json.Marshal(URL{ID: "abc"})
+	fields = nil
+	json.Unmarshal(data, &fields)
+	if _, ok := fields["domain"]; ok || fields["id"] != "abc" {
+		t.Errorf("Expected a bare id and no domain field, got %s", data)
+	}
+}
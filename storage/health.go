@@ -0,0 +1,51 @@
+package storage
+
+import "time"
+
+// Health filters accepted by ListOptions
+const (
+	HealthBroken    = "broken"
+	HealthHealthy   = "healthy"
+	HealthUnchecked = "unchecked"
+)
+
+// Health is the outcome of the latest check of a link's destination. Links
+// that were never checked, or whose destination changed since, have none.
+type Health struct {
+	// StatusCode is the final HTTP status, or 0 when there was no response
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	LatencyMS  int64  `json:"latency_ms"`
+
+	CheckedAt time.Time `json:"checked_at"`
+
+	// LastOKAt is the time of the latest check that found the link healthy
+	LastOKAt *time.Time `json:"last_ok_at,omitempty"`
+}
+
+// Broken reports whether the check got no response or an error status
+func (h *Health) Broken() bool {
+	return h.StatusCode == 0 || h.StatusCode >= 400
+}
+
+// healthState returns HealthUnchecked, HealthBroken or HealthHealthy for url
+func healthState(url *URL) string {
+	if url.Health == nil {
+		return HealthUnchecked
+	}
+	if url.Health.Broken() {
+		return HealthBroken
+	}
+	return HealthHealthy
+}
+
+// normalize returns a copy of the health in UTC without a monotonic clock
+// reading, so that it matches what is read back from every store
+func (h Health) normalize() *Health {
+	h.CheckedAt = h.CheckedAt.UTC().Round(0)
+	if h.LastOKAt != nil {
+		lastOK := h.LastOKAt.UTC().Round(0)
+		h.LastOKAt = &lastOK
+	}
+	return &h
+}
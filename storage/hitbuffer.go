@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults for write-behind hit counting
+const (
+	DefaultHitFlushInterval = time.Second
+	DefaultHitFlushSize     = 1000
+)
+
+// HitBufferOptions configures write-behind hit counting
+type HitBufferOptions struct {
+	// FlushInterval is how often buffered hits are written
+	FlushInterval time.Duration
+
+	// FlushSize triggers an early flush once this many hits are buffered
+	FlushSize int
+
+	// MaxPending caps how many distinct IDs are held while flushes keep
+	// failing; hits for further IDs are dropped. Defaults to 10 * FlushSize.
+	MaxPending int
+}
+
+// Flusher is implemented by stores that buffer writes and can be asked to
+// write them out, for example before a graceful shutdown
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// MetricsRegisterer is implemented by stores that expose their own metrics
+type MetricsRegisterer interface {
+	RegisterMetrics(registry *prometheus.Registry)
+}
+
+// hitBuffer accumulates hit increments in memory, keyed by ID, and writes
+// them in batches on an interval or once FlushSize hits are pending
+type hitBuffer struct {
+	opts  HitBufferOptions
+	write func(ctx context.Context, batch map[string]int) error
+
+	mutex    sync.Mutex
+	pending  map[string]int
+	count    int
+	flushing map[string]int
+	dropped  int
+	flushed  int
+
+	// flushMutex makes sure only one batch is written at a time
+	flushMutex sync.Mutex
+
+	kick      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newHitBuffer starts a buffer that hands batches to write
+func newHitBuffer(opts HitBufferOptions, write func(ctx context.Context, batch map[string]int) error) *hitBuffer {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultHitFlushInterval
+	}
+	if opts.FlushSize <= 0 {
+		opts.FlushSize = DefaultHitFlushSize
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 10 * opts.FlushSize
+	}
+
+	b := &hitBuffer{
+		opts:     opts,
+		write:    write,
+		pending:  make(map[string]int),
+		flushing: make(map[string]int),
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// run flushes on every tick or kick until close is called
+func (b *hitBuffer) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		case <-b.kick:
+		}
+
+		// Failed batches go back into the buffer and are retried next time
+		ctx, cancel := context.WithTimeout(context.Background(), b.opts.FlushInterval+5*time.Second)
+		b.flush(ctx)
+		cancel()
+	}
+}
+
+// add records one hit for id
+func (b *hitBuffer) add(id string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.pending[id]; !ok && len(b.pending) >= b.opts.MaxPending {
+		b.dropped++
+		return
+	}
+	b.pending[id]++
+	b.count++
+
+	if b.count >= b.opts.FlushSize {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pendingFor returns the hits for id that are not yet visible in storage
+func (b *hitBuffer) pendingFor(id string) int {
+	if b == nil {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.pending[id] + b.flushing[id]
+}
+
+// total returns all hits that are not yet visible in storage
+func (b *hitBuffer) total() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	total := b.count
+	for _, hits := range b.flushing {
+		total += hits
+	}
+	return total
+}
+
+// discard forgets buffered hits for a deleted ID, including any in a batch
+// being written. The write itself goes on, but finds no row to update.
+func (b *hitBuffer) discard(id string) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.count -= b.pending[id]
+	delete(b.pending, id)
+	delete(b.flushing, id)
+}
+
+// flush writes all buffered hits. On failure they are put back, up to
+// MaxPending distinct IDs, and the rest are counted as dropped.
+func (b *hitBuffer) flush(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	b.flushMutex.Lock()
+	defer b.flushMutex.Unlock()
+
+	// Keep the batch visible to readers until it has been written. The copy
+	// in flushing loses IDs discarded meanwhile, so those are neither counted
+	// as flushed nor put back on failure.
+	b.mutex.Lock()
+	batch := b.pending
+	b.pending = make(map[string]int)
+	b.flushing = make(map[string]int, len(batch))
+	for id, hits := range batch {
+		b.flushing[id] = hits
+	}
+	b.count = 0
+	b.mutex.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := b.write(ctx, batch)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	kept := b.flushing
+	b.flushing = make(map[string]int)
+	if err == nil {
+		for _, hits := range kept {
+			b.flushed += hits
+		}
+		return nil
+	}
+
+	for id, hits := range kept {
+		if _, ok := b.pending[id]; !ok && len(b.pending) >= b.opts.MaxPending {
+			b.dropped += hits
+			continue
+		}
+		b.pending[id] += hits
+		b.count += hits
+	}
+	return err
+}
+
+// close stops the flush loop and writes what is left, counting anything
+// that could not be written as dropped
+func (b *hitBuffer) close(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+
+	b.closeOnce.Do(func() { close(b.stop) })
+	<-b.done
+
+	err := b.flush(ctx)
+	if err != nil {
+		b.mutex.Lock()
+		b.dropped += b.count
+		b.pending = make(map[string]int)
+		b.count = 0
+		b.mutex.Unlock()
+	}
+	return err
+}
+
+// registerMetrics exposes pending, flushed and dropped hits
+func (b *hitBuffer) registerMetrics(registry *prometheus.Registry) {
+	registry.MustRegister(
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "url_shortener_hits_pending",
+				Help: "Number of hits buffered in memory and not yet written to storage",
+			},
+			func() float64 { return float64(b.total()) },
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "url_shortener_hits_flushed_total",
+				Help: "Total number of buffered hits written to storage",
+			},
+			func() float64 {
+				b.mutex.Lock()
+				defer b.mutex.Unlock()
+				return float64(b.flushed)
+			},
+		),
+		prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name: "url_shortener_hits_dropped_total",
+				Help: "Total number of buffered hits lost because they could not be written",
+			},
+			func() float64 {
+				b.mutex.Lock()
+				defer b.mutex.Unlock()
+				return float64(b.dropped)
+			},
+		),
+	)
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLiteWriteBehindHits(t *testing.T) {
+	if !SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.db")
+
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store: %v", err)
+	}
+	store.BufferHits(HitBufferOptions{FlushInterval: time.Hour, FlushSize: 1000})
+
+	url, err := store.Create(ctx, "https://example.com/buffered")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Get(ctx, url.ID); err != nil {
+			t.Fatalf("Failed to get URL: %v", err)
+		}
+	}
+
+	// Nothing has been written yet, but reads include buffered hits
+	var stored int
+	if err := store.db.QueryRow("SELECT hits FROM urls WHERE id = ?", url.ID).Scan(&stored); err != nil {
+		t.Fatalf("Failed to read hits: %v", err)
+	}
+	if stored != 0 {
+		t.Errorf("Expected no hits written before flush, got %d", stored)
+	}
+	looked, err := store.Lookup(ctx, url.ID)
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if looked.Hits != 3 {
+		t.Errorf("Expected 3 hits including buffered ones, got %d", looked.Hits)
+	}
+
+	// Close writes the buffer out
+	if _, err := store.Get(ctx, url.ID); err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+
+	reopened, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen SQLite store: %v", err)
+	}
+	defer reopened.Close()
+
+	looked, err = reopened.Lookup(ctx, url.ID)
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if looked.Hits != 4 {
+		t.Errorf("Expected 4 hits after close, got %d", looked.Hits)
+	}
+}
+
+func TestHitBuffer(t *testing.T) {
+	t.Run("flushes at size threshold", func(t *testing.T) {
+		written := make(chan map[string]int, 1)
+		buffer := newHitBuffer(HitBufferOptions{FlushInterval: time.Hour, FlushSize: 3}, func(ctx context.Context, batch map[string]int) error {
+			written <- batch
+			return nil
+		})
+		defer buffer.close(context.Background())
+
+		buffer.add("a")
+		buffer.add("b")
+		buffer.add("a")
+
+		select {
+		case batch := <-written:
+			if batch["a"] != 2 || batch["b"] != 1 {
+				t.Errorf("Unexpected batch: %v", batch)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a flush once the threshold was reached")
+		}
+	})
+
+	t.Run("keeps hits when a flush fails", func(t *testing.T) {
+		var mutex sync.Mutex
+		failing := true
+		written := make(map[string]int)
+		buffer := newHitBuffer(HitBufferOptions{FlushInterval: time.Hour, FlushSize: 100, MaxPending: 2}, func(ctx context.Context, batch map[string]int) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failing {
+				return errors.New("storage unavailable")
+			}
+			for id, hits := range batch {
+				written[id] += hits
+			}
+			return nil
+		})
+
+		buffer.add("a")
+		buffer.add("b")
+		if err := buffer.flush(context.Background()); err == nil {
+			t.Fatal("Expected flush to fail")
+		}
+		if buffer.pendingFor("a") != 1 || buffer.total() != 2 {
+			t.Errorf("Expected failed hits to stay buffered, got %d total", buffer.total())
+		}
+
+		// The buffer is full, so hits for a new ID are dropped
+		buffer.add("c")
+		buffer.add("a")
+		if buffer.dropped != 1 {
+			t.Errorf("Expected 1 dropped hit, got %d", buffer.dropped)
+		}
+
+		mutex.Lock()
+		failing = false
+		mutex.Unlock()
+		if err := buffer.close(context.Background()); err != nil {
+			t.Fatalf("Failed to close buffer: %v", err)
+		}
+		if written["a"] != 2 || written["b"] != 1 || written["c"] != 0 {
+			t.Errorf("Unexpected writes: %v", written)
+		}
+		if buffer.total() != 0 {
+			t.Errorf("Expected empty buffer after close, got %d", buffer.total())
+		}
+	})
+
+	t.Run("forgets hits for an ID deleted mid-flush", func(t *testing.T) {
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		buffer := newHitBuffer(HitBufferOptions{FlushInterval: time.Hour, FlushSize: 100}, func(ctx context.Context, batch map[string]int) error {
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			return errors.New("storage unavailable")
+		})
+		defer buffer.close(context.Background())
+
+		buffer.add("a")
+		buffer.add("a")
+		buffer.add("b")
+		flushed := make(chan error, 1)
+		go func() { flushed <- buffer.flush(context.Background()) }()
+
+		// Delete a while its hits are being written, then let the write fail
+		<-started
+		buffer.discard("a")
+		if buffer.pendingFor("a") != 0 || buffer.total() != 1 {
+			t.Errorf("Expected only b's hit pending, got %d for a and %d total", buffer.pendingFor("a"), buffer.total())
+		}
+		close(release)
+		if err := <-flushed; err == nil {
+			t.Fatal("Expected flush to fail")
+		}
+
+		// Only b's hit is put back for the next attempt
+		if buffer.pendingFor("a") != 0 || buffer.pendingFor("b") != 1 {
+			t.Errorf("Expected 0 hits for a and 1 for b, got %d and %d", buffer.pendingFor("a"), buffer.pendingFor("b"))
+		}
+		if buffer.total() != 1 {
+			t.Errorf("Expected 1 pending hit, got %d", buffer.total())
+		}
+	})
+}
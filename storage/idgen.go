@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Alphabets used by the built-in generators
+const (
+	// Base62Alphabet contains digits and both letter cases
+	Base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	// UnambiguousAlphabet drops characters that are easily confused (0/O, 1/l/I)
+	UnambiguousAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+	// LowercaseAlphabet survives case-folding by mail clients and humans
+	LowercaseAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+)
+
+const (
+	// DefaultIDLength is the starting length of generated IDs
+	DefaultIDLength = 6
+
+	// maxIDLength bounds how far IDs are lengthened on repeated collisions
+	maxIDLength = 32
+
+	// idAttemptsPerLength is how many collisions are tolerated before lengthening
+	idAttemptsPerLength = 3
+)
+
+// IDGenerator produces candidate short IDs
+type IDGenerator interface {
+	// Generate returns a random ID scaled to the given length
+	Generate(length int) (string, error)
+}
+
+// ContentIDGenerator derives IDs from the destination URL, so that the same
+// URL always gets the same ID. Longer lengths extend shorter IDs.
+type ContentIDGenerator interface {
+	IDGenerator
+	GenerateFor(original string, length int) (string, error)
+}
+
+// IDConfigurable is implemented by stores whose ID generation can be changed
+type IDConfigurable interface {
+	// SetIDGenerator sets the generator and the starting ID length
+	SetIDGenerator(generator IDGenerator, length int)
+}
+
+// NewIDGenerator returns the generator for a named strategy
+func NewIDGenerator(strategy string) (IDGenerator, error) {
+	switch strategy {
+	case "base62":
+		return AlphabetGenerator(Base62Alphabet), nil
+	case "unambiguous":
+		return AlphabetGenerator(UnambiguousAlphabet), nil
+	case "lowercase":
+		return AlphabetGenerator(LowercaseAlphabet), nil
+	case "words":
+		return WordGenerator{}, nil
+	case "hash":
+		return HashGenerator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown id strategy %q", strategy)
+	}
+}
+
+// LowercaseIDs reports whether generator only produces lower-case IDs, so
+// that links can be found whatever the case they are typed in
+func LowercaseIDs(generator IDGenerator) bool {
+	switch g := generator.(type) {
+	case AlphabetGenerator:
+		return strings.ToLower(string(g)) == string(g)
+	case WordGenerator:
+		return true
+	}
+	return false
+}
+
+// AlphabetGenerator generates IDs by drawing characters uniformly from an alphabet
+type AlphabetGenerator string
+
+// Generate implements IDGenerator.Generate
+func (a AlphabetGenerator) Generate(length int) (string, error) {
+	return randomString(string(a), length)
+}
+
+// WordGenerator generates readable IDs like "brave-otter-4217".
+// The two words count as two characters of the length and the rest are
+// digits in the suffix, so each step in length multiplies the keyspace by ten.
+type WordGenerator struct{}
+
+// Generate implements IDGenerator.Generate
+func (WordGenerator) Generate(length int) (string, error) {
+	digits := length - 2
+	if digits < 1 {
+		digits = 1
+	}
+
+	adjective, err := randomIndexes(1, len(adjectives))
+	if err != nil {
+		return "", err
+	}
+	noun, err := randomIndexes(1, len(nouns))
+	if err != nil {
+		return "", err
+	}
+	suffix, err := randomString("0123456789", digits)
+	if err != nil {
+		return "", err
+	}
+
+	return adjectives[adjective[0]] + "-" + nouns[noun[0]] + "-" + suffix, nil
+}
+
+// HashGenerator derives base62 IDs from a hash of the normalized URL. Creating
+// the same URL twice yields the same link; IDs only get longer when two URLs
+// share a prefix.
+type HashGenerator struct{}
+
+// Generate implements IDGenerator.Generate with random IDs, for callers
+// that have no URL to hash
+func (HashGenerator) Generate(length int) (string, error) {
+	return randomString(Base62Alphabet, length)
+}
+
+// GenerateFor implements ContentIDGenerator.GenerateFor
+func (HashGenerator) GenerateFor(original string, length int) (string, error) {
+	digest := sha256.Sum256([]byte(NormalizeURL(original)))
+	encoded := new(big.Int).SetBytes(digest[:]).Text(62)
+	if length > len(encoded) {
+		return "", fmt.Errorf("hash ids are at most %d characters", len(encoded))
+	}
+	return encoded[:length], nil
+}
+
+var adjectives = []string{
+	"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp",
+	"eager", "fancy", "fast", "gentle", "golden", "happy", "jolly", "keen",
+	"lively", "lucky", "mellow", "merry", "nimble", "noble", "proud", "quick",
+	"quiet", "rapid", "shiny", "silent", "smart", "sunny", "swift", "witty",
+}
+
+var nouns = []string{
+	"badger", "beaver", "bison", "cobra", "comet", "crane", "falcon", "ferret",
+	"gecko", "heron", "koala", "lemur", "lynx", "marten", "meadow", "moose",
+	"otter", "owl", "panda", "parrot", "puffin", "raven", "river", "robin",
+	"salmon", "seal", "sparrow", "tiger", "walrus", "whale", "willow", "zebra",
+}
+
+// randomString returns length characters drawn uniformly from alphabet
+func randomString(alphabet string, length int) (string, error) {
+	indexes, err := randomIndexes(length, len(alphabet))
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.Grow(length)
+	for _, i := range indexes {
+		b.WriteByte(alphabet[i])
+	}
+	return b.String(), nil
+}
+
+// randomIndexes returns count uniform random numbers in [0, n) for n <= 256*256,
+// rejecting samples that would bias the result towards low values
+func randomIndexes(count, n int) ([]int, error) {
+	if n <= 0 || n > 1<<16 {
+		return nil, errors.New("alphabet size out of range")
+	}
+
+	limit := (1 << 16) - (1<<16)%n
+	result := make([]int, 0, count)
+	buf := make([]byte, 2*count)
+	for len(result) < count {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		for i := 0; i+1 < len(buf) && len(result) < count; i += 2 {
+			v := int(buf[i])<<8 | int(buf[i+1])
+			if v < limit {
+				result = append(result, v%n)
+			}
+		}
+	}
+	return result, nil
+}
+
+// idAllocator picks unused IDs for a store, retrying on collisions and
+// lengthening IDs once the keyspace at the current length gets crowded
+type idAllocator struct {
+	generator IDGenerator
+	length    int
+	mutex     sync.RWMutex
+}
+
+// SetIDGenerator implements IDConfigurable.SetIDGenerator
+func (a *idAllocator) SetIDGenerator(generator IDGenerator, length int) {
+	if length < 1 {
+		length = DefaultIDLength
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.generator = generator
+	a.length = length
+}
+
+// current returns the generator and ID length to use, applying defaults
+func (a *idAllocator) current() (IDGenerator, int) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	generator, length := a.generator, a.length
+	if generator == nil {
+		generator = AlphabetGenerator(Base62Alphabet)
+	}
+	if length == 0 {
+		length = DefaultIDLength
+	}
+	return generator, length
+}
+
+// grow lengthens IDs unless another caller already did so
+func (a *idAllocator) grow(from int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.length <= from {
+		a.length = from + 1
+	}
+}
+
+// allocate calls insert with fresh IDs for original on domain until one does
+// not collide. extra holds options insert must add to the caller's.
+func (a *idAllocator) allocate(original, domain string, insert func(id string, extra ...CreateOption) (*URL, error)) (*URL, error) {
+	generator, _ := a.current()
+	if content, ok := generator.(ContentIDGenerator); ok {
+		return a.allocateFor(content, original, domain, insert)
+	}
+
+	for {
+		generator, length := a.current()
+		for attempt := 0; attempt < idAttemptsPerLength; attempt++ {
+			id, err := generator.Generate(length)
+			if err != nil {
+				return nil, err
+			}
+
+			url, err := insert(LinkKey(domain, id))
+			if err != ErrConflict {
+				return url, err
+			}
+		}
+
+		// Too many collisions at this length, so grow IDs for everyone
+		if length >= maxIDLength {
+			return nil, ErrConflict
+		}
+		a.grow(length)
+	}
+}
+
+// allocateFor tries ever longer content-derived IDs. The store is asked to
+// reuse an existing link for the same URL, so a collision means a different
+// URL, or a link for this one that cannot be reused, holds the ID.
+func (a *idAllocator) allocateFor(generator ContentIDGenerator, original, domain string, insert func(id string, extra ...CreateOption) (*URL, error)) (*URL, error) {
+	_, length := a.current()
+	for ; length <= maxIDLength; length++ {
+		id, err := generator.GenerateFor(original, length)
+		if err != nil {
+			return nil, err
+		}
+
+		url, err := insert(LinkKey(domain, id), WithDedup())
+		if err != ErrConflict {
+			return url, err
+		}
+	}
+	return nil, ErrConflict
+}
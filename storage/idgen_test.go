@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// repeatGenerator always returns the same ID for a given length
+type repeatGenerator struct{}
+
+func (repeatGenerator) Generate(length int) (string, error) {
+	return strings.Repeat("a", length), nil
+}
+
+func TestIDGenerators(t *testing.T) {
+	tests := []struct {
+		strategy string
+		pattern  string
+	}{
+		{"base62", `^[0-9A-Za-z]{6}$`},
+		{"unambiguous", `^[2-9A-HJ-NP-Za-km-z]{6}$`},
+		{"lowercase", `^[0-9a-z]{6}$`},
+		{"words", `^[a-z]+-[a-z]+-[0-9]{4}$`},
+		{"hash", `^[0-9A-Za-z]{6}$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			generator, err := NewIDGenerator(tt.strategy)
+			if err != nil {
+				t.Fatalf("Failed to create generator: %v", err)
+			}
+
+			pattern := regexp.MustCompile(tt.pattern)
+			for i := 0; i < 100; i++ {
+				id, err := generator.Generate(6)
+				if err != nil {
+					t.Fatalf("Failed to generate ID: %v", err)
+				}
+				if !pattern.MatchString(id) {
+					t.Fatalf("ID %q does not match %s", id, tt.pattern)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := NewIDGenerator("unknown"); err == nil {
+			t.Error("Expected error for unknown strategy")
+		}
+	})
+}
+
+func TestWordGeneratorKeyspace(t *testing.T) {
+	// Each extra character adds a digit, so longer IDs repeat less often
+	distinct := func(length int) int {
+		seen := make(map[string]bool)
+		for i := 0; i < 5000; i++ {
+			id, err := WordGenerator{}.Generate(length)
+			if err != nil {
+				t.Fatalf("Failed to generate ID: %v", err)
+			}
+			seen[id] = true
+		}
+		return len(seen)
+	}
+
+	previous := distinct(3)
+	for length := 4; length <= 5; length++ {
+		count := distinct(length)
+		if count <= previous {
+			t.Errorf("Expected more than %d distinct IDs at length %d, got %d", previous, length, count)
+		}
+		previous = count
+	}
+}
+
+func TestIDCollisions(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	defer store.Close()
+	store.SetIDGenerator(repeatGenerator{}, 4)
+
+	// Every create collides at the current length, so IDs must keep growing
+	for _, expected := range []string{"aaaa", "aaaaa", "aaaaaa"} {
+		url, err := store.Create(ctx, "https://example.com/collision")
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		if url.ID != expected {
+			t.Errorf("Expected ID %q, got %q", expected, url.ID)
+		}
+	}
+
+	// Existing records must not be overwritten
+	count, err := store.GetTotalCount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get total count: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("Expected 3 URLs, got %d", count)
+	}
+}
+
+func TestHashIDs(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	defer store.Close()
+	store.SetIDGenerator(HashGenerator{}, 6)
+
+	first, err := store.Create(ctx, "https://example.com/content")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	again, err := store.Create(ctx, "HTTPS://EXAMPLE.COM/content")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("Expected the same URL to get the same ID, got %q and %q", first.ID, again.ID)
+	}
+
+	// Take the next URL's ID with an alias, so it has to grow
+	expected, err := HashGenerator{}.GenerateFor("https://example.com/other", 6)
+	if err != nil {
+		t.Fatalf("Failed to generate ID: %v", err)
+	}
+	if _, err := store.CreateWithID(ctx, expected, "https://example.com/squatter"); err != nil {
+		t.Fatalf("Failed to create alias: %v", err)
+	}
+	other, err := store.Create(ctx, "https://example.com/other")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if len(other.ID) != 7 || !strings.HasPrefix(other.ID, expected) {
+		t.Errorf("Expected ID extending %q, got %q", expected, other.ID)
+	}
+}
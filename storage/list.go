@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort fields accepted by ListOptions
+const (
+	SortByCreatedAt = "created_at"
+	SortByHits      = "hits"
+)
+
+// iterateBatchSize is how many URLs Store.Iterate reads at a time
+const iterateBatchSize = 500
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+// or was issued for a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions controls filtering, ordering and pagination for Store.List
+type ListOptions struct {
+	// SortBy is SortByCreatedAt (default) or SortByHits
+	SortBy string
+
+	// Descending reverses the sort order
+	Descending bool
+
+	// Limit caps the number of URLs returned; zero means no limit
+	Limit int
+
+	// Cursor continues a previous listing from its NextCursor
+	Cursor string
+
+	// CreatedFrom and CreatedTo bound the creation time (inclusive, exclusive)
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+
+	// Host keeps only URLs whose destination host contains this substring
+	Host string
+
+	// Domain keeps only links served from this domain ("" for the default
+	// one); nil keeps links on every domain
+	Domain *string
+
+	// Health keeps only links in this state: HealthBroken, HealthHealthy
+	// or HealthUnchecked
+	Health string
+}
+
+// ListPage is one page of a listing
+type ListPage struct {
+	URLs       []*URL `json:"urls"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// listCursor identifies the last URL of a page by its sort key and ID
+type listCursor struct {
+	SortBy    string    `json:"s"`
+	Desc      bool      `json:"d,omitempty"`
+	Hits      int       `json:"h,omitempty"`
+	CreatedAt time.Time `json:"c,omitempty"`
+	ID        string    `json:"i"`
+}
+
+// normalize applies defaults and rejects unknown sort fields
+func (o *ListOptions) normalize() error {
+	if o.SortBy == "" {
+		o.SortBy = SortByCreatedAt
+	}
+	if o.SortBy != SortByCreatedAt && o.SortBy != SortByHits {
+		return ErrInvalid
+	}
+	if o.Health != "" && o.Health != HealthBroken && o.Health != HealthHealthy && o.Health != HealthUnchecked {
+		return ErrInvalid
+	}
+	o.Host = strings.ToLower(o.Host)
+	return nil
+}
+
+// encodeCursor returns the cursor that continues after url
+func (o *ListOptions) encodeCursor(url *URL) string {
+	cursor := listCursor{SortBy: o.SortBy, Desc: o.Descending, ID: url.ID}
+	if o.SortBy == SortByHits {
+		cursor.Hits = url.Hits
+	} else {
+		cursor.CreatedAt = url.CreatedAt.UTC()
+	}
+
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses o.Cursor, returning nil when there is none
+func (o *ListOptions) decodeCursor() (*listCursor, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.SortBy != o.SortBy || cursor.Desc != o.Descending || cursor.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// matches reports whether url passes the filters in o
+func (o *ListOptions) matches(url *URL) bool {
+	if o.CreatedFrom != nil && url.CreatedAt.Before(*o.CreatedFrom) {
+		return false
+	}
+	if o.CreatedTo != nil && !url.CreatedAt.Before(*o.CreatedTo) {
+		return false
+	}
+	if o.Host != "" && !strings.Contains(hostOf(url.Original), o.Host) {
+		return false
+	}
+	if o.Domain != nil && url.Domain() != *o.Domain {
+		return false
+	}
+	if o.Health != "" && healthState(url) != o.Health {
+		return false
+	}
+	return true
+}
+
+// compare orders a before b (-1), after b (1) or equal (0) by the sort key, then ID
+func (o *ListOptions) compare(a *URL, b *listCursor) int {
+	result := 0
+	if o.SortBy == SortByHits {
+		result = compareInts(a.Hits, b.Hits)
+	} else if a.CreatedAt.Before(b.CreatedAt) {
+		result = -1
+	} else if a.CreatedAt.After(b.CreatedAt) {
+		result = 1
+	}
+	if result == 0 {
+		result = strings.Compare(a.ID, b.ID)
+	}
+	if o.Descending {
+		result = -result
+	}
+	return result
+}
+
+// page trims urls to the limit, setting NextCursor when more remain.
+// Callers fetch up to Limit+1 URLs so that a further page can be detected.
+func (o *ListOptions) page(urls []*URL) *ListPage {
+	result := &ListPage{URLs: urls}
+	if o.Limit > 0 && len(urls) > o.Limit {
+		result.URLs = urls[:o.Limit]
+		result.NextCursor = o.encodeCursor(result.URLs[o.Limit-1])
+	}
+	if result.URLs == nil {
+		result.URLs = []*URL{}
+	}
+	return result
+}
+
+// listInMemory filters, sorts and pages urls, for stores without indexes to
+// push the work down to. urls must be copies the caller may hand out.
+func listInMemory(urls []*URL, opts ListOptions) (*ListPage, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := opts.decodeCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	matched := urls[:0]
+	for _, url := range urls {
+		if !opts.matches(url) {
+			continue
+		}
+		if cursor != nil && opts.compare(url, cursor) <= 0 {
+			continue
+		}
+		matched = append(matched, url)
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return opts.compare(matched[i], cursorFor(matched[j])) < 0
+	})
+
+	return opts.page(matched), nil
+}
+
+// cursorFor returns a cursor value describing url, for comparisons
+func cursorFor(url *URL) *listCursor {
+	return &listCursor{Hits: url.Hits, CreatedAt: url.CreatedAt, ID: url.ID}
+}
+
+func compareInts(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// hostOf returns the lowercase host of a destination URL
+func hostOf(original string) string {
+	parsedURL, err := url.Parse(original)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsedURL.Hostname())
+}
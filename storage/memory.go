@@ -1,46 +1,251 @@
 package storage
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"net/url"
+	"context"
+	"fmt"
+	"os"
+	"sort"
 	"sync"
 	"time"
 )
 
 // MemoryStore implements Store using in-memory map
 type MemoryStore struct {
-	urls  map[string]*URL
-	mutex sync.RWMutex
+	idAllocator
+	urls   map[string]*URL
+	hashes map[string][]string // URLHash -> IDs, for deduplication
+	search *searchIndex
+	mutex  sync.RWMutex
+
+	// wal persists changes when the store was opened with OpenMemoryStore
+	wal *memoryLog
 }
 
 // NewMemoryStore creates a new in-memory store
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		urls: make(map[string]*URL),
+		urls:   make(map[string]*URL),
+		hashes: make(map[string][]string),
+		search: newSearchIndex(),
+	}
+}
+
+// OpenMemoryStore creates a MemoryStore that persists to opts.Dir. Every
+// change is appended to a write-ahead log before it is applied, and the log is
+// compacted into a snapshot every SnapshotInterval. On startup the snapshot
+// and the log are replayed; a record cut short by a crash is discarded.
+func OpenMemoryStore(opts PersistenceOptions) (*MemoryStore, error) {
+	if opts.Sync == "" {
+		opts.Sync = SyncInterval
+	}
+	if opts.Sync != SyncAlways && opts.Sync != SyncInterval && opts.Sync != SyncNever {
+		return nil, fmt.Errorf("unknown sync mode %q (want always, interval or never)", opts.Sync)
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultWALSyncInterval
+	}
+	if opts.SnapshotInterval <= 0 {
+		opts.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := NewMemoryStore()
+	snapshot, err := readSnapshot(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range snapshot.URLs {
+		s.replay(walRecord{Op: walCreate, ID: url.ID, URL: url})
+	}
+
+	log := &memoryLog{opts: opts, stop: make(chan struct{}), done: make(chan struct{})}
+	segments, err := log.segments()
+	if err != nil {
+		return nil, err
+	}
+	next := snapshot.Segment
+	for i, n := range segments {
+		path := log.segmentPath(n)
+		if n < snapshot.Segment {
+			// Already part of the snapshot
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		offset, err := readSegment(path, s.replay)
+		if err == errTornRecord {
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("%s is damaged before its end", path)
+			}
+			// A crash cut the last record short; it was never acknowledged
+			if err := os.Truncate(path, offset); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("replaying %s: %w", path, err)
+		}
+		next = n + 1
+	}
+
+	if err := log.open(next); err != nil {
+		return nil, err
+	}
+	s.wal = log
+	go s.persist()
+	return s, nil
+}
+
+// replay applies a logged change without logging it again
+func (s *MemoryStore) replay(record walRecord) {
+	switch record.Op {
+	case walCreate:
+		if record.URL == nil {
+			return
+		}
+		url := *record.URL
+		s.urls[record.ID] = &url
+		hash := URLHash(url.Original)
+		s.hashes[hash] = append(s.hashes[hash], record.ID)
+		s.search.add(&url)
+	case walHit:
+		if url, exists := s.urls[record.ID]; exists {
+			url.Hits++
+		}
+	case walUpdate:
+		if url, exists := s.urls[record.ID]; exists {
+			s.applyUpdate(url, record)
+		}
+	case walHealth:
+		if url, exists := s.urls[record.ID]; exists && record.Health != nil {
+			url.Health = record.Health.normalize()
+		}
+	case walDetails:
+		if url, exists := s.urls[record.ID]; exists && record.Details != nil {
+			s.search.remove(url)
+			url.Details = *record.Details
+			s.search.add(url)
+		}
+	case walDelete:
+		if url, exists := s.urls[record.ID]; exists {
+			delete(s.urls, record.ID)
+			s.unindex(record.ID, url.Original)
+			s.search.remove(url)
+		}
+	}
+}
+
+// log appends a change to the write-ahead log, if there is one, before it
+// is applied; the caller holds the write lock
+func (s *MemoryStore) log(record walRecord) error {
+	if s.wal == nil {
+		return nil
 	}
+	return s.wal.append(record)
 }
 
-// generateID creates a unique shortcode
-func generateID(length int) (string, error) {
-	bytes := make([]byte, length)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+// persist syncs the log and takes snapshots until Close is called
+func (s *MemoryStore) persist() {
+	defer close(s.wal.done)
+
+	snapshots := time.NewTicker(s.wal.opts.SnapshotInterval)
+	defer snapshots.Stop()
+
+	var syncs <-chan time.Time
+	if s.wal.opts.Sync == SyncInterval {
+		ticker := time.NewTicker(s.wal.opts.SyncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+
+	// Failed snapshots are retried on the next tick; a failed sync fails the
+	// log, so that no further changes are acknowledged
+	for {
+		select {
+		case <-s.wal.stop:
+			return
+		case <-syncs:
+			s.wal.sync()
+		case <-snapshots.C:
+			s.Snapshot()
+		}
 	}
-	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(bytes)[:length], nil
+}
+
+// Snapshot writes the current state to disk and removes the log segments it
+// replaces. It does nothing for a store without persistence.
+func (s *MemoryStore) Snapshot() error {
+	if s.wal == nil {
+		return nil
+	}
+
+	s.wal.snapshotMutex.Lock()
+	defer s.wal.snapshotMutex.Unlock()
+
+	// Changes are logged under the write lock, so holding the read lock
+	// keeps the copy and the segment boundary in step
+	s.mutex.RLock()
+	if !s.wal.pending() {
+		s.mutex.RUnlock()
+		return nil
+	}
+	urls := make([]*URL, 0, len(s.urls))
+	for _, url := range s.urls {
+		record := *url
+		urls = append(urls, &record)
+	}
+	segment, err := s.wal.rotate()
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := writeSnapshot(s.wal.opts.Dir, &memorySnapshot{Segment: segment, URLs: urls}); err != nil {
+		return err
+	}
+
+	segments, err := s.wal.segments()
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n < segment {
+			if err := os.Remove(s.wal.segmentPath(n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // Create implements Store.Create
-func (s *MemoryStore) Create(original string) (*URL, error) {
+func (s *MemoryStore) Create(ctx context.Context, original string, opts ...CreateOption) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	// Validate URL
-	parsedURL, err := url.ParseRequestURI(original)
-	if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
-		return nil, ErrInvalid
+	if err := validateURL(original); err != nil {
+		return nil, err
 	}
 
-	// Generate short ID (6 characters)
-	id, err := generateID(6)
-	if err != nil {
+	// Generate a short ID, retrying on collisions
+	return s.allocate(original, createDomain(opts), func(id string, extra ...CreateOption) (*URL, error) {
+		return s.CreateWithID(ctx, id, original, append(extra, opts...)...)
+	})
+}
+
+// CreateWithID implements Store.CreateWithID
+func (s *MemoryStore) CreateWithID(ctx context.Context, id, original string, opts ...CreateOption) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Validate URL
+	if err := validateURL(original); err != nil {
 		return nil, err
 	}
 
@@ -51,17 +256,64 @@ func (s *MemoryStore) Create(original string) (*URL, error) {
 		CreatedAt: time.Now(),
 		Hits:      0,
 	}
+	for _, opt := range opts {
+		opt(record)
+	}
 
-	// Store URL
+	// Store URL, refusing to overwrite an existing one
 	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hash := URLHash(original)
+	if record.dedup {
+		candidates := make([]*URL, 0, len(s.hashes[hash]))
+		for _, other := range s.hashes[hash] {
+			candidates = append(candidates, s.urls[other])
+		}
+		if existing := findReusable(candidates, record); existing != nil {
+			found := *existing
+			return &found, nil
+		}
+	}
+
+	if _, exists := s.urls[id]; exists {
+		return nil, ErrConflict
+	}
+	if err := s.log(walRecord{Op: walCreate, ID: id, URL: record}); err != nil {
+		return nil, err
+	}
 	s.urls[id] = record
-	s.mutex.Unlock()
+	s.hashes[hash] = append(s.hashes[hash], id)
+	s.search.add(record)
 
-	return record, nil
+	// Hand out a copy, since the stored record changes under the lock
+	created := *record
+	return &created, nil
+}
+
+// unindex removes id from the duplicate index; the caller holds the lock
+func (s *MemoryStore) unindex(id, original string) {
+	hash := URLHash(original)
+	ids := s.hashes[hash]
+	for i, other := range ids {
+		if other == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(s.hashes, hash)
+	} else {
+		s.hashes[hash] = ids
+	}
 }
 
 // Get implements Store.Get
-func (s *MemoryStore) Get(id string) (*URL, error) {
+func (s *MemoryStore) Get(ctx context.Context, id string) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	
@@ -69,28 +321,304 @@ func (s *MemoryStore) Get(id string) (*URL, error) {
 	if !exists {
 		return nil, ErrNotFound
 	}
+	if url.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	if url.Exhausted() {
+		return nil, ErrExhausted
+	}
 	
 	// Increment hit counter
+	if err := s.log(walRecord{Op: walHit, ID: id}); err != nil {
+		return nil, err
+	}
 	url.Hits++
 	
-	return url, nil
+	record := *url
+	return &record, nil
+}
+
+// RecordHit implements HitRecorder.RecordHit
+func (s *MemoryStore) RecordHit(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	url, exists := s.urls[id]
+	if !exists {
+		return nil
+	}
+	if err := s.log(walRecord{Op: walHit, ID: id}); err != nil {
+		return err
+	}
+	url.Hits++
+	return nil
+}
+
+// Lookup implements Store.Lookup
+func (s *MemoryStore) Lookup(ctx context.Context, id string) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	url, exists := s.urls[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	record := *url
+	return &record, nil
+}
+
+// Update implements Store.Update
+func (s *MemoryStore) Update(ctx context.Context, id, original string, opts ...UpdateOption) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Validate URL
+	if original != "" {
+		if err := validateURL(original); err != nil {
+			return nil, err
+		}
+	}
+	o := collectUpdate(opts)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	url, exists := s.urls[id]
+	if !exists || (o.destination != "" && url.Original != o.destination) {
+		return nil, ErrNotFound
+	}
+	record := walRecord{Op: walUpdate, ID: id, Original: original}
+	if o.changesDetails() {
+		details := o.details(url.Details)
+		record.Details = &details
+	}
+	if err := s.log(record); err != nil {
+		return nil, err
+	}
+	s.applyUpdate(url, record)
+
+	updated := *url
+	return &updated, nil
+}
+
+// applyUpdate makes a logged update; the caller holds the write lock
+func (s *MemoryStore) applyUpdate(url *URL, record walRecord) {
+	s.search.remove(url)
+	if record.Original != "" {
+		s.unindex(record.ID, url.Original)
+		url.Original = record.Original
+		url.Health = nil
+		hash := URLHash(record.Original)
+		s.hashes[hash] = append(s.hashes[hash], record.ID)
+	}
+	if record.Details != nil {
+		url.Details = *record.Details
+	}
+	s.search.add(url)
+}
+
+// SetDetails implements Store.SetDetails
+func (s *MemoryStore) SetDetails(ctx context.Context, id string, details Details) (*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	details = details.normalize()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	url, exists := s.urls[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	if err := s.log(walRecord{Op: walDetails, ID: id, Details: &details}); err != nil {
+		return nil, err
+	}
+	s.search.remove(url)
+	url.Details = details
+	s.search.add(url)
+
+	record := *url
+	return &record, nil
+}
+
+// SetHealth implements Store.SetHealth. The record is replaced rather than
+// changed in place, since copies handed out share it.
+func (s *MemoryStore) SetHealth(ctx context.Context, id string, health Health) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	url, exists := s.urls[id]
+	if !exists {
+		return ErrNotFound
+	}
+	if err := s.log(walRecord{Op: walHealth, ID: id, Health: &health}); err != nil {
+		return err
+	}
+	url.Health = health.normalize()
+	return nil
+}
+
+// Delete implements Store.Delete
+func (s *MemoryStore) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	url, exists := s.urls[id]
+	if !exists {
+		return ErrNotFound
+	}
+	if err := s.log(walRecord{Op: walDelete, ID: id}); err != nil {
+		return err
+	}
+	delete(s.urls, id)
+	s.unindex(id, url.Original)
+	s.search.remove(url)
+
+	return nil
+}
+
+// DeleteExpired implements Store.DeleteExpired
+func (s *MemoryStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := 0
+	for id, url := range s.urls {
+		if url.Expired(before) {
+			if err := s.log(walRecord{Op: walDelete, ID: id}); err != nil {
+				return removed, err
+			}
+			delete(s.urls, id)
+			s.unindex(id, url.Original)
+			s.search.remove(url)
+			removed++
+		}
+	}
+
+	return removed, nil
 }
 
 // GetStats implements Store.GetStats
-func (s *MemoryStore) GetStats() ([]*URL, error) {
+func (s *MemoryStore) GetStats(ctx context.Context) ([]*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	
 	result := make([]*URL, 0, len(s.urls))
 	for _, url := range s.urls {
-		result = append(result, url)
+		record := *url
+		result = append(result, &record)
 	}
 	
 	return result, nil
 }
 
+// List implements Store.List
+func (s *MemoryStore) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	urls := make([]*URL, 0, len(s.urls))
+	for _, url := range s.urls {
+		record := *url
+		urls = append(urls, &record)
+	}
+	s.mutex.RUnlock()
+
+	return listInMemory(urls, opts)
+}
+
+// Iterate implements Store.Iterate
+func (s *MemoryStore) Iterate(ctx context.Context, fn func(*URL) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	ids := make([]string, 0, len(s.urls))
+	for id := range s.urls {
+		ids = append(ids, id)
+	}
+	s.mutex.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		url, err := s.Lookup(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(url); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search implements Searcher with the inverted index
+func (s *MemoryStore) Search(ctx context.Context, opts SearchOptions) ([]*URL, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	ids, all := s.search.match(opts)
+	var urls []*URL
+	if all {
+		urls = make([]*URL, 0, len(s.urls))
+		for _, url := range s.urls {
+			record := *url
+			urls = append(urls, &record)
+		}
+	} else {
+		urls = make([]*URL, 0, len(ids))
+		for id := range ids {
+			record := *s.urls[id]
+			urls = append(urls, &record)
+		}
+	}
+	s.mutex.RUnlock()
+
+	return searchResults(urls, opts.Limit), nil
+}
+
 // GetTotalCount implements Store.GetTotalCount
-func (s *MemoryStore) GetTotalCount() (int, error) {
+func (s *MemoryStore) GetTotalCount(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	
@@ -98,7 +626,11 @@ func (s *MemoryStore) GetTotalCount() (int, error) {
 }
 
 // GetTotalHits implements Store.GetTotalHits
-func (s *MemoryStore) GetTotalHits() (int, error) {
+func (s *MemoryStore) GetTotalHits(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 	
@@ -110,7 +642,22 @@ func (s *MemoryStore) GetTotalHits() (int, error) {
 	return total, nil
 }
 
-// Close implements Store.Close (no-op for memory store)
+// Close implements Store.Close, taking a final snapshot when the store
+// is persistent
 func (s *MemoryStore) Close() error {
-	return nil
+	if s.wal == nil {
+		return nil
+	}
+
+	var err error
+	s.wal.closeOnce.Do(func() {
+		close(s.wal.stop)
+		<-s.wal.done
+
+		err = s.Snapshot()
+		if closeErr := s.wal.close(); closeErr != nil {
+			err = closeErr
+		}
+	})
+	return err
 }
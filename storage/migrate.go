@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrationFiles embed.FS
+
+// sqliteMigrationHooks holds Go steps that run after a migration's SQL, in the
+// same transaction, for data changes that are awkward to express in SQL
+var sqliteMigrationHooks = map[int]func(ctx context.Context, tx *sql.Tx) error{
+	4: backfillHosts,
+	6: func(ctx context.Context, tx *sql.Tx) error {
+		return backfillURLHashes(ctx, tx, sqlitePlaceholder)
+	},
+}
+
+// sqliteLegacyColumns lists the columns added by the first migrations. A
+// database created before schema_version existed is adopted at the last of
+// these versions whose column is already present.
+var sqliteLegacyColumns = []struct {
+	version int
+	column  string
+}{
+	{2, "expires_at"},
+	{3, "max_hits"},
+	{4, "host"},
+}
+
+// Migration is a single embedded, ordered up-migration
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus reports whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+// Migrator applies the embedded SQLite migrations and records them in the
+// schema_version table
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+// NewSQLiteMigrator creates a migrator for an open SQLite database
+func NewSQLiteMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := loadMigrations(sqliteMigrationFiles, "migrations/sqlite")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+// OpenSQLiteMigrator opens the SQLite database at path without migrating it,
+// for tooling that inspects or applies migrations on its own
+func OpenSQLiteMigrator(path string) (*Migrator, error) {
+	db, err := openSQLite(sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+
+	migrator, err := NewSQLiteMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return migrator, nil
+}
+
+// loadMigrations reads NNNN_name.sql files from dir, ordered by version
+func loadMigrations(files fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+
+		data, err := fs.ReadFile(files, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// Status reports every known migration and whether it has been applied.
+// It does not modify the database; migrations adopted from an untracked
+// database are reported as applied without a time.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i].Migration = migration
+		if appliedAt, ok := applied[migration.Version]; ok {
+			statuses[i].Applied = true
+			statuses[i].AppliedAt = appliedAt
+		}
+	}
+	return statuses, nil
+}
+
+// applied maps the version of every applied migration to when it was applied
+func (m *Migrator) applied(ctx context.Context) (map[int]*time.Time, error) {
+	tracked, err := hasVersionTable(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]*time.Time)
+	if !tracked {
+		legacy, err := legacyVersion(ctx, m.db)
+		if err != nil {
+			return nil, err
+		}
+		for _, migration := range m.migrations {
+			if migration.Version <= legacy {
+				applied[migration.Version] = nil
+			}
+		}
+		return applied, nil
+	}
+
+	rows, err := m.db.QueryContext(ctx, "SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = &appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Pending returns the migrations that Up would apply, oldest first
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, status := range statuses {
+		if !status.Applied {
+			pending = append(pending, status.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies all pending migrations in order, each in its own transaction,
+// and returns the ones it applied
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range m.migrations {
+		ok, err := m.apply(ctx, migration)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+		}
+		if ok {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// Close closes the underlying database
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+// init creates the schema_version table, adopting databases that were
+// created before migrations were tracked
+func (m *Migrator) init(ctx context.Context) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tracked, err := hasVersionTable(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if tracked {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		CREATE TABLE schema_version (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	legacy, err := legacyVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, migration := range m.migrations {
+		if migration.Version > legacy {
+			break
+		}
+		if err := recordMigration(ctx, tx, migration, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// hasVersionTable reports whether the schema_version table exists
+func hasVersionTable(ctx context.Context, q queryer) (bool, error) {
+	var count int
+	err := q.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'",
+	).Scan(&count)
+	return count > 0, err
+}
+
+// legacyVersion works out how far an untracked database had been brought up
+// to date by the column checks that ran before migrations existed
+func legacyVersion(ctx context.Context, q queryer) (int, error) {
+	rows, err := q.QueryContext(ctx, "SELECT name FROM pragma_table_info('urls')")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return 0, err
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// No urls table means a fresh database
+	if len(columns) == 0 {
+		return 0, nil
+	}
+
+	version := 1
+	for _, legacy := range sqliteLegacyColumns {
+		if !columns[legacy.column] {
+			break
+		}
+		version = legacy.version
+	}
+	return version, nil
+}
+
+// apply runs one migration unless another process already has, reporting
+// whether it did
+func (m *Migrator) apply(ctx context.Context, migration Migration) (bool, error) {
+	// Transactions take the write lock up front (see sqliteDSN), so the
+	// check below cannot race another replica applying the same migration
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var done int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_version WHERE version = ?", migration.Version).Scan(&done)
+	if err != nil {
+		return false, err
+	}
+	if done > 0 {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, migration.SQL); err != nil {
+		return false, err
+	}
+	if hook, ok := sqliteMigrationHooks[migration.Version]; ok {
+		if err := hook(ctx, tx); err != nil {
+			return false, err
+		}
+	}
+	if err := recordMigration(ctx, tx, migration, time.Now().UTC()); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// recordMigration marks a migration as applied
+func recordMigration(ctx context.Context, tx *sql.Tx, migration Migration, appliedAt time.Time) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		migration.Version, migration.Name, appliedAt,
+	)
+	return err
+}
+
+// backfillHosts fills the host column for rows created before it existed
+func backfillHosts(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, original FROM urls WHERE host IS NULL")
+	if err != nil {
+		return err
+	}
+	hosts := make(map[string]string)
+	for rows.Next() {
+		var id, original string
+		if err := rows.Scan(&id, &original); err != nil {
+			rows.Close()
+			return err
+		}
+		hosts[id] = hostOf(original)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, host := range hosts {
+		if _, err := tx.ExecContext(ctx, "UPDATE urls SET host = ? WHERE id = ?", host, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMigrations(t *testing.T) {
+	if !SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
+
+	t.Run("fresh database", func(t *testing.T) {
+		migrator, err := OpenSQLiteMigrator(filepath.Join(t.TempDir(), "urls.db"))
+		if err != nil {
+			t.Fatalf("Failed to open migrator: %v", err)
+		}
+		defer migrator.Close()
+
+		// Status must not create anything, so a dry run leaves the file untouched
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			t.Fatalf("Failed to list pending migrations: %v", err)
+		}
+		if len(pending) != len(migrator.migrations) {
+			t.Errorf("Expected %d pending migrations, got %d", len(migrator.migrations), len(pending))
+		}
+		tracked, err := hasVersionTable(ctx, migrator.db)
+		if err != nil {
+			t.Fatalf("Failed to check schema_version: %v", err)
+		}
+		if tracked {
+			t.Error("Expected Pending not to create schema_version")
+		}
+
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if len(applied) != len(migrator.migrations) {
+			t.Errorf("Expected %d applied migrations, got %d", len(migrator.migrations), len(applied))
+		}
+
+		// Running again is a no-op
+		applied, err = migrator.Up(ctx)
+		if err != nil {
+			t.Fatalf("Failed to migrate again: %v", err)
+		}
+		if len(applied) != 0 {
+			t.Errorf("Expected no migrations on second run, got %d", len(applied))
+		}
+
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			t.Fatalf("Failed to get status: %v", err)
+		}
+		for _, status := range statuses {
+			if !status.Applied || status.AppliedAt == nil {
+				t.Errorf("Expected migration %d to be applied with a time", status.Version)
+			}
+		}
+	})
+
+	t.Run("legacy database", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "urls.db")
+
+		// Create the table the way the first release did
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatalf("Failed to open database: %v", err)
+		}
+		_, err = db.Exec(`
+			CREATE TABLE urls (
+				id TEXT PRIMARY KEY,
+				original TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				hits INTEGER NOT NULL DEFAULT 0
+			);
+			INSERT INTO urls (id, original, created_at, hits) VALUES ('legacy', 'https://Old.Example.com/page', '2024-01-01 00:00:00+00:00', 7);
+		`)
+		db.Close()
+		if err != nil {
+			t.Fatalf("Failed to create legacy table: %v", err)
+		}
+
+		migrator, err := OpenSQLiteMigrator(path)
+		if err != nil {
+			t.Fatalf("Failed to open migrator: %v", err)
+		}
+		pending, err := migrator.Pending(ctx)
+		migrator.Close()
+		if err != nil {
+			t.Fatalf("Failed to list pending migrations: %v", err)
+		}
+		if len(pending) == 0 || pending[0].Version != 2 {
+			t.Fatalf("Expected migrations from version 2 to be pending, got %+v", pending)
+		}
+
+		// Opening the store migrates and keeps existing rows
+		store, err := NewSQLiteStore(path)
+		if err != nil {
+			t.Fatalf("Failed to open store: %v", err)
+		}
+		defer store.Close()
+
+		url, err := store.Lookup(ctx, "legacy")
+		if err != nil {
+			t.Fatalf("Failed to look up legacy URL: %v", err)
+		}
+		if url.Hits != 7 || url.ExpiresAt != nil || url.MaxHits != 0 {
+			t.Errorf("Unexpected legacy URL: %+v", url)
+		}
+
+		// The host column was backfilled
+		page, err := store.List(ctx, ListOptions{Host: "old.example.com"})
+		if err != nil {
+			t.Fatalf("Failed to list URLs: %v", err)
+		}
+		if len(page.URLs) != 1 || page.URLs[0].ID != "legacy" {
+			t.Errorf("Expected host filter to find the legacy URL, got %+v", page.URLs)
+		}
+	})
+}
+
+func TestLoadMigrations(t *testing.T) {
+	files := fstest.MapFS{
+		"m/0002_second.sql": {Data: []byte("SELECT 2;")},
+		"m/0001_first.sql":  {Data: []byte("SELECT 1;")},
+	}
+	migrations, err := loadMigrations(files, "m")
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	if len(migrations) != 2 || migrations[0].Name != "first" || migrations[1].Version != 2 {
+		t.Errorf("Unexpected migrations: %+v", migrations)
+	}
+
+	invalid := map[string]fstest.MapFS{
+		"missing version": {"m/first.sql": {Data: []byte("SELECT 1;")}},
+		"duplicate version": {
+			"m/0001_first.sql": {Data: []byte("SELECT 1;")},
+			"m/0001_again.sql": {Data: []byte("SELECT 1;")},
+		},
+	}
+	for name, files := range invalid {
+		if _, err := loadMigrations(files, "m"); err == nil {
+			t.Errorf("Expected error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS urls (
+	id TEXT PRIMARY KEY,
+	original TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	hits INTEGER NOT NULL DEFAULT 0
+);
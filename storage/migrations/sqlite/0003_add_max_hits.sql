@@ -0,0 +1 @@
+ALTER TABLE urls ADD COLUMN max_hits INTEGER NOT NULL DEFAULT 0;
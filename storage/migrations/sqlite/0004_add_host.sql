@@ -0,0 +1,2 @@
+-- Existing rows are backfilled from the original URL after this runs
+ALTER TABLE urls ADD COLUMN host TEXT;
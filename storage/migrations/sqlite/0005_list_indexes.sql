@@ -0,0 +1,3 @@
+-- Indexes backing the sort orders offered by List
+CREATE INDEX IF NOT EXISTS idx_urls_created_at ON urls (created_at, id);
+CREATE INDEX IF NOT EXISTS idx_urls_hits ON urls (hits, id);
@@ -0,0 +1,4 @@
+-- Hash of the normalized destination, used to find duplicates.
+-- Existing rows are backfilled after this runs.
+ALTER TABLE urls ADD COLUMN url_hash TEXT;
+CREATE INDEX IF NOT EXISTS idx_urls_url_hash ON urls (url_hash);
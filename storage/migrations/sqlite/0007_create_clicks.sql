@@ -0,0 +1,12 @@
+-- Click events recorded on every redirect, pruned after the retention window
+CREATE TABLE IF NOT EXISTS clicks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url_id TEXT NOT NULL,
+	clicked_at TIMESTAMP NOT NULL,
+	referrer TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	language TEXT NOT NULL DEFAULT '',
+	client_ip TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_clicks_url_id ON clicks (url_id, clicked_at);
+CREATE INDEX IF NOT EXISTS idx_clicks_clicked_at ON clicks (clicked_at);
@@ -0,0 +1,3 @@
+-- Country and city resolved from the client IP when a GeoIP database is configured
+ALTER TABLE clicks ADD COLUMN country TEXT NOT NULL DEFAULT '';
+ALTER TABLE clicks ADD COLUMN city TEXT NOT NULL DEFAULT '';
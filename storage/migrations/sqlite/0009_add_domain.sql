@@ -0,0 +1,5 @@
+-- Domain a link is served from, '' for the default one; the id already holds
+-- it as "<domain>/<code>", this copy is for filtering
+ALTER TABLE urls ADD COLUMN domain TEXT NOT NULL DEFAULT '';
+UPDATE urls SET domain = substr(id, 1, instr(id, '/') - 1) WHERE instr(id, '/') > 0;
+CREATE INDEX IF NOT EXISTS idx_urls_domain ON urls (domain);
@@ -0,0 +1,6 @@
+-- Title, description and tags for finding links; tags are a JSON array of
+-- strings. The full-text index over them is set up at startup, see
+-- setupSQLiteSearch, since it needs SQLite built with FTS5.
+ALTER TABLE urls ADD COLUMN title TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
@@ -0,0 +1,3 @@
+-- Favicon and Open Graph image fetched from the destination page
+ALTER TABLE urls ADD COLUMN favicon_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN image_url TEXT NOT NULL DEFAULT '';
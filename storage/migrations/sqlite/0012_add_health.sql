@@ -0,0 +1,7 @@
+-- Outcome of the latest check of the destination; health_checked_at is NULL
+-- until the link has been checked
+ALTER TABLE urls ADD COLUMN health_status INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN health_error TEXT NOT NULL DEFAULT '';
+ALTER TABLE urls ADD COLUMN health_latency_ms INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE urls ADD COLUMN health_checked_at TIMESTAMP;
+ALTER TABLE urls ADD COLUMN health_ok_at TIMESTAMP;
@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresSchemaLock is the advisory lock key that serializes schema setup
+// when several replicas start at the same time
+const postgresSchemaLock = 7_311_504_001
+
+// postgresSchema creates the urls and clicks tables and brings older tables up to date
+var postgresSchema = []string{
+	`CREATE TABLE IF NOT EXISTS urls (
+		id TEXT PRIMARY KEY,
+		original TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		hits INTEGER NOT NULL DEFAULT 0
+	)`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS max_hits INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS host TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_urls_created_at ON urls (created_at, id)`,
+	`CREATE INDEX IF NOT EXISTS idx_urls_hits ON urls (hits, id)`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS url_hash TEXT`,
+	`CREATE INDEX IF NOT EXISTS idx_urls_url_hash ON urls (url_hash)`,
+	`CREATE TABLE IF NOT EXISTS clicks (
+		id BIGSERIAL PRIMARY KEY,
+		url_id TEXT NOT NULL,
+		clicked_at TIMESTAMPTZ NOT NULL,
+		referrer TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		language TEXT NOT NULL DEFAULT '',
+		client_ip TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_clicks_url_id ON clicks (url_id, clicked_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_clicks_clicked_at ON clicks (clicked_at)`,
+	`ALTER TABLE clicks ADD COLUMN IF NOT EXISTS country TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE clicks ADD COLUMN IF NOT EXISTS city TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS domain TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_urls_domain ON urls (domain)`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS title TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS tags TEXT NOT NULL DEFAULT '[]'`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS favicon_url TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS image_url TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_status INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_error TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_latency_ms BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_checked_at TIMESTAMPTZ`,
+	`ALTER TABLE urls ADD COLUMN IF NOT EXISTS health_ok_at TIMESTAMPTZ`,
+}
+
+// PostgresStore implements Store using PostgreSQL, so that several
+// replicas can share one database
+type PostgresStore struct {
+	idAllocator
+	db *sql.DB
+}
+
+// NewPostgresStore connects to PostgreSQL with a pool of up to maxConns
+// connections and creates or migrates the schema
+func NewPostgresStore(dsn string, maxConns int) (*PostgresStore, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Configure the connection pool
+	db.SetMaxOpenConns(maxConns)
+	db.SetMaxIdleConns(maxConns)
+	db.SetConnMaxIdleTime(5 * time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := migratePostgres(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+// migratePostgres applies the schema in one transaction under an advisory lock
+func migratePostgres(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", postgresSchemaLock); err != nil {
+		return err
+	}
+	for _, statement := range postgresSchema {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	if err := backfillURLHashes(ctx, tx, postgresPlaceholder); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// postgresPlaceholder renders PostgreSQL's numbered bind parameters
+func postgresPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// Create implements Store.Create
+func (s *PostgresStore) Create(ctx context.Context, original string, opts ...CreateOption) (*URL, error) {
+	// Validate URL
+	if err := validateURL(original); err != nil {
+		return nil, err
+	}
+
+	// Generate a short ID, retrying on collisions
+	return s.allocate(original, createDomain(opts), func(id string, extra ...CreateOption) (*URL, error) {
+		return s.CreateWithID(ctx, id, original, append(extra, opts...)...)
+	})
+}
+
+// CreateWithID implements Store.CreateWithID
+func (s *PostgresStore) CreateWithID(ctx context.Context, id, original string, opts ...CreateOption) (*URL, error) {
+	// Validate URL
+	if err := validateURL(original); err != nil {
+		return nil, err
+	}
+
+	// PostgreSQL keeps microseconds, so truncate up front to return
+	// the same timestamps that later reads will see
+	record := &URL{
+		ID:        id,
+		Original:  original,
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+		Hits:      0,
+	}
+	for _, opt := range opts {
+		opt(record)
+	}
+	if record.ExpiresAt != nil {
+		expiresAt := record.ExpiresAt.Truncate(time.Microsecond)
+		record.ExpiresAt = &expiresAt
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize deduplicated creates of the same URL across replicas
+	hash := URLHash(record.Original)
+	if record.dedup {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", hash); err != nil {
+			return nil, err
+		}
+		existing, err := findDuplicate(ctx, tx, record, postgresPlaceholder)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return existing, nil
+		}
+	}
+
+	// Insert record, leaving an existing row with the same ID untouched
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO urls (id, original, created_at, hits, expires_at, max_hits, host, url_hash, domain, title, description, tags, favicon_url, image_url) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) ON CONFLICT (id) DO NOTHING",
+		record.ID, record.Original, record.CreatedAt, record.Hits, record.ExpiresAt, record.MaxHits, hostOf(record.Original), hash, record.Domain(),
+		record.Title, record.Description, encodeTags(record.Tags), record.FaviconURL, record.ImageURL,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if inserted == 0 {
+		return nil, ErrConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// Get implements Store.Get
+func (s *PostgresStore) Get(ctx context.Context, id string) (*URL, error) {
+	// Count the hit in a single statement that also enforces expiry and the hit limit
+	url, err := scanURL(s.db.QueryRowContext(ctx,
+		`UPDATE urls SET hits = hits + 1
+		WHERE id = $1 AND (expires_at IS NULL OR expires_at > $2) AND (max_hits = 0 OR hits < max_hits)
+		RETURNING `+urlColumns,
+		id, time.Now(),
+	))
+	if err != sql.ErrNoRows {
+		return url, err
+	}
+
+	// Nothing was updated, so find out why
+	url, err = s.Lookup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if url.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	return nil, ErrExhausted
+}
+
+// RecordHit implements HitRecorder.RecordHit
+func (s *PostgresStore) RecordHit(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE urls SET hits = hits + 1 WHERE id = $1", id)
+	return err
+}
+
+// Lookup implements Store.Lookup
+func (s *PostgresStore) Lookup(ctx context.Context, id string) (*URL, error) {
+	url, err := scanURL(s.db.QueryRowContext(ctx, "SELECT "+urlColumns+" FROM urls WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return url, err
+}
+
+// Update implements Store.Update
+func (s *PostgresStore) Update(ctx context.Context, id, original string, opts ...UpdateOption) (*URL, error) {
+	// Validate URL
+	if original != "" {
+		if err := validateURL(original); err != nil {
+			return nil, err
+		}
+	}
+
+	return updateURL(ctx, s.db, id, original, collectUpdate(opts), postgresPlaceholder)
+}
+
+// SetHealth implements Store.SetHealth
+func (s *PostgresStore) SetHealth(ctx context.Context, id string, health Health) error {
+	return setHealth(ctx, s.db, id, health, postgresPlaceholder)
+}
+
+// SetDetails implements Store.SetDetails
+func (s *PostgresStore) SetDetails(ctx context.Context, id string, details Details) (*URL, error) {
+	return setDetails(ctx, s.db, id, details, postgresPlaceholder)
+}
+
+// Delete implements Store.Delete
+func (s *PostgresStore) Delete(ctx context.Context, id string) error {
+	removed, err := deleteURLs(ctx, s.db, "id = $1", id)
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteExpired implements Store.DeleteExpired
+func (s *PostgresStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	return deleteURLs(ctx, s.db, "expires_at <= $1", before)
+}
+
+// GetStats implements Store.GetStats
+func (s *PostgresStore) GetStats(ctx context.Context) ([]*URL, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+urlColumns+" FROM urls")
+	if err != nil {
+		return nil, err
+	}
+	return scanURLs(rows)
+}
+
+// List implements Store.List
+func (s *PostgresStore) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := opts.decodeCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	query, args := listQuery(&opts, cursor, postgresPlaceholder)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := scanURLs(rows)
+	if err != nil {
+		return nil, err
+	}
+	return opts.page(urls), nil
+}
+
+// Iterate implements Store.Iterate
+func (s *PostgresStore) Iterate(ctx context.Context, fn func(*URL) error) error {
+	return iterateURLs(ctx, s.db, fn, postgresPlaceholder)
+}
+
+// GetTotalCount implements Store.GetTotalCount
+func (s *PostgresStore) GetTotalCount(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls").Scan(&count)
+	return count, err
+}
+
+// GetTotalHits implements Store.GetTotalHits
+func (s *PostgresStore) GetTotalHits(ctx context.Context) (int, error) {
+	var total int
+	err := s.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(hits), 0) FROM urls").Scan(&total)
+	return total, err
+}
+
+// RecordClicks implements ClickStore.RecordClicks
+func (s *PostgresStore) RecordClicks(ctx context.Context, clicks []Click) error {
+	return insertClicks(ctx, s.db, clicks, postgresPlaceholder)
+}
+
+// ListClicks implements ClickStore.ListClicks
+func (s *PostgresStore) ListClicks(ctx context.Context, id string, from, to time.Time) ([]Click, error) {
+	return selectClicks(ctx, s.db, id, from, to, postgresPlaceholder)
+}
+
+// DeleteClicksBefore implements ClickStore.DeleteClicksBefore
+func (s *PostgresStore) DeleteClicksBefore(ctx context.Context, before time.Time) (int, error) {
+	return pruneClicks(ctx, s.db, before, postgresPlaceholder)
+}
+
+// Close implements Store.Close
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
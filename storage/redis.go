@@ -0,0 +1,667 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces every key the store writes
+const redisKeyPrefix = "url-shortener:"
+
+// errRedisReply is returned when a script reply has an unexpected shape
+var errRedisReply = errors.New("unexpected redis reply")
+
+// errRedisCluster is returned when the server is part of a Redis Cluster
+var errRedisCluster = errors.New("redis cluster is not supported, use a single server")
+
+// redisScanBatch is how many IDs List reads from a sorted set per round trip
+const redisScanBatch = 500
+
+// Each URL is a hash at url:<id>. Sorted sets index IDs by creation time
+// (microseconds), hits and expiry, a set at hash:<URLHash> holds the IDs
+// sharing a destination, and a plain counter tracks the total hits.
+// Scripts keep the hash and the indexes consistent. Some of them build key
+// names from stored values, such as the hash set of a previous destination
+// or the URLs found in one, so they only work on a single Redis server, or
+// a primary with replicas, and not on a cluster.
+
+// redisCreateScript inserts a URL unless the ID is taken (0). With dedup set
+// it first looks for a live link on the same domain with the same
+// destination, expiry (or lifetime, when ttl is set) and hit limit, and
+// returns its hash instead.
+// KEYS: url, created, hits, expires, url hash set, total hits. ARGV: id,
+// original, created_at, created score, expires_at ("" for none), max_hits,
+// host, url_hash, dedup ("1" or ""), now, url key prefix, initial hits,
+// domain, title, description, tags (JSON array), favicon_url, image_url,
+// ttl in nanoseconds ("" for none), TTL slack in nanoseconds.
+var redisCreateScript = redis.NewScript(`
+if ARGV[9] == '1' then
+	local found, foundCreated
+	for _, other in ipairs(redis.call('SMEMBERS', KEYS[5])) do
+		local slash = string.find(other, '/', 1, true)
+		local domain = slash and string.sub(other, 1, slash - 1) or ''
+		local key = ARGV[11] .. other
+		local f = redis.call('HMGET', key, 'expires_at', 'max_hits', 'hits', 'created_at')
+		local expires = f[1] or ''
+		local maxHits = tonumber(f[2]) or 0
+		local sameExpiry = expires == ARGV[5]
+		if ARGV[19] ~= '' then
+			sameExpiry = expires ~= '' and
+				math.abs(tonumber(expires) - tonumber(f[4]) - tonumber(ARGV[19])) < tonumber(ARGV[20])
+		end
+		if domain == ARGV[13] and sameExpiry and f[2] == ARGV[6]
+			and (expires == '' or tonumber(expires) > tonumber(ARGV[10]))
+			and (maxHits == 0 or tonumber(f[3]) < maxHits)
+			and (not found or tonumber(f[4]) < foundCreated) then
+			found, foundCreated = key, tonumber(f[4])
+		end
+	end
+	if found then
+		return redis.call('HGETALL', found)
+	end
+end
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'id', ARGV[1], 'original', ARGV[2], 'created_at', ARGV[3],
+	'hits', ARGV[12], 'max_hits', ARGV[6], 'host', ARGV[7], 'url_hash', ARGV[8],
+	'title', ARGV[14], 'description', ARGV[15], 'tags', ARGV[16],
+	'favicon_url', ARGV[17], 'image_url', ARGV[18])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[1])
+redis.call('ZADD', KEYS[3], ARGV[12], ARGV[1])
+if tonumber(ARGV[12]) > 0 then
+	redis.call('INCRBY', KEYS[6], ARGV[12])
+end
+redis.call('SADD', KEYS[5], ARGV[1])
+if ARGV[5] ~= '' then
+	redis.call('HSET', KEYS[1], 'expires_at', ARGV[5])
+	redis.call('ZADD', KEYS[4], ARGV[5], ARGV[1])
+end
+return 1
+`)
+
+// redisGetScript counts a hit with HINCRBY unless the URL is missing (-1),
+// expired (-2) or exhausted (-3), and returns the updated hash.
+// KEYS: url, hits, total hits. ARGV: id, now.
+var redisGetScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return -1
+end
+local expires = redis.call('HGET', KEYS[1], 'expires_at')
+if expires and tonumber(expires) <= tonumber(ARGV[2]) then
+	return -2
+end
+local maxHits = tonumber(redis.call('HGET', KEYS[1], 'max_hits'))
+local hits = tonumber(redis.call('HGET', KEYS[1], 'hits'))
+if maxHits > 0 and hits >= maxHits then
+	return -3
+end
+redis.call('HINCRBY', KEYS[1], 'hits', 1)
+redis.call('ZINCRBY', KEYS[2], 1, ARGV[1])
+redis.call('INCR', KEYS[3])
+return redis.call('HGETALL', KEYS[1])
+`)
+
+// redisRecordHitScript counts a hit without any checks, ignoring missing URLs.
+// KEYS: url, hits, total hits. ARGV: id.
+var redisRecordHitScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'hits', 1)
+redis.call('ZINCRBY', KEYS[2], 1, ARGV[1])
+redis.call('INCR', KEYS[3])
+return 1
+`)
+
+// redisUpdateScript changes the destination of an existing URL, clearing its
+// health, and sets the given details, returning the updated hash, or 0 when
+// the URL is missing or no longer points to the expected destination. An
+// empty original keeps the destination, and an empty expected destination
+// matches any.
+// KEYS: url. ARGV: original, host, url_hash, id, url hash set prefix,
+// expected destination, number of fields to set, then field and value pairs
+// to set, then pairs to set only where the field is empty.
+var redisUpdateScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+if ARGV[6] ~= '' and redis.call('HGET', KEYS[1], 'original') ~= ARGV[6] then
+	return 0
+end
+if ARGV[1] ~= '' then
+	local previous = redis.call('HGET', KEYS[1], 'url_hash')
+	if previous then
+		redis.call('SREM', ARGV[5] .. previous, ARGV[4])
+	end
+	redis.call('SADD', ARGV[5] .. ARGV[3], ARGV[4])
+	redis.call('HSET', KEYS[1], 'original', ARGV[1], 'host', ARGV[2], 'url_hash', ARGV[3])
+	redis.call('HDEL', KEYS[1], 'health')
+end
+local i = 8
+for _ = 1, tonumber(ARGV[7]) do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	i = i + 2
+end
+while i < #ARGV do
+	local current = redis.call('HGET', KEYS[1], ARGV[i])
+	if not current or current == '' then
+		redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	end
+	i = i + 2
+end
+return redis.call('HGETALL', KEYS[1])
+`)
+
+// redisDetailsScript replaces the details of an existing URL and returns the
+// updated hash, or 0 when the URL is missing.
+// KEYS: url. ARGV: title, description, tags (JSON array), favicon_url, image_url.
+var redisDetailsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'title', ARGV[1], 'description', ARGV[2], 'tags', ARGV[3],
+	'favicon_url', ARGV[4], 'image_url', ARGV[5])
+return redis.call('HGETALL', KEYS[1])
+`)
+
+// redisHealthScript sets the health of an existing URL, returning 0 when the
+// URL is missing.
+// KEYS: url. ARGV: health (JSON).
+var redisHealthScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'health', ARGV[1])
+return 1
+`)
+
+// redisDeleteScript removes a URL from the hash and every index.
+// KEYS: url, created, hits, expires, total hits. ARGV: id, url hash set prefix.
+var redisDeleteScript = redis.NewScript(`
+local hits = redis.call('HGET', KEYS[1], 'hits')
+if not hits then
+	return 0
+end
+local hash = redis.call('HGET', KEYS[1], 'url_hash')
+if hash then
+	redis.call('SREM', ARGV[2] .. hash, ARGV[1])
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZREM', KEYS[3], ARGV[1])
+redis.call('ZREM', KEYS[4], ARGV[1])
+redis.call('DECRBY', KEYS[5], hits)
+return 1
+`)
+
+// RedisStore implements Store using Redis, for horizontally scaled
+// deployments that need fast shared lookups. Redis Cluster is not supported.
+type RedisStore struct {
+	idAllocator
+	client *redis.Client
+}
+
+// NewRedisStore connects to the Redis server at redisURL
+// (e.g. redis://localhost:6379/0)
+func NewRedisStore(redisURL string) (*RedisStore, error) {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// A cluster would refuse the keys the scripts do not declare, or worse,
+	// run them against a node that holds only some of the keys. Servers that
+	// do not report the section are not clusters.
+	if info, err := client.Info(ctx, "cluster").Result(); err == nil && strings.Contains(info, "cluster_enabled:1") {
+		client.Close()
+		return nil, errRedisCluster
+	}
+
+	return &RedisStore{client: client}, nil
+}
+
+// Key helpers
+func (s *RedisStore) urlKey(id string) string { return redisKeyPrefix + "url:" + id }
+func (s *RedisStore) createdKey() string      { return redisKeyPrefix + "created" }
+func (s *RedisStore) hitsKey() string         { return redisKeyPrefix + "hits" }
+func (s *RedisStore) expiresKey() string      { return redisKeyPrefix + "expires" }
+func (s *RedisStore) totalHitsKey() string    { return redisKeyPrefix + "total_hits" }
+func (s *RedisStore) urlHashKey(hash string) string {
+	return redisKeyPrefix + "hash:" + hash
+}
+
+// Create implements Store.Create
+func (s *RedisStore) Create(ctx context.Context, original string, opts ...CreateOption) (*URL, error) {
+	// Validate URL
+	if err := validateURL(original); err != nil {
+		return nil, err
+	}
+
+	// Generate a short ID, retrying on collisions
+	return s.allocate(original, createDomain(opts), func(id string, extra ...CreateOption) (*URL, error) {
+		return s.CreateWithID(ctx, id, original, append(extra, opts...)...)
+	})
+}
+
+// CreateWithID implements Store.CreateWithID
+func (s *RedisStore) CreateWithID(ctx context.Context, id, original string, opts ...CreateOption) (*URL, error) {
+	// Validate URL
+	if err := validateURL(original); err != nil {
+		return nil, err
+	}
+
+	// Creation time is indexed in microseconds, so keep exactly that precision
+	record := &URL{
+		ID:        id,
+		Original:  original,
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+		Hits:      0,
+	}
+	for _, opt := range opts {
+		opt(record)
+	}
+	record.CreatedAt = record.CreatedAt.Truncate(time.Microsecond)
+
+	expiresAt := ""
+	if record.ExpiresAt != nil {
+		expiresAt = strconv.FormatInt(record.ExpiresAt.UnixNano(), 10)
+	}
+
+	dedup := ""
+	if record.dedup {
+		dedup = "1"
+	}
+	ttl := ""
+	if record.ttl > 0 {
+		ttl = strconv.FormatInt(int64(record.ttl), 10)
+	}
+
+	hash := URLHash(original)
+	result, err := redisCreateScript.Run(ctx, s.client,
+		[]string{s.urlKey(id), s.createdKey(), s.hitsKey(), s.expiresKey(), s.urlHashKey(hash), s.totalHitsKey()},
+		id, original, record.CreatedAt.UnixNano(), record.CreatedAt.UnixMicro(),
+		expiresAt, record.MaxHits, hostOf(original),
+		hash, dedup, time.Now().UnixNano(), s.urlKey(""), record.Hits, record.Domain(),
+		record.Title, record.Description, encodeTags(record.Tags), record.FaviconURL, record.ImageURL,
+		ttl, int64(dedupTTLSlack),
+	).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	switch result {
+	case int64(0):
+		return nil, ErrConflict
+	case int64(1):
+		return record, nil
+	}
+	return parseRedisReply(result)
+}
+
+// Get implements Store.Get
+func (s *RedisStore) Get(ctx context.Context, id string) (*URL, error) {
+	result, err := redisGetScript.Run(ctx, s.client,
+		[]string{s.urlKey(id), s.hitsKey(), s.totalHitsKey()},
+		id, time.Now().UnixNano(),
+	).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	switch result {
+	case int64(-1):
+		return nil, ErrNotFound
+	case int64(-2):
+		return nil, ErrExpired
+	case int64(-3):
+		return nil, ErrExhausted
+	}
+	return parseRedisReply(result)
+}
+
+// RecordHit implements HitRecorder.RecordHit
+func (s *RedisStore) RecordHit(ctx context.Context, id string) error {
+	return redisRecordHitScript.Run(ctx, s.client,
+		[]string{s.urlKey(id), s.hitsKey(), s.totalHitsKey()},
+		id,
+	).Err()
+}
+
+// Lookup implements Store.Lookup
+func (s *RedisStore) Lookup(ctx context.Context, id string) (*URL, error) {
+	fields, err := s.client.HGetAll(ctx, s.urlKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+	return parseRedisHash(fields)
+}
+
+// Update implements Store.Update
+func (s *RedisStore) Update(ctx context.Context, id, original string, opts ...UpdateOption) (*URL, error) {
+	args := []any{original, "", "", id, s.urlHashKey("")}
+	if original != "" {
+		// Validate URL
+		if err := validateURL(original); err != nil {
+			return nil, err
+		}
+		args[1], args[2] = hostOf(original), URLHash(original)
+	}
+
+	o := collectUpdate(opts)
+	set, fill := o.detailFields()
+	args = append(args, o.destination, len(set))
+	for _, field := range append(set, fill...) {
+		args = append(args, field.name, field.value)
+	}
+
+	result, err := redisUpdateScript.Run(ctx, s.client, []string{s.urlKey(id)}, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	if result == int64(0) {
+		return nil, ErrNotFound
+	}
+	return parseRedisReply(result)
+}
+
+// SetHealth implements Store.SetHealth
+func (s *RedisStore) SetHealth(ctx context.Context, id string, health Health) error {
+	data, err := json.Marshal(health.normalize())
+	if err != nil {
+		return err
+	}
+	result, err := redisHealthScript.Run(ctx, s.client, []string{s.urlKey(id)}, data).Result()
+	if err != nil {
+		return err
+	}
+	if result == int64(0) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetDetails implements Store.SetDetails
+func (s *RedisStore) SetDetails(ctx context.Context, id string, details Details) (*URL, error) {
+	details = details.normalize()
+	result, err := redisDetailsScript.Run(ctx, s.client,
+		[]string{s.urlKey(id)},
+		details.Title, details.Description, encodeTags(details.Tags), details.FaviconURL, details.ImageURL,
+	).Result()
+	if err != nil {
+		return nil, err
+	}
+	if result == int64(0) {
+		return nil, ErrNotFound
+	}
+	return parseRedisReply(result)
+}
+
+// Delete implements Store.Delete
+func (s *RedisStore) Delete(ctx context.Context, id string) error {
+	removed, err := redisDeleteScript.Run(ctx, s.client,
+		[]string{s.urlKey(id), s.createdKey(), s.hitsKey(), s.expiresKey(), s.totalHitsKey()},
+		id, s.urlHashKey(""),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteExpired implements Store.DeleteExpired
+func (s *RedisStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	ids, err := s.client.ZRangeByScore(ctx, s.expiresKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(before.UnixNano(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, id := range ids {
+		err := s.Delete(ctx, id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// GetStats implements Store.GetStats, most visited first
+func (s *RedisStore) GetStats(ctx context.Context) ([]*URL, error) {
+	ids, err := s.client.ZRevRange(ctx, s.hitsKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	return s.fetch(ctx, ids)
+}
+
+// List implements Store.List by walking the sorted set for the sort order
+func (s *RedisStore) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := opts.decodeCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	// Redis orders equal scores by member, which matches the (key, id) order of List
+	index := s.createdKey()
+	rangeBy := &redis.ZRangeBy{Min: "-inf", Max: "+inf", Count: redisScanBatch}
+	if opts.SortBy == SortByHits {
+		index = s.hitsKey()
+	}
+	if cursor != nil {
+		score := strconv.FormatInt(cursor.CreatedAt.UnixMicro(), 10)
+		if opts.SortBy == SortByHits {
+			score = strconv.Itoa(cursor.Hits)
+		}
+		if opts.Descending {
+			rangeBy.Max = score
+		} else {
+			rangeBy.Min = score
+		}
+	}
+
+	var urls []*URL
+	for {
+		var ids []string
+		if opts.Descending {
+			ids, err = s.client.ZRevRangeByScore(ctx, index, rangeBy).Result()
+		} else {
+			ids, err = s.client.ZRangeByScore(ctx, index, rangeBy).Result()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		batch, err := s.fetch(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, url := range batch {
+			if cursor != nil && opts.compare(url, cursor) <= 0 {
+				continue
+			}
+			if !opts.matches(url) {
+				continue
+			}
+			urls = append(urls, url)
+			if opts.Limit > 0 && len(urls) > opts.Limit {
+				return opts.page(urls), nil
+			}
+		}
+
+		if len(ids) < redisScanBatch {
+			return opts.page(urls), nil
+		}
+		rangeBy.Offset += int64(len(ids))
+	}
+}
+
+// Iterate implements Store.Iterate. The sorted sets order IDs by score, so
+// it reads every ID up front and fetches the hashes in batches.
+func (s *RedisStore) Iterate(ctx context.Context, fn func(*URL) error) error {
+	ids, err := s.client.ZRange(ctx, s.createdKey(), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+
+	for start := 0; start < len(ids); start += iterateBatchSize {
+		end := min(start+iterateBatchSize, len(ids))
+		urls, err := s.fetch(ctx, ids[start:end])
+		if err != nil {
+			return err
+		}
+		for _, url := range urls {
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetch loads the hashes for ids in one pipeline, skipping IDs deleted meanwhile
+func (s *RedisStore) fetch(ctx context.Context, ids []string) ([]*URL, error) {
+	pipe := s.client.Pipeline()
+	commands := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		commands[i] = pipe.HGetAll(ctx, s.urlKey(id))
+	}
+	if len(ids) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	urls := make([]*URL, 0, len(ids))
+	for _, command := range commands {
+		fields := command.Val()
+		if len(fields) == 0 {
+			continue
+		}
+		url, err := parseRedisHash(fields)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	return urls, nil
+}
+
+// GetTotalCount implements Store.GetTotalCount
+func (s *RedisStore) GetTotalCount(ctx context.Context) (int, error) {
+	count, err := s.client.ZCard(ctx, s.createdKey()).Result()
+	return int(count), err
+}
+
+// GetTotalHits implements Store.GetTotalHits
+func (s *RedisStore) GetTotalHits(ctx context.Context) (int, error) {
+	total, err := s.client.Get(ctx, s.totalHitsKey()).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return total, err
+}
+
+// Close implements Store.Close
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// parseRedisReply converts a flat HGETALL reply returned by a script
+func parseRedisReply(reply any) (*URL, error) {
+	values, ok := reply.([]any)
+	if !ok || len(values)%2 != 0 {
+		return nil, errRedisReply
+	}
+
+	fields := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		key, _ := values[i].(string)
+		value, _ := values[i+1].(string)
+		fields[key] = value
+	}
+	return parseRedisHash(fields)
+}
+
+// parseRedisHash converts the fields of a url:<id> hash
+func parseRedisHash(fields map[string]string) (*URL, error) {
+	createdAt, err := strconv.ParseInt(fields["created_at"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	hits, err := strconv.Atoi(fields["hits"])
+	if err != nil {
+		return nil, err
+	}
+	maxHits, err := strconv.Atoi(fields["max_hits"])
+	if err != nil {
+		return nil, err
+	}
+
+	url := &URL{
+		ID:        fields["id"],
+		Original:  fields["original"],
+		CreatedAt: time.Unix(0, createdAt),
+		Hits:      hits,
+		MaxHits:   maxHits,
+		Details: Details{
+			Title:       fields["title"],
+			Description: fields["description"],
+			FaviconURL:  fields["favicon_url"],
+			ImageURL:    fields["image_url"],
+		},
+	}
+	if value := fields["tags"]; value != "" {
+		if err := json.Unmarshal([]byte(value), &url.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if value := fields["health"]; value != "" {
+		if err := json.Unmarshal([]byte(value), &url.Health); err != nil {
+			return nil, err
+		}
+	}
+	if value, ok := fields["expires_at"]; ok {
+		expiresAt, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Unix(0, expiresAt)
+		url.ExpiresAt = &t
+	}
+	return url, nil
+}
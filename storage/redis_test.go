@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2/server"
+)
+
+func TestRedisStoreRefusesClusters(t *testing.T) {
+	// A bare server that answers like a cluster node
+	cluster, err := server.NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer cluster.Close()
+	cluster.Register("PING", func(c *server.Peer, cmd string, args []string) {
+		c.WriteInline("PONG")
+	})
+	cluster.Register("INFO", func(c *server.Peer, cmd string, args []string) {
+		c.WriteBulk("# Cluster\r\ncluster_enabled:1\r\n")
+	})
+
+	if _, err := NewRedisStore("redis://" + cluster.Addr().String()); err != errRedisCluster {
+		t.Errorf("Expected errRedisCluster, got %v", err)
+	}
+}
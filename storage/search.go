@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchOptions selects links for Search. Links must match every word of
+// Query and carry every tag in Tags; empty options match every link.
+type SearchOptions struct {
+	// Query is free text. Each of its words must be the start of a word in
+	// the destination, the title or the tags.
+	Query string
+
+	// Tags are tags the links must all have
+	Tags []string
+
+	// Limit caps the number of results; zero means no limit
+	Limit int
+}
+
+// Searcher is implemented by stores that keep an index for Search
+type Searcher interface {
+	// Search returns the matching links, newest first
+	Search(ctx context.Context, opts SearchOptions) ([]*URL, error)
+}
+
+// Search returns the links in store matching opts, newest first. It uses the
+// store's index when it is a Searcher and otherwise reads every link.
+func Search(ctx context.Context, store Store, opts SearchOptions) ([]*URL, error) {
+	if searcher, ok := store.(Searcher); ok {
+		return searcher.Search(ctx, opts)
+	}
+	return scanSearch(ctx, store, opts)
+}
+
+// scanSearch implements Search with Iterate, for stores without an index
+func scanSearch(ctx context.Context, store Store, opts SearchOptions) ([]*URL, error) {
+	terms := searchTerms(opts.Query)
+	tags := NormalizeTags(opts.Tags)
+
+	var urls []*URL
+	err := store.Iterate(ctx, func(url *URL) error {
+		if matchesSearch(url, terms, tags) {
+			urls = append(urls, url)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return searchResults(urls, opts.Limit), nil
+}
+
+// searchTerms splits text into lowercase words of letters and digits, the
+// same way SQLite's unicode61 tokenizer does
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchWords returns the words a link can be found by
+func searchWords(url *URL) []string {
+	words := searchTerms(url.Original)
+	words = append(words, searchTerms(url.Title)...)
+	for _, tag := range url.Tags {
+		words = append(words, searchTerms(tag)...)
+	}
+	return words
+}
+
+// matchesSearch reports whether url has every tag and a word starting with
+// every term
+func matchesSearch(url *URL, terms, tags []string) bool {
+	for _, tag := range tags {
+		if !url.HasTag(tag) {
+			return false
+		}
+	}
+
+	words := searchWords(url)
+	for _, term := range terms {
+		found := false
+		for _, word := range words {
+			if strings.HasPrefix(word, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// searchResults sorts matches newest first and applies the limit
+func searchResults(urls []*URL, limit int) []*URL {
+	sort.Slice(urls, func(i, j int) bool {
+		if !urls[i].CreatedAt.Equal(urls[j].CreatedAt) {
+			return urls[i].CreatedAt.After(urls[j].CreatedAt)
+		}
+		return urls[i].ID > urls[j].ID
+	})
+	if limit > 0 && len(urls) > limit {
+		urls = urls[:limit]
+	}
+	return urls
+}
+
+// searchIndex is an inverted index from words and tags to link IDs, for
+// stores that keep every link in memory
+type searchIndex struct {
+	words map[string]map[string]struct{}
+	tags  map[string]map[string]struct{}
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		words: make(map[string]map[string]struct{}),
+		tags:  make(map[string]map[string]struct{}),
+	}
+}
+
+// add indexes url under its current words and tags
+func (x *searchIndex) add(url *URL) {
+	for _, word := range searchWords(url) {
+		addPosting(x.words, word, url.ID)
+	}
+	for _, tag := range url.Tags {
+		addPosting(x.tags, tag, url.ID)
+	}
+}
+
+// remove drops url from the index; it must have the words and tags it was
+// added with
+func (x *searchIndex) remove(url *URL) {
+	for _, word := range searchWords(url) {
+		removePosting(x.words, word, url.ID)
+	}
+	for _, tag := range url.Tags {
+		removePosting(x.tags, tag, url.ID)
+	}
+}
+
+// match returns the IDs of links matching opts, or all=true when opts has no
+// conditions
+func (x *searchIndex) match(opts SearchOptions) (ids map[string]struct{}, all bool) {
+	conditions := 0
+	narrow := func(matched map[string]struct{}) {
+		conditions++
+		if conditions == 1 {
+			ids = matched
+			return
+		}
+		for id := range ids {
+			if _, ok := matched[id]; !ok {
+				delete(ids, id)
+			}
+		}
+	}
+
+	for _, tag := range NormalizeTags(opts.Tags) {
+		narrow(copyPostings(x.tags[tag]))
+	}
+	for _, term := range searchTerms(opts.Query) {
+		matched := make(map[string]struct{})
+		for word, postings := range x.words {
+			if strings.HasPrefix(word, term) {
+				for id := range postings {
+					matched[id] = struct{}{}
+				}
+			}
+		}
+		narrow(matched)
+	}
+	return ids, conditions == 0
+}
+
+// addPosting records that id has key
+func addPosting(index map[string]map[string]struct{}, key, id string) {
+	postings, ok := index[key]
+	if !ok {
+		postings = make(map[string]struct{})
+		index[key] = postings
+	}
+	postings[id] = struct{}{}
+}
+
+// removePosting forgets that id has key, dropping keys no link has
+func removePosting(index map[string]map[string]struct{}, key, id string) {
+	postings, ok := index[key]
+	if !ok {
+		return
+	}
+	delete(postings, id)
+	if len(postings) == 0 {
+		delete(index, key)
+	}
+}
+
+// copyPostings returns a copy of postings that the caller may change
+func copyPostings(postings map[string]struct{}) map[string]struct{} {
+	copied := make(map[string]struct{}, len(postings))
+	for id := range postings {
+		copied[id] = struct{}{}
+	}
+	return copied
+}
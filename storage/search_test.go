@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	got := NormalizeTags([]string{" Docs ", "q3,roadmap", "", "docs", "Team Wiki"})
+	if strings.Join(got, "|") != "docs|q3|roadmap|team wiki" {
+		t.Errorf("Unexpected tags %q", got)
+	}
+	if NormalizeTags([]string{" ", ","}) != nil {
+		t.Error("Expected nil when no tags remain")
+	}
+}
+
+func TestSQLiteSearchIndex(t *testing.T) {
+	if !SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "urls.db")
+
+	store, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store: %v", err)
+	}
+	if !store.fts {
+		store.Close()
+		t.Skip("SQLite was built without FTS5; run with -tags sqlite_fts5")
+	}
+	store.CreateWithID(ctx, "indexed", "https://example.com/roadmap")
+
+	// A binary without FTS5 drops the triggers, so links it creates are
+	// missing from the index until it is rebuilt
+	for name := range sqliteSearchTriggers {
+		if _, err := store.db.Exec("DROP TRIGGER " + name); err != nil {
+			t.Fatalf("Failed to drop trigger: %v", err)
+		}
+	}
+	store.CreateWithID(ctx, "unindexed", "https://example.com/roadmap-draft")
+	store.Close()
+
+	store, err = NewSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen SQLite store: %v", err)
+	}
+	defer store.Close()
+
+	urls, err := store.Search(ctx, SearchOptions{Query: "roadmap"})
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+	if len(urls) != 2 {
+		t.Errorf("Expected the rebuilt index to find both links, got %d", len(urls))
+	}
+}
@@ -1,90 +1,302 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// ErrSQLiteUnavailable is returned when opening a SQLite database in a
+// binary built without cgo
+var ErrSQLiteUnavailable = errors.New("SQLite is not available in this build; rebuild with CGO_ENABLED=1")
+
 // SQLiteStore implements Store using SQLite
 type SQLiteStore struct {
-	db *sql.DB
+	idAllocator
+	db   *sql.DB
+	hits *hitBuffer
+
+	// fts is set when SQLite has FTS5 and urls_fts indexes the links
+	fts bool
 }
 
 // NewSQLiteStore creates a new SQLite store
 func NewSQLiteStore(path string) (*SQLiteStore, error) {
-	db, err := sql.Open("sqlite3", path)
+	db, err := openSQLite(sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring the schema up to date
+	migrator, err := NewSQLiteMigrator(db)
 	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := migrator.Up(ctx); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	// Create table if not exists
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS urls (
-			id TEXT PRIMARY KEY,
-			original TEXT NOT NULL,
-			created_at TIMESTAMP NOT NULL,
-			hits INTEGER NOT NULL DEFAULT 0
-		)
-	`)
+	fts, err := setupSQLiteSearch(ctx, db)
 	if err != nil {
 		db.Close()
 		return nil, err
 	}
 
-	return &SQLiteStore{db: db}, nil
+	return &SQLiteStore{db: db, fts: fts}, nil
+}
+
+// sqliteSearchTriggers keep urls_fts in step with urls. Hit counts do not
+// touch the indexed columns, so redirects never update the index.
+var sqliteSearchTriggers = map[string]string{
+	"urls_fts_insert": `CREATE TRIGGER urls_fts_insert AFTER INSERT ON urls BEGIN
+		INSERT INTO urls_fts (rowid, original, title, tags) VALUES (new.rowid, new.original, new.title, new.tags);
+	END`,
+	"urls_fts_delete": `CREATE TRIGGER urls_fts_delete AFTER DELETE ON urls BEGIN
+		INSERT INTO urls_fts (urls_fts, rowid, original, title, tags) VALUES ('delete', old.rowid, old.original, old.title, old.tags);
+	END`,
+	"urls_fts_update": `CREATE TRIGGER urls_fts_update AFTER UPDATE OF original, title, tags ON urls BEGIN
+		INSERT INTO urls_fts (urls_fts, rowid, original, title, tags) VALUES ('delete', old.rowid, old.original, old.title, old.tags);
+		INSERT INTO urls_fts (rowid, original, title, tags) VALUES (new.rowid, new.original, new.title, new.tags);
+	END`,
+}
+
+// setupSQLiteSearch creates the urls_fts full-text index over the
+// destination, title and tags when SQLite was built with FTS5 (the
+// sqlite_fts5 build tag), and reports whether it is available. The index is
+// derived from urls, so it is rebuilt whenever its triggers were missing.
+// Without FTS5 the triggers are dropped, since writes would fail on them, and
+// Search scans instead.
+func setupSQLiteSearch(ctx context.Context, db *sql.DB) (bool, error) {
+	var available bool
+	if err := db.QueryRowContext(ctx, "SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available); err != nil {
+		return false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if !available {
+		for name := range sqliteSearchTriggers {
+			if _, err := tx.ExecContext(ctx, "DROP TRIGGER IF EXISTS "+name); err != nil {
+				return false, err
+			}
+		}
+		return false, tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"CREATE VIRTUAL TABLE IF NOT EXISTS urls_fts USING fts5(original, title, tags, content='urls', content_rowid='rowid', tokenize='unicode61 remove_diacritics 0')",
+	); err != nil {
+		return false, err
+	}
+	rebuild := false
+	for name, statement := range sqliteSearchTriggers {
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?", name).Scan(&exists); err != nil {
+			return false, err
+		}
+		if exists > 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return false, err
+		}
+		rebuild = true
+	}
+	if rebuild {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO urls_fts (urls_fts) VALUES ('rebuild')"); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// BufferHits switches to write-behind hit counting: redirects only read, and
+// hits are written in batches. Links with a hit limit are still counted
+// synchronously so the limit holds exactly. Call it before serving traffic.
+func (s *SQLiteStore) BufferHits(opts HitBufferOptions) {
+	s.hits = newHitBuffer(opts, s.writeHits)
+}
+
+// writeHits adds a batch of buffered hits in one transaction
+func (s *SQLiteStore) writeHits(ctx context.Context, batch map[string]int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "UPDATE urls SET hits = hits + ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for id, hits := range batch {
+		if _, err := stmt.ExecContext(ctx, hits, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Flush implements Flusher
+func (s *SQLiteStore) Flush(ctx context.Context) error {
+	return s.hits.flush(ctx)
+}
+
+// RegisterMetrics implements MetricsRegisterer
+func (s *SQLiteStore) RegisterMetrics(registry *prometheus.Registry) {
+	if s.hits != nil {
+		s.hits.registerMetrics(registry)
+	}
+}
+
+// sqlitePlaceholder renders SQLite's bind parameters
+func sqlitePlaceholder(int) string {
+	return "?"
+}
+
+// openSQLite opens a SQLite database, failing with ErrSQLiteUnavailable
+// when the driver was left out of the build
+func openSQLite(dsn string) (*sql.DB, error) {
+	if !SQLiteAvailable {
+		return nil, ErrSQLiteUnavailable
+	}
+	return sql.Open("sqlite3", dsn)
+}
+
+// sqliteDSN makes writers wait for the lock instead of failing immediately,
+// and takes the write lock up front so read-then-update transactions cannot deadlock
+func sqliteDSN(path string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + "_busy_timeout=5000&_txlock=immediate"
 }
 
 // Create implements Store.Create
-func (s *SQLiteStore) Create(original string) (*URL, error) {
+func (s *SQLiteStore) Create(ctx context.Context, original string, opts ...CreateOption) (*URL, error) {
 	// Validate URL
-	parsedURL, err := url.ParseRequestURI(original)
-	if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
-		return nil, ErrInvalid
+	if err := validateURL(original); err != nil {
+		return nil, err
 	}
 
-	// Generate ID (6 characters)
-	id, err := generateID(6)
-	if err != nil {
+	// Generate a short ID, retrying on collisions
+	return s.allocate(original, createDomain(opts), func(id string, extra ...CreateOption) (*URL, error) {
+		return s.CreateWithID(ctx, id, original, append(extra, opts...)...)
+	})
+}
+
+// CreateWithID implements Store.CreateWithID
+func (s *SQLiteStore) CreateWithID(ctx context.Context, id, original string, opts ...CreateOption) (*URL, error) {
+	// Validate URL
+	if err := validateURL(original); err != nil {
 		return nil, err
 	}
 
-	now := time.Now()
+	record := &URL{
+		ID:        id,
+		Original:  original,
+		CreatedAt: time.Now(),
+		Hits:      0,
+	}
+	for _, opt := range opts {
+		opt(record)
+	}
 	
-	// Insert record
-	_, err = s.db.Exec(
-		"INSERT INTO urls (id, original, created_at, hits) VALUES (?, ?, ?, 0)",
-		id, original, now,
+	// Look for a duplicate and insert in one transaction, so that concurrent
+	// deduplicated creates cannot both insert
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if record.dedup {
+		existing, err := findDuplicate(ctx, tx, record, sqlitePlaceholder)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return existing, nil
+		}
+	}
+
+	// Insert record, leaving an existing row with the same ID untouched
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO urls (id, original, created_at, hits, expires_at, max_hits, host, url_hash, domain, title, description, tags, favicon_url, image_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT(id) DO NOTHING",
+		record.ID, record.Original, record.CreatedAt.UTC(), record.Hits, nullableTime(record.ExpiresAt), record.MaxHits, hostOf(record.Original), URLHash(record.Original), record.Domain(),
+		record.Title, record.Description, encodeTags(record.Tags), record.FaviconURL, record.ImageURL,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &URL{
-		ID:        id,
-		Original:  original,
-		CreatedAt: now,
-		Hits:      0,
-	}, nil
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if inserted == 0 {
+		return nil, ErrConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return record, nil
 }
 
 // Get implements Store.Get
-func (s *SQLiteStore) Get(id string) (*URL, error) {
-	var url URL
-	
+func (s *SQLiteStore) Get(ctx context.Context, id string) (*URL, error) {
+	if s.hits == nil {
+		return s.countHit(ctx, id)
+	}
+
+	// Read only, and leave the hit to the write-behind buffer
+	url, err := s.Lookup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if url.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	if url.MaxHits > 0 {
+		return s.countHit(ctx, id)
+	}
+
+	s.hits.add(id)
+	url.Hits++
+
+	return url, nil
+}
+
+// countHit increments the hit counter in a transaction, enforcing expiry and MaxHits
+func (s *SQLiteStore) countHit(ctx context.Context, id string) (*URL, error) {
 	// Begin transaction to ensure atomicity of read+update
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
 
 	// Get URL record
-	err = tx.QueryRow(
-		"SELECT id, original, created_at, hits FROM urls WHERE id = ?",
+	url, err := scanURL(tx.QueryRowContext(ctx,
+		"SELECT "+urlColumns+" FROM urls WHERE id = ?",
 		id,
-	).Scan(&url.ID, &url.Original, &url.CreatedAt, &url.Hits)
+	))
 	
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
@@ -92,12 +304,26 @@ func (s *SQLiteStore) Get(id string) (*URL, error) {
 	if err != nil {
 		return nil, err
 	}
+	if url.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
 
-	// Increment hits
-	_, err = tx.Exec("UPDATE urls SET hits = hits + 1 WHERE id = ?", id)
+	// Increment hits, refusing once the limit is reached so that
+	// concurrent visitors cannot push a link past MaxHits
+	result, err := tx.ExecContext(ctx,
+		"UPDATE urls SET hits = hits + 1 WHERE id = ? AND (max_hits = 0 OR hits < max_hits)",
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := result.RowsAffected()
 	if err != nil {
 		return nil, err
 	}
+	if updated == 0 {
+		return nil, ErrExhausted
+	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
@@ -107,48 +333,223 @@ func (s *SQLiteStore) Get(id string) (*URL, error) {
 	// Return URL with incremented hit count
 	url.Hits++
 	
-	return &url, nil
+	return url, nil
 }
 
-// GetStats implements Store.GetStats
-func (s *SQLiteStore) GetStats() ([]*URL, error) {
-	rows, err := s.db.Query("SELECT id, original, created_at, hits FROM urls")
+// RecordHit implements HitRecorder.RecordHit
+func (s *SQLiteStore) RecordHit(ctx context.Context, id string) error {
+	if s.hits != nil {
+		s.hits.add(id)
+		return nil
+	}
+
+	_, err := s.db.ExecContext(ctx, "UPDATE urls SET hits = hits + 1 WHERE id = ?", id)
+	return err
+}
+
+// Lookup implements Store.Lookup
+func (s *SQLiteStore) Lookup(ctx context.Context, id string) (*URL, error) {
+	url, err := scanURL(s.db.QueryRowContext(ctx, "SELECT "+urlColumns+" FROM urls WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	url.Hits += s.hits.pendingFor(id)
+	return url, nil
+}
 
-	var urls []*URL
-	for rows.Next() {
-		var url URL
-		if err := rows.Scan(&url.ID, &url.Original, &url.CreatedAt, &url.Hits); err != nil {
+// Update implements Store.Update
+func (s *SQLiteStore) Update(ctx context.Context, id, original string, opts ...UpdateOption) (*URL, error) {
+	// Validate URL
+	if original != "" {
+		if err := validateURL(original); err != nil {
 			return nil, err
 		}
-		urls = append(urls, &url)
 	}
 
-	if err := rows.Err(); err != nil {
+	url, err := updateURL(ctx, s.db, id, original, collectUpdate(opts), sqlitePlaceholder)
+	if err != nil {
+		return nil, err
+	}
+	url.Hits += s.hits.pendingFor(id)
+	return url, nil
+}
+
+// SetHealth implements Store.SetHealth
+func (s *SQLiteStore) SetHealth(ctx context.Context, id string, health Health) error {
+	return setHealth(ctx, s.db, id, health, sqlitePlaceholder)
+}
+
+// SetDetails implements Store.SetDetails
+func (s *SQLiteStore) SetDetails(ctx context.Context, id string, details Details) (*URL, error) {
+	url, err := setDetails(ctx, s.db, id, details, sqlitePlaceholder)
+	if err != nil {
+		return nil, err
+	}
+	url.Hits += s.hits.pendingFor(id)
+	return url, nil
+}
+
+// Delete implements Store.Delete
+func (s *SQLiteStore) Delete(ctx context.Context, id string) error {
+	removed, err := deleteURLs(ctx, s.db, "id = ?", id)
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	s.hits.discard(id)
+	return nil
+}
+
+// DeleteExpired implements Store.DeleteExpired
+func (s *SQLiteStore) DeleteExpired(ctx context.Context, before time.Time) (int, error) {
+	return deleteURLs(ctx, s.db, "expires_at IS NOT NULL AND expires_at <= ?", before.UTC())
+}
+
+// GetStats implements Store.GetStats
+func (s *SQLiteStore) GetStats(ctx context.Context) ([]*URL, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+urlColumns+" FROM urls")
+	if err != nil {
 		return nil, err
 	}
 
+	urls, err := scanURLs(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range urls {
+		url.Hits += s.hits.pendingFor(url.ID)
+	}
+	return urls, nil
+}
+
+// List implements Store.List
+func (s *SQLiteStore) List(ctx context.Context, opts ListOptions) (*ListPage, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	cursor, err := opts.decodeCursor()
+	if err != nil {
+		return nil, err
+	}
+
+	// Write buffered hits first so that sorting by hits and cursors agree
+	if err := s.hits.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	query, args := listQuery(&opts, cursor, sqlitePlaceholder)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	urls, err := scanURLs(rows)
+	if err != nil {
+		return nil, err
+	}
+	return opts.page(urls), nil
+}
+
+// Iterate implements Store.Iterate
+func (s *SQLiteStore) Iterate(ctx context.Context, fn func(*URL) error) error {
+	// Write buffered hits first so that every URL is read with its full count
+	if err := s.hits.flush(ctx); err != nil {
+		return err
+	}
+	return iterateURLs(ctx, s.db, fn, sqlitePlaceholder)
+}
+
+// Search implements Searcher with the urls_fts index, or by scanning every
+// link when SQLite was built without FTS5
+func (s *SQLiteStore) Search(ctx context.Context, opts SearchOptions) ([]*URL, error) {
+	if !s.fts {
+		return scanSearch(ctx, s, opts)
+	}
+
+	var conditions []string
+	var args []any
+	if terms := searchTerms(opts.Query); len(terms) > 0 {
+		// Terms only hold letters and digits, so quoting them is enough
+		phrases := make([]string, len(terms))
+		for i, term := range terms {
+			phrases[i] = `"` + term + `"*`
+		}
+		conditions = append(conditions, "rowid IN (SELECT rowid FROM urls_fts WHERE urls_fts MATCH ?)")
+		args = append(args, strings.Join(phrases, " "))
+	}
+	for _, tag := range NormalizeTags(opts.Tags) {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(urls.tags) WHERE value = ?)")
+		args = append(args, tag)
+	}
+
+	query := "SELECT " + urlColumns + " FROM urls"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	urls, err := scanURLs(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range urls {
+		url.Hits += s.hits.pendingFor(url.ID)
+	}
 	return urls, nil
 }
 
 // GetTotalCount implements Store.GetTotalCount
-func (s *SQLiteStore) GetTotalCount() (int, error) {
+func (s *SQLiteStore) GetTotalCount(ctx context.Context) (int, error) {
 	var count int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM urls").Scan(&count)
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls").Scan(&count)
 	return count, err
 }
 
 // GetTotalHits implements Store.GetTotalHits
-func (s *SQLiteStore) GetTotalHits() (int, error) {
+func (s *SQLiteStore) GetTotalHits(ctx context.Context) (int, error) {
 	var total int
-	err := s.db.QueryRow("SELECT COALESCE(SUM(hits), 0) FROM urls").Scan(&total)
-	return total, err
+	if err := s.db.QueryRowContext(ctx, "SELECT COALESCE(SUM(hits), 0) FROM urls").Scan(&total); err != nil {
+		return 0, err
+	}
+	return total + s.hits.total(), nil
 }
 
-// Close implements Store.Close
+// RecordClicks implements ClickStore.RecordClicks
+func (s *SQLiteStore) RecordClicks(ctx context.Context, clicks []Click) error {
+	return insertClicks(ctx, s.db, clicks, sqlitePlaceholder)
+}
+
+// ListClicks implements ClickStore.ListClicks
+func (s *SQLiteStore) ListClicks(ctx context.Context, id string, from, to time.Time) ([]Click, error) {
+	return selectClicks(ctx, s.db, id, from, to, sqlitePlaceholder)
+}
+
+// DeleteClicksBefore implements ClickStore.DeleteClicksBefore
+func (s *SQLiteStore) DeleteClicksBefore(ctx context.Context, before time.Time) (int, error) {
+	return pruneClicks(ctx, s.db, before, sqlitePlaceholder)
+}
+
+// Close implements Store.Close, writing any buffered hits first
 func (s *SQLiteStore) Close() error {
-	return s.db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	flushErr := s.hits.close(ctx)
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return flushErr
 }
@@ -0,0 +1,11 @@
+//go:build cgo
+
+package storage
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteAvailable reports whether the binary includes the SQLite driver,
+// which needs cgo
+const SQLiteAvailable = true
@@ -0,0 +1,8 @@
+//go:build !cgo
+
+package storage
+
+// SQLiteAvailable reports whether the binary includes the SQLite driver,
+// which needs cgo. Builds with CGO_ENABLED=0 leave it out and can only use
+// the other stores.
+const SQLiteAvailable = false
@@ -0,0 +1,14 @@
+//go:build !cgo
+
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteUnavailableWithoutCgo(t *testing.T) {
+	if _, err := NewSQLiteStore(filepath.Join(t.TempDir(), "urls.db")); err != ErrSQLiteUnavailable {
+		t.Errorf("Expected ErrSQLiteUnavailable, got %v", err)
+	}
+}
@@ -0,0 +1,387 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Helpers shared by the database/sql backends (SQLite and PostgreSQL),
+// which use the same urls table layout.
+
+// urlColumns lists the columns read by scanURL, in order
+const urlColumns = "id, original, created_at, hits, expires_at, max_hits, title, description, tags, favicon_url, image_url, " +
+	"health_status, health_error, health_latency_ms, health_checked_at, health_ok_at"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanURL reads a URL record selected with urlColumns
+func scanURL(row rowScanner) (*URL, error) {
+	var url URL
+	var expiresAt sql.NullTime
+	var tags string
+	var health Health
+	var checkedAt, lastOKAt sql.NullTime
+	if err := row.Scan(&url.ID, &url.Original, &url.CreatedAt, &url.Hits, &expiresAt, &url.MaxHits, &url.Title, &url.Description, &tags, &url.FaviconURL, &url.ImageURL,
+		&health.StatusCode, &health.Error, &health.LatencyMS, &checkedAt, &lastOKAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		url.ExpiresAt = &expiresAt.Time
+	}
+	if checkedAt.Valid {
+		health.CheckedAt = checkedAt.Time
+		if lastOKAt.Valid {
+			health.LastOKAt = &lastOKAt.Time
+		}
+		url.Health = &health
+	}
+	if err := json.Unmarshal([]byte(tags), &url.Tags); err != nil {
+		return nil, err
+	}
+	return &url, nil
+}
+
+// encodeTags renders tags as the JSON array stored in the tags column
+func encodeTags(tags []string) string {
+	if len(tags) == 0 {
+		return "[]"
+	}
+	data, _ := json.Marshal(tags)
+	return string(data)
+}
+
+// scanURLs reads and closes rows selected with urlColumns
+func scanURLs(rows *sql.Rows) ([]*URL, error) {
+	defer rows.Close()
+
+	var urls []*URL
+	for rows.Next() {
+		url, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// nullableTime converts an optional time to a UTC value, so that SQLite can
+// compare stored timestamps as text
+func nullableTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// escapeLike escapes LIKE wildcards so the pattern matches literally
+func escapeLike(pattern string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(pattern)
+}
+
+// findDuplicate returns an existing link that can stand in for record, or nil
+func findDuplicate(ctx context.Context, tx *sql.Tx, record *URL, placeholder func(n int) string) (*URL, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT "+urlColumns+" FROM urls WHERE url_hash = "+placeholder(1),
+		URLHash(record.Original),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := scanURLs(rows)
+	if err != nil {
+		return nil, err
+	}
+	return findReusable(candidates, record), nil
+}
+
+// backfillURLHashes fills url_hash for rows created before it existed
+func backfillURLHashes(ctx context.Context, tx *sql.Tx, placeholder func(n int) string) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id, original FROM urls WHERE url_hash IS NULL")
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]string)
+	for rows.Next() {
+		var id, original string
+		if err := rows.Scan(&id, &original); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = URLHash(original)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	update := "UPDATE urls SET url_hash = " + placeholder(1) + " WHERE id = " + placeholder(2)
+	for id, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, update, hash, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearHealth is the SET clause that forgets the health of a link whose
+// destination changed
+const clearHealth = "health_status = 0, health_error = '', health_latency_ms = 0, health_checked_at = NULL, health_ok_at = NULL"
+
+// healthConditions are the WHERE clauses for ListOptions.Health
+var healthConditions = map[string]string{
+	HealthBroken:    "health_checked_at IS NOT NULL AND (health_status = 0 OR health_status >= 400)",
+	HealthHealthy:   "health_checked_at IS NOT NULL AND health_status > 0 AND health_status < 400",
+	HealthUnchecked: "health_checked_at IS NULL",
+}
+
+// setHealth implements Store.SetHealth for the database/sql backends
+func setHealth(ctx context.Context, db *sql.DB, id string, health Health, placeholder func(n int) string) error {
+	result, err := db.ExecContext(ctx,
+		"UPDATE urls SET health_status = "+placeholder(1)+", health_error = "+placeholder(2)+
+			", health_latency_ms = "+placeholder(3)+", health_checked_at = "+placeholder(4)+
+			", health_ok_at = "+placeholder(5)+" WHERE id = "+placeholder(6),
+		health.StatusCode, health.Error, health.LatencyMS, health.CheckedAt.UTC(), nullableTime(health.LastOKAt), id,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// updateURL implements Store.Update for the database/sql backends, making
+// every change in one statement
+func updateURL(ctx context.Context, db *sql.DB, id, original string, opts updateOptions, placeholder func(n int) string) (*URL, error) {
+	var sets []string
+	var args []any
+	bind := func(value any) string {
+		args = append(args, value)
+		return placeholder(len(args))
+	}
+	if original != "" {
+		sets = append(sets, "original = "+bind(original), "host = "+bind(hostOf(original)),
+			"url_hash = "+bind(URLHash(original)), clearHealth)
+	}
+	set, fill := opts.detailFields()
+	for _, field := range set {
+		sets = append(sets, field.name+" = "+bind(field.value))
+	}
+	for _, field := range fill {
+		sets = append(sets, field.name+" = CASE WHEN "+field.name+" = '' THEN "+bind(field.value)+" ELSE "+field.name+" END")
+	}
+	if len(sets) == 0 {
+		sets = append(sets, "id = id")
+	}
+
+	where := "id = " + bind(id)
+	if opts.destination != "" {
+		where += " AND original = " + bind(opts.destination)
+	}
+	url, err := scanURL(db.QueryRowContext(ctx,
+		"UPDATE urls SET "+strings.Join(sets, ", ")+" WHERE "+where+" RETURNING "+urlColumns,
+		args...,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return url, err
+}
+
+// setDetails implements Store.SetDetails for the database/sql backends
+func setDetails(ctx context.Context, db *sql.DB, id string, details Details, placeholder func(n int) string) (*URL, error) {
+	details = details.normalize()
+	url, err := scanURL(db.QueryRowContext(ctx,
+		"UPDATE urls SET title = "+placeholder(1)+", description = "+placeholder(2)+", tags = "+placeholder(3)+
+			", favicon_url = "+placeholder(4)+", image_url = "+placeholder(5)+
+			" WHERE id = "+placeholder(6)+" RETURNING "+urlColumns,
+		details.Title, details.Description, encodeTags(details.Tags), details.FaviconURL, details.ImageURL, id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return url, err
+}
+
+// iterateURLs implements Store.Iterate with keyset pagination on id, so no
+// query stays open while fn runs
+func iterateURLs(ctx context.Context, db *sql.DB, fn func(*URL) error, placeholder func(n int) string) error {
+	query := "SELECT " + urlColumns + " FROM urls WHERE id > " + placeholder(1) + " ORDER BY id LIMIT " + placeholder(2)
+	after := ""
+	for {
+		rows, err := db.QueryContext(ctx, query, after, iterateBatchSize)
+		if err != nil {
+			return err
+		}
+		urls, err := scanURLs(rows)
+		if err != nil {
+			return err
+		}
+
+		for _, url := range urls {
+			if err := fn(url); err != nil {
+				return err
+			}
+		}
+		if len(urls) < iterateBatchSize {
+			return nil
+		}
+		after = urls[len(urls)-1].ID
+	}
+}
+
+// listQuery builds the SELECT behind Store.List. placeholder renders the
+// n-th (1-based) bind parameter in the driver's syntax.
+func listQuery(opts *ListOptions, cursor *listCursor, placeholder func(n int) string) (string, []any) {
+	var conditions []string
+	var args []any
+	bind := func(value any) string {
+		args = append(args, value)
+		return placeholder(len(args))
+	}
+
+	// Build filters
+	if opts.CreatedFrom != nil {
+		conditions = append(conditions, "created_at >= "+bind(opts.CreatedFrom.UTC()))
+	}
+	if opts.CreatedTo != nil {
+		conditions = append(conditions, "created_at < "+bind(opts.CreatedTo.UTC()))
+	}
+	if opts.Host != "" {
+		conditions = append(conditions, "host LIKE "+bind("%"+escapeLike(opts.Host)+"%")+` ESCAPE '\'`)
+	}
+	if opts.Domain != nil {
+		conditions = append(conditions, "domain = "+bind(*opts.Domain))
+	}
+	if opts.Health != "" {
+		conditions = append(conditions, healthConditions[opts.Health])
+	}
+
+	// Continue after the cursor using the (sort key, id) index
+	direction, comparison := "ASC", ">"
+	if opts.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if cursor != nil {
+		var key any = cursor.CreatedAt.UTC()
+		if opts.SortBy == SortByHits {
+			key = cursor.Hits
+		}
+		conditions = append(conditions,
+			"("+opts.SortBy+", id) "+comparison+" ("+bind(key)+", "+bind(cursor.ID)+")")
+	}
+
+	query := "SELECT " + urlColumns + " FROM urls"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY " + opts.SortBy + " " + direction + ", id " + direction
+	if opts.Limit > 0 {
+		query += " LIMIT " + bind(opts.Limit+1)
+	}
+
+	return query, args
+}
+
+// deleteURLs removes the links matching condition together with their clicks
+// in one transaction, so that an alias created later under the same ID starts
+// without history, and returns how many links were removed
+func deleteURLs(ctx context.Context, db *sql.DB, condition string, args ...any) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM clicks WHERE url_id IN (SELECT id FROM urls WHERE "+condition+")", args...); err != nil {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM urls WHERE "+condition, args...)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(removed), tx.Commit()
+}
+
+// insertClicks writes a batch of clicks in one transaction
+func insertClicks(ctx context.Context, db *sql.DB, clicks []Click, placeholder func(n int) string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx,
+		"INSERT INTO clicks (url_id, clicked_at, referrer, user_agent, language, client_ip, country, city) VALUES ("+
+			placeholder(1)+", "+placeholder(2)+", "+placeholder(3)+", "+placeholder(4)+", "+
+			placeholder(5)+", "+placeholder(6)+", "+placeholder(7)+", "+placeholder(8)+")",
+	)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, click := range clicks {
+		if _, err := stmt.ExecContext(ctx, click.URLID, click.Time.UTC(), click.Referrer, click.UserAgent, click.Language, click.ClientIP, click.Country, click.City); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// selectClicks reads the clicks for id in [from, to), oldest first
+func selectClicks(ctx context.Context, db *sql.DB, id string, from, to time.Time, placeholder func(n int) string) ([]Click, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT url_id, clicked_at, referrer, user_agent, language, client_ip, country, city FROM clicks"+
+			" WHERE url_id = "+placeholder(1)+" AND clicked_at >= "+placeholder(2)+" AND clicked_at < "+placeholder(3)+
+			" ORDER BY clicked_at, id",
+		id, from.UTC(), to.UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clicks []Click
+	for rows.Next() {
+		var click Click
+		if err := rows.Scan(&click.URLID, &click.Time, &click.Referrer, &click.UserAgent, &click.Language, &click.ClientIP, &click.Country, &click.City); err != nil {
+			return nil, err
+		}
+		clicks = append(clicks, click)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return clicks, nil
+}
+
+// pruneClicks removes clicks recorded before the given time
+func pruneClicks(ctx context.Context, db *sql.DB, before time.Time, placeholder func(n int) string) (int, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM clicks WHERE clicked_at < "+placeholder(1), before.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
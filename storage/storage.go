@@ -1,41 +1,162 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"net/url"
 	"time"
 )
 
 // URL represents a shortened URL record
 type URL struct {
-	ID        string    `json:"id"`
-	Original  string    `json:"original"`
-	CreatedAt time.Time `json:"created_at"`
-	Hits      int       `json:"hits"`
+	ID        string     `json:"id"`
+	Original  string     `json:"original"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Hits      int        `json:"hits"`
+	MaxHits   int        `json:"max_hits,omitempty"`
+	Details
+	Health *Health `json:"health,omitempty"`
+
+	// dedup, domain and ttl are set by WithDedup, WithDomain and WithTTL and
+	// only affect creation
+	dedup  bool
+	domain string
+	ttl    time.Duration
+}
+
+// Expired reports whether the URL has an expiry at or before now
+func (u *URL) Expired(now time.Time) bool {
+	return u.ExpiresAt != nil && !u.ExpiresAt.After(now)
+}
+
+// Exhausted reports whether the URL has used up its allowed hits
+func (u *URL) Exhausted() bool {
+	return u.MaxHits > 0 && u.Hits >= u.MaxHits
 }
 
-// Store defines the interface for URL storage
+// CreateOption customizes a URL record before it is stored
+type CreateOption func(*URL)
+
+// WithExpiry makes the URL stop redirecting at expiresAt
+func WithExpiry(expiresAt time.Time) CreateOption {
+	return func(u *URL) {
+		u.ExpiresAt = &expiresAt
+	}
+}
+
+// WithTTL makes the URL stop redirecting ttl after it is created. Unlike
+// WithExpiry, deduplication then matches links created with the same ttl.
+func WithTTL(ttl time.Duration) CreateOption {
+	return func(u *URL) {
+		expiresAt := time.Now().Add(ttl)
+		u.ExpiresAt = &expiresAt
+		u.ttl = ttl
+	}
+}
+
+// WithMaxHits makes the URL stop redirecting after maxHits visits
+func WithMaxHits(maxHits int) CreateOption {
+	return func(u *URL) {
+		u.MaxHits = maxHits
+	}
+}
+
+// WithCreatedAt sets the creation time, for records carried over from
+// another store
+func WithCreatedAt(createdAt time.Time) CreateOption {
+	return func(u *URL) {
+		u.CreatedAt = createdAt
+	}
+}
+
+// WithHits starts the hit counter at hits, for records carried over from
+// another store
+func WithHits(hits int) CreateOption {
+	return func(u *URL) {
+		u.Hits = hits
+	}
+}
+
+// Store defines the interface for URL storage.
+// Every method except Close honours cancellation and deadlines on ctx:
+// stores that wait on a database give up on it, and in-memory stores check
+// ctx before they start and between the records they iterate over.
 type Store interface {
 	// Create stores a new shortened URL
-	Create(url string) (*URL, error)
-	
-	// Get retrieves a URL by its ID and increments hit counter
-	Get(id string) (*URL, error)
-	
+	Create(ctx context.Context, url string, opts ...CreateOption) (*URL, error)
+
+	// CreateWithID stores a new shortened URL under a caller-chosen ID
+	CreateWithID(ctx context.Context, id, url string, opts ...CreateOption) (*URL, error)
+
+	// Get retrieves a URL by its ID and increments hit counter,
+	// failing with ErrExhausted once MaxHits is reached
+	Get(ctx context.Context, id string) (*URL, error)
+
+	// Lookup retrieves a URL by its ID without counting a hit
+	Lookup(ctx context.Context, id string) (*URL, error)
+
+	// Update changes the destination of an existing URL, clearing its health,
+	// and makes the changes in opts, all at once. An empty url keeps the
+	// destination and health.
+	Update(ctx context.Context, id, url string, opts ...UpdateOption) (*URL, error)
+
+	// SetDetails replaces the title, description and tags of an existing URL
+	SetDetails(ctx context.Context, id string, details Details) (*URL, error)
+
+	// SetHealth records the latest check of an existing URL's destination
+	SetHealth(ctx context.Context, id string, health Health) error
+
+	// Delete removes a URL by its ID
+	Delete(ctx context.Context, id string) error
+
+	// DeleteExpired removes URLs that expired before the given time
+	DeleteExpired(ctx context.Context, before time.Time) (int, error)
+
 	// GetStats retrieves all URLs stats
-	GetStats() ([]*URL, error)
-	
+	GetStats(ctx context.Context) ([]*URL, error)
+
+	// List retrieves a filtered, sorted page of URLs
+	List(ctx context.Context, opts ListOptions) (*ListPage, error)
+
+	// Iterate calls fn for every URL in ID order, reading them in batches
+	// rather than all at once, and stops at the first error fn returns.
+	// URLs created or deleted meanwhile may or may not be visited.
+	Iterate(ctx context.Context, fn func(*URL) error) error
+
 	// GetTotalCount returns the total number of shortened URLs
-	GetTotalCount() (int, error)
-	
+	GetTotalCount(ctx context.Context) (int, error)
+
 	// GetTotalHits returns the total number of hits across all URLs
-	GetTotalHits() (int, error)
-	
-	// Close cleans up any resources
+	GetTotalHits(ctx context.Context) (int, error)
+
+	// Close writes out anything buffered and cleans up any resources.
+	// Calling it again is harmless.
 	Close() error
 }
 
+// HitRecorder is implemented by stores that can count a hit without reading
+// the record back, so that CachedStore can serve redirects from memory
+type HitRecorder interface {
+	// RecordHit counts one hit for id without checking expiry or MaxHits;
+	// unknown IDs are ignored
+	RecordHit(ctx context.Context, id string) error
+}
+
 // Common errors
 var (
-	ErrNotFound = errors.New("url not found")
-	ErrInvalid  = errors.New("invalid url")
+	ErrNotFound  = errors.New("url not found")
+	ErrInvalid   = errors.New("invalid url")
+	ErrConflict  = errors.New("url id already exists")
+	ErrExpired   = errors.New("url expired")
+	ErrExhausted = errors.New("url hit limit reached")
 )
+
+// validateURL checks that original is an absolute URL with a scheme and host
+func validateURL(original string) error {
+	parsedURL, err := url.ParseRequestURI(original)
+	if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		return ErrInvalid
+	}
+	return nil
+}
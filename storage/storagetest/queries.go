@@ -0,0 +1,348 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+)
+
+func testList(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	// Create URLs on a host no other subtest uses, with distinct hit counts
+	var ids []string
+	for i := 0; i < 5; i++ {
+		url, err := store.Create(ctx, "https://list.example.org/item-"+string(rune('a'+i)))
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		for j := 0; j < i; j++ {
+			if _, err := store.Get(ctx, url.ID); err != nil {
+				t.Fatalf("Failed to get URL: %v", err)
+			}
+		}
+		ids = append(ids, url.ID)
+		time.Sleep(time.Millisecond)
+	}
+
+	// Walk all pages sorted by creation time
+	var seen []string
+	opts := storage.ListOptions{SortBy: storage.SortByCreatedAt, Limit: 2, Host: "list.example"}
+	for {
+		page, err := store.List(ctx, opts)
+		if err != nil {
+			t.Fatalf("Failed to list URLs: %v", err)
+		}
+		for _, url := range page.URLs {
+			seen = append(seen, url.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.Cursor = page.NextCursor
+	}
+	if len(seen) != len(ids) {
+		t.Fatalf("Expected %d URLs across pages, got %d", len(ids), len(seen))
+	}
+	for i := range ids {
+		if seen[i] != ids[i] {
+			t.Errorf("Expected URL %d to be %q, got %q", i, ids[i], seen[i])
+		}
+	}
+
+	// Most visited first
+	page, err := store.List(ctx, storage.ListOptions{SortBy: storage.SortByHits, Descending: true, Limit: 1, Host: "list.example"})
+	if err != nil {
+		t.Fatalf("Failed to list URLs: %v", err)
+	}
+	if len(page.URLs) != 1 || page.URLs[0].ID != ids[4] || page.URLs[0].Hits != 4 {
+		t.Errorf("Expected most visited URL %q with 4 hits, got %+v", ids[4], page.URLs)
+	}
+
+	// Creation time window
+	created, err := store.Lookup(ctx, ids[2])
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	page, err = store.List(ctx, storage.ListOptions{CreatedFrom: &created.CreatedAt, Host: "list.example"})
+	if err != nil {
+		t.Fatalf("Failed to list URLs: %v", err)
+	}
+	if len(page.URLs) != 3 {
+		t.Errorf("Expected 3 URLs created from the third one, got %d", len(page.URLs))
+	}
+
+	// Cursors are tied to their sort order
+	_, err = store.List(ctx, storage.ListOptions{SortBy: storage.SortByCreatedAt, Cursor: opts.Cursor})
+	if err != nil {
+		t.Errorf("Expected cursor to be accepted for its own sort, got %v", err)
+	}
+	_, err = store.List(ctx, storage.ListOptions{SortBy: storage.SortByHits, Cursor: opts.Cursor})
+	if err != storage.ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor for mismatched sort, got %v", err)
+	}
+	_, err = store.List(ctx, storage.ListOptions{Cursor: "garbage"})
+	if err != storage.ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor for garbage cursor, got %v", err)
+	}
+}
+
+func testIterate(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	// A record carried over from another store keeps its history
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	carried, err := store.CreateWithID(ctx, "iterate-carried", "https://example.com/carried", storage.WithCreatedAt(createdAt), storage.WithHits(7))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if carried.Hits != 7 || !carried.CreatedAt.Equal(createdAt) {
+		t.Errorf("Unexpected carried URL: %+v", carried)
+	}
+
+	count, err := store.GetTotalCount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get total count: %v", err)
+	}
+	var seen []*storage.URL
+	err = store.Iterate(ctx, func(url *storage.URL) error {
+		seen = append(seen, url)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to iterate URLs: %v", err)
+	}
+	if len(seen) != count {
+		t.Fatalf("Expected %d URLs, got %d", count, len(seen))
+	}
+	found := false
+	for i, url := range seen {
+		if i > 0 && seen[i-1].ID >= url.ID {
+			t.Errorf("Expected URLs in ID order, got %q before %q", seen[i-1].ID, url.ID)
+		}
+		if url.ID == carried.ID {
+			found = true
+			if url.Hits != 7 || !url.CreatedAt.Equal(createdAt) {
+				t.Errorf("Unexpected iterated URL: %+v", url)
+			}
+		}
+	}
+	if !found {
+		t.Error("Expected the carried URL to be visited")
+	}
+
+	// An error from fn stops the walk
+	stop := errors.New("stop")
+	calls := 0
+	err = store.Iterate(ctx, func(url *storage.URL) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Expected Iterate to stop after the first error, got %v after %d calls", err, calls)
+	}
+}
+
+func testDomains(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	// The same code can point somewhere else on each domain
+	plain, err := store.CreateWithID(ctx, "brand", "https://domains.example.net/plain")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	branded, err := store.CreateWithID(ctx, storage.LinkKey("go.team.io", "brand"), "https://domains.example.net/team")
+	if err != nil {
+		t.Fatalf("Failed to create URL on a domain: %v", err)
+	}
+	if branded.Domain() != "go.team.io" || plain.Domain() != "" {
+		t.Errorf("Unexpected domains %q and %q", branded.Domain(), plain.Domain())
+	}
+	got, err := store.Get(ctx, storage.LinkKey("go.team.io", "brand"))
+	if err != nil || got.Original != "https://domains.example.net/team" {
+		t.Errorf("Expected the domain's link, got %+v, %v", got, err)
+	}
+
+	// Generated codes are namespaced, and dedup stays within a domain
+	generated, err := store.Create(ctx, "https://domains.example.net/plain", storage.WithDomain("links.product.com"), storage.WithDedup())
+	if err != nil {
+		t.Fatalf("Failed to create URL on a domain: %v", err)
+	}
+	if generated.ID == plain.ID || generated.Domain() != "links.product.com" {
+		t.Errorf("Expected a new link on links.product.com, got %q", generated.ID)
+	}
+	if looked, err := store.Lookup(ctx, generated.ID); err != nil || looked.Domain() != "links.product.com" {
+		t.Errorf("Expected to look up %q, got %+v, %v", generated.ID, looked, err)
+	}
+
+	// List filters by domain
+	for _, domain := range []string{"", "go.team.io", "links.product.com"} {
+		page, err := store.List(ctx, storage.ListOptions{Host: "domains.example.net", Domain: &domain})
+		if err != nil {
+			t.Fatalf("Failed to list URLs: %v", err)
+		}
+		if len(page.URLs) != 1 || page.URLs[0].Domain() != domain {
+			t.Errorf("Expected one link on %q, got %+v", domain, page.URLs)
+		}
+	}
+}
+
+func testDetailsAndSearch(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	search := func(opts storage.SearchOptions) string {
+		t.Helper()
+		urls, err := storage.Search(ctx, store, opts)
+		if err != nil {
+			t.Fatalf("Failed to search: %v", err)
+		}
+		ids := make([]string, 0, len(urls))
+		for _, url := range urls {
+			ids = append(ids, url.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	created, err := store.CreateWithID(ctx, "handbook", "https://wiki.searchtest.net/engineering-handbook",
+		storage.WithDetails(storage.Details{Title: "Engineering Handbook", Description: "How we work", Tags: []string{"Onboarding", "docs", " docs"}}))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if strings.Join(created.Tags, ",") != "docs,onboarding" {
+		t.Errorf("Expected normalized tags, got %q", created.Tags)
+	}
+	looked, err := store.Lookup(ctx, "handbook")
+	if err != nil || looked.Title != "Engineering Handbook" || looked.Description != "How we work" || strings.Join(looked.Tags, ",") != "docs,onboarding" {
+		t.Errorf("Expected the details to be stored, got %+v, %v", looked, err)
+	}
+	if _, err := store.CreateWithID(ctx, "handbook-v1", "https://wiki.searchtest.net/handbook-v1", storage.WithDetails(storage.Details{Tags: []string{"docs"}})); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	// Words match the start of words in the destination, title and tags,
+	// newest first
+	for _, tc := range []struct {
+		opts storage.SearchOptions
+		want string
+	}{
+		{storage.SearchOptions{Query: "handbook"}, "handbook-v1,handbook"},
+		{storage.SearchOptions{Query: "Engin HAND"}, "handbook"},
+		{storage.SearchOptions{Query: "onboard"}, "handbook"},
+		{storage.SearchOptions{Query: "searchtest", Tags: []string{"docs"}}, "handbook-v1,handbook"},
+		{storage.SearchOptions{Tags: []string{"docs", "onboarding"}}, "handbook"},
+		{storage.SearchOptions{Query: "searchtest", Limit: 1}, "handbook-v1"},
+		{storage.SearchOptions{Query: "andbook"}, ""},
+	} {
+		if got := search(tc.opts); got != tc.want {
+			t.Errorf("Search(%+v) = %q, want %q", tc.opts, got, tc.want)
+		}
+	}
+
+	// Changing the details or the destination updates the index
+	updated, err := store.SetDetails(ctx, "handbook", storage.Details{Title: "Staff Guide", Tags: []string{"HR"}, FaviconURL: "https://intranet.searchtest.net/favicon.ico"})
+	if err != nil {
+		t.Fatalf("Failed to set details: %v", err)
+	}
+	if updated.Title != "Staff Guide" || updated.Description != "" || strings.Join(updated.Tags, ",") != "hr" || updated.Original != created.Original {
+		t.Errorf("Unexpected record after SetDetails: %+v", updated)
+	}
+	if looked, _ := store.Lookup(ctx, "handbook"); looked.FaviconURL != "https://intranet.searchtest.net/favicon.ico" || looked.ImageURL != "" {
+		t.Errorf("Expected the favicon to be stored, got %+v", looked.Details)
+	}
+	if _, err := store.Update(ctx, "handbook-v1", "https://intranet.searchtest.net/archive"); err != nil {
+		t.Fatalf("Failed to update URL: %v", err)
+	}
+	for _, tc := range []struct {
+		opts storage.SearchOptions
+		want string
+	}{
+		{storage.SearchOptions{Query: "onboarding"}, ""},
+		{storage.SearchOptions{Query: "staff"}, "handbook"},
+		{storage.SearchOptions{Tags: []string{"docs"}}, "handbook-v1"},
+		{storage.SearchOptions{Query: "handbook"}, "handbook"},
+		{storage.SearchOptions{Query: "intranet"}, "handbook-v1"},
+	} {
+		if got := search(tc.opts); got != tc.want {
+			t.Errorf("After changes, Search(%+v) = %q, want %q", tc.opts, got, tc.want)
+		}
+	}
+
+	if err := store.Delete(ctx, "handbook-v1"); err != nil {
+		t.Fatalf("Failed to delete URL: %v", err)
+	}
+	if got := search(storage.SearchOptions{Tags: []string{"docs"}}); got != "" {
+		t.Errorf("Expected deleted links to be gone from the index, got %q", got)
+	}
+	if _, err := store.SetDetails(ctx, "no-such-link", storage.Details{}); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func testHealth(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	for _, id := range []string{"health-ok", "health-gone", "health-new"} {
+		if _, err := store.CreateWithID(ctx, id, "https://health.example.org/"+id); err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+	}
+
+	checkedAt := time.Now().Add(-time.Minute)
+	lastOKAt := checkedAt.Add(-24 * time.Hour)
+	if err := store.SetHealth(ctx, "health-ok", storage.Health{StatusCode: 200, LatencyMS: 42, CheckedAt: checkedAt, LastOKAt: &checkedAt}); err != nil {
+		t.Fatalf("Failed to set health: %v", err)
+	}
+	if err := store.SetHealth(ctx, "health-gone", storage.Health{StatusCode: 404, LatencyMS: 7, CheckedAt: checkedAt, LastOKAt: &lastOKAt}); err != nil {
+		t.Fatalf("Failed to set health: %v", err)
+	}
+
+	looked, err := store.Lookup(ctx, "health-gone")
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if h := looked.Health; h == nil || h.StatusCode != 404 || h.LatencyMS != 7 || !h.CheckedAt.Equal(checkedAt) || h.LastOKAt == nil || !h.LastOKAt.Equal(lastOKAt) {
+		t.Errorf("Unexpected health %+v", looked.Health)
+	}
+
+	listed := func(health string) string {
+		t.Helper()
+		page, err := store.List(ctx, storage.ListOptions{Host: "health.example.org", Health: health})
+		if err != nil {
+			t.Fatalf("Failed to list URLs: %v", err)
+		}
+		var ids []string
+		for _, url := range page.URLs {
+			ids = append(ids, url.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+	for health, want := range map[string]string{
+		storage.HealthBroken:    "health-gone",
+		storage.HealthHealthy:   "health-ok",
+		storage.HealthUnchecked: "health-new",
+	} {
+		if got := listed(health); got != want {
+			t.Errorf("List(health=%s) = %q, want %q", health, got, want)
+		}
+	}
+
+	// A new destination has not been checked yet
+	updated, err := store.Update(ctx, "health-gone", "https://health.example.org/moved")
+	if err != nil {
+		t.Fatalf("Failed to update URL: %v", err)
+	}
+	if updated.Health != nil {
+		t.Errorf("Expected the health to be cleared, got %+v", updated.Health)
+	}
+	if got := listed(storage.HealthBroken); got != "" {
+		t.Errorf("Expected no broken links after the update, got %q", got)
+	}
+
+	if err := store.SetHealth(ctx, "no-such-link", storage.Health{CheckedAt: checkedAt}); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
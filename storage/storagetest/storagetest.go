@@ -0,0 +1,728 @@
+// Package storagetest provides a conformance suite that every storage.Store
+// implementation should pass. A backend's tests call RunConformance with a
+// factory for empty stores:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.RunConformance(t, func(t *testing.T) storage.Store {
+//			store, err := NewMyStore(t.TempDir())
+//			if err != nil {
+//				t.Fatalf("Failed to create store: %v", err)
+//			}
+//			return store
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+)
+
+// Concurrency used by the concurrent subtests
+const (
+	workers           = 8
+	requestsPerWorker = 25
+)
+
+// Factory returns a new, empty store. Each subtest gets its own store and
+// closes it; the factory may also register cleanup with t.
+type Factory func(t *testing.T) storage.Store
+
+// RunConformance runs the Store conformance suite against stores from factory
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store storage.Store)
+	}{
+		{"Create", testCreate},
+		{"CreateWithID", testCreateWithID},
+		{"Get", testGet},
+		{"Update", testUpdate},
+		{"NotFound", testNotFound},
+		{"Invalid", testInvalid},
+		{"Expiry", testExpiry},
+		{"MaxHits", testMaxHits},
+		{"List", testList},
+		{"Iterate", testIterate},
+		{"Domains", testDomains},
+		{"DetailsAndSearch", testDetailsAndSearch},
+		{"UpdateDetails", testUpdateDetails},
+		{"Health", testHealth},
+		{"ReturnsCopies", testReturnsCopies},
+		{"Dedup", testDedup},
+		{"RecordHit", testRecordHit},
+		{"CancelledContext", testCancelledContext},
+		{"ConcurrentHits", testConcurrentHits},
+		{"ConcurrentCreates", testConcurrentCreates},
+		{"StatsConsistency", testStatsConsistency},
+		{"Close", testClose},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := factory(t)
+			// Close is idempotent, so this is safe after testClose too
+			defer store.Close()
+			test.run(t, store)
+		})
+	}
+}
+
+func testCreate(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	url, err := store.Create(ctx, "https://example.com/create")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if url.ID == "" {
+		t.Error("Expected ID to be set")
+	}
+	if url.Original != "https://example.com/create" {
+		t.Errorf("Expected original URL to be %q, got %q", "https://example.com/create", url.Original)
+	}
+	if url.Hits != 0 {
+		t.Errorf("Expected hits to be 0, got %d", url.Hits)
+	}
+	if time.Since(url.CreatedAt) > time.Minute {
+		t.Errorf("Expected CreatedAt to be recent, got %v", url.CreatedAt)
+	}
+
+	// The stored record matches what Create returned
+	stored, err := store.Lookup(ctx, url.ID)
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if stored.Original != url.Original || stored.Hits != 0 || !stored.CreatedAt.Equal(url.CreatedAt) {
+		t.Errorf("Expected %+v, got %+v", url, stored)
+	}
+
+	// Creating the same URL again makes a second link
+	again, err := store.Create(ctx, "https://example.com/create")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if again.ID == url.ID {
+		t.Errorf("Expected a new ID, got %q twice", url.ID)
+	}
+}
+
+func testCreateWithID(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	url, err := store.CreateWithID(ctx, "custom", "https://example.com/custom")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if url.ID != "custom" {
+		t.Errorf("Expected ID %q, got %q", "custom", url.ID)
+	}
+	if _, err := store.CreateWithID(ctx, "custom", "https://example.com/other"); err != storage.ErrConflict {
+		t.Errorf("Expected ErrConflict for a taken ID, got %v", err)
+	}
+
+	// The conflicting create left the first record alone
+	stored, err := store.Lookup(ctx, "custom")
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if stored.Original != "https://example.com/custom" {
+		t.Errorf("Expected the original destination to be kept, got %q", stored.Original)
+	}
+}
+
+func testGet(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	created, err := store.Create(ctx, "https://example.com/get")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	for want := 1; want <= 3; want++ {
+		url, err := store.Get(ctx, created.ID)
+		if err != nil {
+			t.Fatalf("Failed to get URL: %v", err)
+		}
+		if url.Original != created.Original || url.Hits != want {
+			t.Errorf("Get %d: expected %q with %d hits, got %q with %d", want, created.Original, want, url.Original, url.Hits)
+		}
+	}
+
+	// Lookup reads without counting
+	url, err := store.Lookup(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if url.Hits != 3 {
+		t.Errorf("Expected 3 hits after Lookup, got %d", url.Hits)
+	}
+}
+
+func testUpdate(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	created, err := store.Create(ctx, "https://example.com/update")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if _, err := store.Get(ctx, created.ID); err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+
+	// Update changes the destination but keeps the rest of the record
+	updated, err := store.Update(ctx, created.ID, "https://example.com/update-moved")
+	if err != nil {
+		t.Fatalf("Failed to update URL: %v", err)
+	}
+	if updated.Original != "https://example.com/update-moved" {
+		t.Errorf("Expected original URL to be %q, got %q", "https://example.com/update-moved", updated.Original)
+	}
+	if updated.ID != created.ID || !updated.CreatedAt.Equal(created.CreatedAt) || updated.Hits != 1 {
+		t.Errorf("Expected update to keep ID, CreatedAt and hits, got %+v", updated)
+	}
+	stored, err := store.Lookup(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if stored.Original != updated.Original {
+		t.Errorf("Expected the new destination to be stored, got %q", stored.Original)
+	}
+}
+
+func testNotFound(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "missing"); err != storage.ErrNotFound {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Lookup(ctx, "missing"); err != storage.ErrNotFound {
+		t.Errorf("Lookup: expected ErrNotFound, got %v", err)
+	}
+	if _, err := store.Update(ctx, "missing", "https://example.com/x"); err != storage.ErrNotFound {
+		t.Errorf("Update: expected ErrNotFound, got %v", err)
+	}
+	if err := store.Delete(ctx, "missing"); err != storage.ErrNotFound {
+		t.Errorf("Delete: expected ErrNotFound, got %v", err)
+	}
+
+	// A deleted link is gone for good
+	url, err := store.Create(ctx, "https://example.com/deleted")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if err := store.Delete(ctx, url.ID); err != nil {
+		t.Fatalf("Failed to delete URL: %v", err)
+	}
+	if _, err := store.Get(ctx, url.ID); err != storage.ErrNotFound {
+		t.Errorf("Get after Delete: expected ErrNotFound, got %v", err)
+	}
+	if err := store.Delete(ctx, url.ID); err != storage.ErrNotFound {
+		t.Errorf("Repeated Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func testInvalid(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	for _, original := range []string{"", "not-a-url", "/relative/path", "https://"} {
+		if _, err := store.Create(ctx, original); err != storage.ErrInvalid {
+			t.Errorf("Create(%q): expected ErrInvalid, got %v", original, err)
+		}
+		if _, err := store.CreateWithID(ctx, "invalid", original); err != storage.ErrInvalid {
+			t.Errorf("CreateWithID(%q): expected ErrInvalid, got %v", original, err)
+		}
+	}
+
+	url, err := store.Create(ctx, "https://example.com/valid")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if _, err := store.Update(ctx, url.ID, "not-a-url"); err != storage.ErrInvalid {
+		t.Errorf("Update: expected ErrInvalid, got %v", err)
+	}
+
+	// Rejected writes leave nothing behind
+	if count, err := store.GetTotalCount(ctx); err != nil || count != 1 {
+		t.Errorf("Expected 1 URL, got %d (%v)", count, err)
+	}
+}
+
+func testExpiry(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	// Create an already expired storage.URL and one that expires later
+	expired, err := store.Create(ctx, "https://example.com/test-expired", storage.WithExpiry(time.Now().Add(-time.Hour)))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	live, err := store.Create(ctx, "https://example.com/test-live", storage.WithExpiry(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	// Expired URLs must not redirect
+	_, err = store.Get(ctx, expired.ID)
+	if err != storage.ErrExpired {
+		t.Errorf("Expected ErrExpired for expired URL, got %v", err)
+	}
+	got, err := store.Get(ctx, live.ID)
+	if err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+	if got.ExpiresAt == nil || !got.ExpiresAt.Equal(*live.ExpiresAt) {
+		t.Errorf("Expected ExpiresAt to be %v, got %v", live.ExpiresAt, got.ExpiresAt)
+	}
+
+	// Purging removes only the expired storage.URL
+	removed, err := store.DeleteExpired(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to delete expired URLs: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 URL removed, got %d", removed)
+	}
+	_, err = store.Get(ctx, expired.ID)
+	if err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for purged URL, got %v", err)
+	}
+	if _, err := store.Get(ctx, live.ID); err != nil {
+		t.Errorf("Expected live URL to survive purge, got %v", err)
+	}
+}
+
+func testMaxHits(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	// Create a two-visit storage.URL
+	url, err := store.Create(ctx, "https://example.com/test-max-hits", storage.WithMaxHits(2))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	// Hammer it concurrently; exactly two visits may succeed
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	succeeded, exhausted := 0, 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Get(ctx, url.ID)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch err {
+			case nil:
+				succeeded++
+			case storage.ErrExhausted:
+				exhausted++
+			default:
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 2 {
+		t.Errorf("Expected 2 successful visits, got %d", succeeded)
+	}
+	if exhausted != 8 {
+		t.Errorf("Expected 8 exhausted visits, got %d", exhausted)
+	}
+}
+
+func testUpdateDetails(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	str := func(s string) *string { return &s }
+	if _, err := store.CreateWithID(ctx, "patched", "https://example.com/test-patched",
+		storage.WithDetails(storage.Details{Title: "Old title", Description: "Kept", Tags: []string{"a"}})); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if err := store.SetHealth(ctx, "patched", storage.Health{StatusCode: 200, CheckedAt: time.Now()}); err != nil {
+		t.Fatalf("Failed to set health: %v", err)
+	}
+
+	// Without a destination only the given details change
+	tags := []string{"B"}
+	updated, err := store.Update(ctx, "patched", "", storage.ChangeDetails(storage.DetailsChange{Title: str("New title"), Tags: &tags}))
+	if err != nil {
+		t.Fatalf("Failed to update URL: %v", err)
+	}
+	if updated.Original != "https://example.com/test-patched" || updated.Title != "New title" || updated.Description != "Kept" ||
+		strings.Join(updated.Tags, ",") != "b" || updated.Health == nil {
+		t.Errorf("Unexpected record after changing details: %+v", updated)
+	}
+
+	// The destination and details change together
+	updated, err = store.Update(ctx, "patched", "https://example.com/test-patched-moved", storage.ChangeDetails(storage.DetailsChange{Description: str("")}))
+	if err != nil {
+		t.Fatalf("Failed to update URL: %v", err)
+	}
+	if updated.Original != "https://example.com/test-patched-moved" || updated.Title != "New title" || updated.Description != "" || updated.Health != nil {
+		t.Errorf("Unexpected record after changing destination and details: %+v", updated)
+	}
+
+	// An invalid destination changes nothing
+	if _, err := store.Update(ctx, "patched", "not-a-url", storage.ChangeDetails(storage.DetailsChange{Title: str("Lost")})); err != storage.ErrInvalid {
+		t.Errorf("Expected ErrInvalid, got %v", err)
+	}
+	if looked, _ := store.Lookup(ctx, "patched"); looked.Title != "New title" {
+		t.Errorf("Expected the details to be left alone, got %+v", looked.Details)
+	}
+	if _, err := store.Update(ctx, "no-such-link", "", storage.ChangeDetails(storage.DetailsChange{Title: str("Lost")})); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Filled details only replace empty title and description, and only
+	// while the destination is the one they came from
+	page := storage.Details{Title: "Page title", Description: "Page description", FaviconURL: "https://example.com/favicon.ico", ImageURL: "https://example.com/og.png"}
+	if _, err := store.Update(ctx, "patched", "", storage.IfDestination("https://example.com/test-patched"), storage.FillDetails(page)); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an old destination, got %v", err)
+	}
+	updated, err = store.Update(ctx, "patched", "", storage.IfDestination("https://example.com/test-patched-moved"), storage.FillDetails(page))
+	if err != nil {
+		t.Fatalf("Failed to fill details: %v", err)
+	}
+	if updated.Title != "New title" || updated.Description != "Page description" || updated.FaviconURL != page.FaviconURL ||
+		updated.ImageURL != page.ImageURL || strings.Join(updated.Tags, ",") != "b" {
+		t.Errorf("Unexpected record after filling details: %+v", updated.Details)
+	}
+}
+
+func testReturnsCopies(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	created, err := store.CreateWithID(ctx, "copies", "https://copies.example.org/before")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	got, err := store.Get(ctx, "copies")
+	if err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+	stats, err := store.GetStats(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+
+	// Records handed out must not change along with the store
+	if _, err := store.Update(ctx, "copies", "https://copies.example.org/after"); err != nil {
+		t.Fatalf("Failed to update URL: %v", err)
+	}
+	if _, err := store.SetDetails(ctx, "copies", storage.Details{Title: "After"}); err != nil {
+		t.Fatalf("Failed to set details: %v", err)
+	}
+	for _, url := range stats {
+		if url.ID == "copies" {
+			got = url
+		}
+	}
+	for _, url := range []*storage.URL{created, got} {
+		if url.Original != "https://copies.example.org/before" || url.Title != "" {
+			t.Errorf("Expected a copy of the record, got %+v", url)
+		}
+	}
+}
+
+func testDedup(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	first, err := store.Create(ctx, "https://Example.com:443?q=1", storage.WithDedup())
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	// The same destination in another spelling reuses the link
+	again, err := store.Create(ctx, "https://example.com/?q=1", storage.WithDedup())
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("Expected duplicate to reuse %q, got %q", first.ID, again.ID)
+	}
+
+	// Without dedup, or with different options, a new link is created
+	plain, err := store.Create(ctx, "https://example.com/?q=1")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	limited, err := store.Create(ctx, "https://example.com/?q=1", storage.WithDedup(), storage.WithMaxHits(5))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if plain.ID == first.ID || limited.ID == first.ID {
+		t.Error("Expected new links without dedup or with a hit limit")
+	}
+
+	// Links with a TTL are reused for the same TTL, not a different one
+	expiring, err := store.Create(ctx, "https://example.com/test-ttl", storage.WithDedup(), storage.WithTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	sameTTL, err := store.Create(ctx, "https://example.com/test-ttl", storage.WithDedup(), storage.WithTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	otherTTL, err := store.Create(ctx, "https://example.com/test-ttl", storage.WithDedup(), storage.WithTTL(2*time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if sameTTL.ID != expiring.ID {
+		t.Errorf("Expected the same TTL to reuse %q, got %q", expiring.ID, sameTTL.ID)
+	}
+	if otherTTL.ID == expiring.ID {
+		t.Error("Expected a new link for a different TTL")
+	}
+
+	// Moving the link away means it no longer matches its old destination
+	if _, err := store.Update(ctx, first.ID, "https://example.com/moved"); err != nil {
+		t.Fatalf("Failed to update URL: %v", err)
+	}
+	moved, err := store.Create(ctx, "https://example.com/moved", storage.WithDedup())
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if moved.ID != first.ID {
+		t.Errorf("Expected dedup to follow the update to %q, got %q", first.ID, moved.ID)
+	}
+
+	// Deleted links are never reused
+	if err := store.Delete(ctx, first.ID); err != nil {
+		t.Fatalf("Failed to delete URL: %v", err)
+	}
+	fresh, err := store.Create(ctx, "https://example.com/moved", storage.WithDedup())
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if fresh.ID == first.ID {
+		t.Error("Expected a new link after the original was deleted")
+	}
+}
+
+func testRecordHit(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	recorder, ok := store.(storage.HitRecorder)
+	if !ok {
+		t.Skip("Store does not implement HitRecorder")
+	}
+
+	// Create a storage.URL
+	url, err := store.Create(ctx, "https://example.com/record-hit")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	// Record hits, including one for an unknown ID
+	for i := 0; i < 2; i++ {
+		if err := recorder.RecordHit(ctx, url.ID); err != nil {
+			t.Fatalf("Failed to record hit: %v", err)
+		}
+	}
+	if err := recorder.RecordHit(ctx, "no-such-id"); err != nil {
+		t.Errorf("Expected unknown IDs to be ignored, got %v", err)
+	}
+
+	looked, err := store.Lookup(ctx, url.ID)
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if looked.Hits != 2 {
+		t.Errorf("Expected 2 hits, got %d", looked.Hits)
+	}
+	if _, err := store.Lookup(ctx, "no-such-id"); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for unknown ID, got %v", err)
+	}
+}
+
+func testConcurrentHits(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	url, err := store.Create(ctx, "https://example.com/concurrent")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*requestsPerWorker)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < requestsPerWorker; j++ {
+				if _, err := store.Get(ctx, url.ID); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Failed to get URL concurrently: %v", err)
+	}
+
+	// No hit may be lost or counted twice
+	const want = workers * requestsPerWorker
+	stored, err := store.Lookup(ctx, url.ID)
+	if err != nil {
+		t.Fatalf("Failed to look up URL: %v", err)
+	}
+	if stored.Hits != want {
+		t.Errorf("Expected %d hits, got %d", want, stored.Hits)
+	}
+	if total, err := store.GetTotalHits(ctx); err != nil || total != want {
+		t.Errorf("Expected %d total hits, got %d (%v)", want, total, err)
+	}
+}
+
+func testConcurrentCreates(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	var mutex sync.Mutex
+	ids := make(map[string]bool)
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*requestsPerWorker)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < requestsPerWorker; j++ {
+				url, err := store.Create(ctx, fmt.Sprintf("https://example.com/%d/%d", worker, j))
+				if err != nil {
+					errs <- err
+					continue
+				}
+				mutex.Lock()
+				if ids[url.ID] {
+					errs <- fmt.Errorf("ID %q handed out twice", url.ID)
+				}
+				ids[url.ID] = true
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Failed to create URLs concurrently: %v", err)
+	}
+
+	if count, err := store.GetTotalCount(ctx); err != nil || count != workers*requestsPerWorker {
+		t.Errorf("Expected %d URLs, got %d (%v)", workers*requestsPerWorker, count, err)
+	}
+}
+
+func testStatsConsistency(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	// Links with 0 to 4 hits, one of them deleted afterwards
+	var deleted string
+	for i := 0; i < 5; i++ {
+		url, err := store.Create(ctx, fmt.Sprintf("https://example.com/stats/%d", i))
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		for j := 0; j < i; j++ {
+			if _, err := store.Get(ctx, url.ID); err != nil {
+				t.Fatalf("Failed to get URL: %v", err)
+			}
+		}
+		if i == 2 {
+			deleted = url.ID
+		}
+	}
+	if err := store.Delete(ctx, deleted); err != nil {
+		t.Fatalf("Failed to delete URL: %v", err)
+	}
+
+	// Every view of the store agrees
+	stats, err := store.GetStats(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	count, err := store.GetTotalCount(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get total count: %v", err)
+	}
+	total, err := store.GetTotalHits(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get total hits: %v", err)
+	}
+	iterated := 0
+	if err := store.Iterate(ctx, func(*storage.URL) error {
+		iterated++
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to iterate URLs: %v", err)
+	}
+
+	sum := 0
+	for _, url := range stats {
+		sum += url.Hits
+		if url.ID == deleted {
+			t.Errorf("Expected deleted URL %q to be left out of stats", deleted)
+		}
+	}
+	if len(stats) != 4 || count != 4 || iterated != 4 {
+		t.Errorf("Expected 4 URLs everywhere, got %d in stats, %d counted and %d iterated", len(stats), count, iterated)
+	}
+	if sum != 8 || total != 8 {
+		t.Errorf("Expected 8 hits after the delete, got %d in stats and %d in total", sum, total)
+	}
+}
+
+func testClose(t *testing.T, store storage.Store) {
+	ctx := context.Background()
+
+	url, err := store.Create(ctx, "https://example.com/close")
+	if err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	if _, err := store.Get(ctx, url.ID); err != nil {
+		t.Fatalf("Failed to get URL: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+
+	// Closing again and using a closed store may fail, but must not panic
+	// or hang
+	done := make(chan any, 1)
+	go func() {
+		defer func() { done <- recover() }()
+		store.Close()
+		store.Lookup(ctx, url.ID)
+		store.Create(ctx, "https://example.com/after-close")
+	}()
+	select {
+	case recovered := <-done:
+		if recovered != nil {
+			t.Errorf("Using a closed store panicked: %v", recovered)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Using a closed store hung")
+	}
+}
+
+func testCancelledContext(t *testing.T, store storage.Store) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := store.Create(ctx, "https://example.com/cancelled"); err != context.Canceled {
+		t.Errorf("Create: expected context.Canceled, got %v", err)
+	}
+	if _, err := store.List(ctx, storage.ListOptions{}); err != context.Canceled {
+		t.Errorf("List: expected context.Canceled, got %v", err)
+	}
+	if err := store.Iterate(ctx, func(*storage.URL) error { return nil }); err != context.Canceled {
+		t.Errorf("Iterate: expected context.Canceled, got %v", err)
+	}
+}
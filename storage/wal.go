@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for a persistent MemoryStore
+const (
+	DefaultSnapshotInterval = 5 * time.Minute
+	DefaultWALSyncInterval  = time.Second
+)
+
+// When the write-ahead log is fsynced
+const (
+	// SyncAlways fsyncs after every change; nothing acknowledged is lost
+	SyncAlways = "always"
+
+	// SyncInterval fsyncs every SyncInterval; a crash of the process loses
+	// nothing, a crash of the machine loses at most one interval
+	SyncInterval = "interval"
+
+	// SyncNever leaves flushing to the operating system
+	SyncNever = "never"
+)
+
+// PersistenceOptions configures a persistent MemoryStore
+type PersistenceOptions struct {
+	// Dir holds the snapshot and the write-ahead log segments
+	Dir string
+
+	// Sync is SyncAlways, SyncInterval (default) or SyncNever
+	Sync string
+
+	// SyncInterval is how often the log is fsynced with SyncInterval
+	SyncInterval time.Duration
+
+	// SnapshotInterval is how often a snapshot is taken and older log
+	// segments are removed
+	SnapshotInterval time.Duration
+}
+
+// Write-ahead log operations
+const (
+	walCreate  = "create"
+	walHit     = "hit"
+	walUpdate  = "update"
+	walDetails = "details"
+	walHealth  = "health"
+	walDelete  = "delete"
+)
+
+// walRecord is one change in the write-ahead log
+type walRecord struct {
+	Op       string   `json:"op"`
+	ID       string   `json:"id"`
+	URL      *URL     `json:"url,omitempty"`
+	Original string   `json:"original,omitempty"`
+	Details  *Details `json:"details,omitempty"`
+	Health   *Health  `json:"health,omitempty"`
+}
+
+// memorySnapshot is the state of a MemoryStore up to, but not including,
+// the log segment Segment
+type memorySnapshot struct {
+	Segment int    `json:"segment"`
+	URLs    []*URL `json:"urls"`
+}
+
+const (
+	snapshotFile  = "snapshot.json"
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+
+	// walHeaderSize is the length and CRC-32 that precede every record
+	walHeaderSize = 8
+
+	// walMaxRecord rejects absurd lengths read from a damaged header
+	walMaxRecord = 1 << 20
+)
+
+// errTornRecord marks a record that was only partly written
+var errTornRecord = errors.New("torn write-ahead log record")
+
+// memoryLog appends changes to numbered log segments. A snapshot records
+// the first segment it does not cover, so replay after a crash at any point
+// neither skips nor repeats a change.
+type memoryLog struct {
+	opts PersistenceOptions
+
+	mutex   sync.Mutex
+	file    *os.File
+	segment int
+	offset  int64 // end of the last complete record in the segment
+	records int
+	dirty   bool
+
+	// failed is set once the log may no longer hold what it acknowledged,
+	// and is returned by every later append
+	failed error
+
+	// snapshotMutex makes sure only one snapshot is written at a time
+	snapshotMutex sync.Mutex
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// segmentPath returns the file name of log segment n
+func (l *memoryLog) segmentPath(n int) string {
+	return filepath.Join(l.opts.Dir, fmt.Sprintf("%s%08d%s", segmentPrefix, n, segmentSuffix))
+}
+
+// segments lists the log segment numbers in dir, in order
+func (l *memoryLog) segments() ([]int, error) {
+	entries, err := os.ReadDir(l.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// open starts appending to a new segment numbered n
+func (l *memoryLog) open(n int) error {
+	file, err := os.OpenFile(l.segmentPath(n), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.segment = n
+	l.offset = info.Size()
+	l.records = 0
+	l.dirty = false
+	return syncDir(l.opts.Dir)
+}
+
+// append writes a record, fsyncing it straight away with SyncAlways
+func (l *memoryLog) append(record walRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[walHeaderSize:], payload)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.failed != nil {
+		return l.failed
+	}
+	if _, err := l.file.Write(frame); err != nil {
+		return l.discard(err)
+	}
+	if l.opts.Sync == SyncAlways {
+		if err := l.file.Sync(); err != nil {
+			// The caller will not apply the record, so it must not replay
+			// either. A failed fsync cannot be retried reliably.
+			l.discard(err)
+			return l.fail(err)
+		}
+	} else {
+		l.dirty = true
+	}
+	l.offset += int64(len(frame))
+	l.records++
+	return nil
+}
+
+// discard cuts what was written of a failed record off the segment, so that
+// later records do not follow a partial frame. If that fails too, the log
+// fails. The caller holds the lock.
+func (l *memoryLog) discard(cause error) error {
+	if err := l.file.Truncate(l.offset); err != nil {
+		return l.fail(cause)
+	}
+	if err := l.file.Sync(); err != nil {
+		return l.fail(cause)
+	}
+	return cause
+}
+
+// fail refuses further appends; the caller holds the lock
+func (l *memoryLog) fail(cause error) error {
+	if l.failed == nil {
+		l.failed = fmt.Errorf("write-ahead log failed, restart to recover: %w", cause)
+	}
+	return l.failed
+}
+
+// sync fsyncs records written since the last sync
+func (l *memoryLog) sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.dirty || l.failed != nil {
+		return l.failed
+	}
+	l.dirty = false
+	if err := l.file.Sync(); err != nil {
+		// Records already acknowledged may be lost, and a retried fsync
+		// can report success without writing them
+		return l.fail(err)
+	}
+	return nil
+}
+
+// rotate closes the current segment and starts the next one, returning its
+// number. The caller must stop further appends while it runs.
+func (l *memoryLog) rotate() (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.failed != nil {
+		return 0, l.failed
+	}
+	if err := l.file.Sync(); err != nil {
+		return 0, l.fail(err)
+	}
+	if err := l.file.Close(); err != nil {
+		return 0, err
+	}
+	if err := l.open(l.segment + 1); err != nil {
+		return 0, err
+	}
+	return l.segment, nil
+}
+
+// pending reports whether changes were logged since the segment was started
+func (l *memoryLog) pending() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.records > 0
+}
+
+// close syncs and closes the current segment
+func (l *memoryLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// readSegment applies every record in a segment. It returns the offset after
+// the last complete record and errTornRecord if what follows it can only be
+// a write cut short by a crash: a frame that runs to the end of the file, or
+// a zero-filled tail. A bad frame with more data after it is damage, since
+// truncating there would drop records that were acknowledged.
+func readSegment(path string, apply func(walRecord)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return offset, errTornRecord
+			}
+			return offset, err
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		if length > walMaxRecord {
+			return offset, badFrame(file, offset, false)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(file, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, errTornRecord
+			}
+			return offset, err
+		}
+		end := offset + int64(walHeaderSize+len(payload))
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return offset, badFrame(file, offset, end == info.Size())
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return offset, badFrame(file, offset, end == info.Size())
+		}
+		apply(record)
+		offset = end
+	}
+}
+
+// badFrame decides whether the frame at offset that failed to decode was
+// torn. last reports whether it ends at the end of the file; otherwise it is
+// torn only if nothing but zeros is left to read.
+func badFrame(file *os.File, offset int64, last bool) error {
+	if last {
+		return errTornRecord
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := file.Read(buf)
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return fmt.Errorf("damaged record at offset %d", offset)
+			}
+		}
+		if err == io.EOF {
+			return errTornRecord
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readSnapshot loads the snapshot in dir, or an empty one if there is none
+func readSnapshot(dir string) (*memorySnapshot, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return &memorySnapshot{Segment: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", snapshotFile, err)
+	}
+	return &snapshot, nil
+}
+
+// writeSnapshot replaces the snapshot in dir atomically
+func writeSnapshot(dir string, snapshot *memorySnapshot) error {
+	temp, err := os.CreateTemp(dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := json.NewEncoder(temp).Encode(snapshot); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that created and renamed files survive a crash
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
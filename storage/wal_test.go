@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStorePersistence(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("restores state after a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := OpenMemoryStore(PersistenceOptions{Dir: dir, Sync: SyncAlways})
+		if err != nil {
+			t.Fatalf("Failed to open memory store: %v", err)
+		}
+
+		expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		kept, err := store.CreateWithID(ctx, "kept", "https://example.com/kept", WithExpiry(expiresAt), WithMaxHits(10))
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		removed, err := store.Create(ctx, "https://example.com/removed")
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := store.Get(ctx, kept.ID); err != nil {
+				t.Fatalf("Failed to get URL: %v", err)
+			}
+		}
+		if _, err := store.Update(ctx, kept.ID, "https://example.com/moved"); err != nil {
+			t.Fatalf("Failed to update URL: %v", err)
+		}
+		if err := store.Delete(ctx, removed.ID); err != nil {
+			t.Fatalf("Failed to delete URL: %v", err)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatalf("Failed to close store: %v", err)
+		}
+
+		reopened, err := OpenMemoryStore(PersistenceOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("Failed to reopen memory store: %v", err)
+		}
+		defer reopened.Close()
+
+		url, err := reopened.Lookup(ctx, kept.ID)
+		if err != nil {
+			t.Fatalf("Failed to look up URL: %v", err)
+		}
+		if url.Original != "https://example.com/moved" || url.Hits != 3 || url.MaxHits != 10 {
+			t.Errorf("Unexpected restored URL: %+v", url)
+		}
+		if url.ExpiresAt == nil || !url.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected expiry %v, got %v", expiresAt, url.ExpiresAt)
+		}
+		if _, err := reopened.Lookup(ctx, removed.ID); err != ErrNotFound {
+			t.Errorf("Expected deleted URL to stay deleted, got %v", err)
+		}
+
+		// The duplicate index is rebuilt too
+		again, err := reopened.Create(ctx, "https://example.com/moved", WithDedup(), WithExpiry(expiresAt), WithMaxHits(10))
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		if again.ID != kept.ID {
+			t.Errorf("Expected the restored link to be reused, got %s", again.ID)
+		}
+	})
+
+	t.Run("replays the log after a crash", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := OpenMemoryStore(PersistenceOptions{Dir: dir, Sync: SyncNever})
+		if err != nil {
+			t.Fatalf("Failed to open memory store: %v", err)
+		}
+		url, err := store.Create(ctx, "https://example.com/crash")
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		if err := store.RecordHit(ctx, url.ID); err != nil {
+			t.Fatalf("Failed to record hit: %v", err)
+		}
+		if _, err := store.SetDetails(ctx, url.ID, Details{Title: "Crash report", Tags: []string{"incidents"}}); err != nil {
+			t.Fatalf("Failed to set details: %v", err)
+		}
+		description := "What happened"
+		if _, err := store.Update(ctx, url.ID, "", ChangeDetails(DetailsChange{Description: &description})); err != nil {
+			t.Fatalf("Failed to update URL: %v", err)
+		}
+
+		// Simulate a crash halfway through writing the next record
+		segment := store.wal.segmentPath(store.wal.segment)
+		file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("Failed to open log segment: %v", err)
+		}
+		file.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, '{', '"', 'o'})
+		file.Close()
+		before, _ := os.Stat(segment)
+
+		// Open a second store over the same directory without closing the first
+		recovered, err := OpenMemoryStore(PersistenceOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("Failed to recover memory store: %v", err)
+		}
+		defer recovered.Close()
+
+		looked, err := recovered.Lookup(ctx, url.ID)
+		if err != nil {
+			t.Fatalf("Failed to look up URL: %v", err)
+		}
+		if looked.Hits != 1 {
+			t.Errorf("Expected 1 hit after recovery, got %d", looked.Hits)
+		}
+		if looked.Title != "Crash report" || looked.Description != "What happened" {
+			t.Errorf("Expected the replayed details, got %+v", looked.Details)
+		}
+		if found, _ := recovered.Search(ctx, SearchOptions{Query: "crash report", Tags: []string{"incidents"}}); len(found) != 1 {
+			t.Errorf("Expected the replayed details to be searchable, got %+v", found)
+		}
+		after, _ := os.Stat(segment)
+		if after.Size() != before.Size()-11 {
+			t.Errorf("Expected the torn record to be truncated, size %d -> %d", before.Size(), after.Size())
+		}
+	})
+
+	t.Run("only truncates damage at the end of the log", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := OpenMemoryStore(PersistenceOptions{Dir: dir, Sync: SyncAlways})
+		if err != nil {
+			t.Fatalf("Failed to open memory store: %v", err)
+		}
+		defer store.Close()
+		for _, id := range []string{"first", "second"} {
+			if _, err := store.CreateWithID(ctx, id, "https://example.com/"+id); err != nil {
+				t.Fatalf("Failed to create URL: %v", err)
+			}
+		}
+		segment := store.wal.segmentPath(store.wal.segment)
+
+		// Stores are opened over the same directory without closing, since
+		// closing compacts the log away. A zero-filled tail is what a crash
+		// leaves after the file grew.
+		file, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatalf("Failed to open log segment: %v", err)
+		}
+		file.Write(make([]byte, 100))
+		file.Close()
+		recovered, err := OpenMemoryStore(PersistenceOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("Failed to recover from a zero-filled tail: %v", err)
+		}
+		defer recovered.Close()
+		if _, err := recovered.Lookup(ctx, "second"); err != nil {
+			t.Errorf("Expected the last record to survive, got %v", err)
+		}
+
+		// A damaged record followed by others is not a torn write
+		data, err := os.ReadFile(segment)
+		if err != nil {
+			t.Fatalf("Failed to read log segment: %v", err)
+		}
+		data[walHeaderSize+2] ^= 0xff
+		if err := os.WriteFile(segment, data, 0o644); err != nil {
+			t.Fatalf("Failed to write log segment: %v", err)
+		}
+		if _, err := OpenMemoryStore(PersistenceOptions{Dir: dir}); err == nil || !strings.Contains(err.Error(), "damaged record") {
+			t.Fatalf("Expected a damaged log to fail to open, got %v", err)
+		}
+		if after, _ := os.Stat(segment); after.Size() != int64(len(data)) {
+			t.Errorf("Expected the damaged log to be left alone, size %d -> %d", len(data), after.Size())
+		}
+	})
+
+	t.Run("failed appends leave no partial record", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := OpenMemoryStore(PersistenceOptions{Dir: dir, Sync: SyncAlways})
+		if err != nil {
+			t.Fatalf("Failed to open memory store: %v", err)
+		}
+		defer store.Close()
+		if _, err := store.CreateWithID(ctx, "before", "https://example.com/before"); err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		segment := store.wal.segmentPath(store.wal.segment)
+		good, _ := os.Stat(segment)
+
+		// Part of a frame made it to disk before the write failed
+		store.wal.mutex.Lock()
+		store.wal.file.Write([]byte{0, 0, 0, 40, 1, 2})
+		err = store.wal.discard(errors.New("disk full"))
+		store.wal.mutex.Unlock()
+		if err == nil || store.wal.failed != nil {
+			t.Fatalf("Expected the write error to be returned without failing the log, got %v", err)
+		}
+		if after, _ := os.Stat(segment); after.Size() != good.Size() {
+			t.Errorf("Expected the partial frame to be cut off, size %d -> %d", good.Size(), after.Size())
+		}
+		if _, err := store.CreateWithID(ctx, "after", "https://example.com/after"); err != nil {
+			t.Fatalf("Failed to create URL after a discarded write: %v", err)
+		}
+
+		// When the segment cannot be cut back either, the log stops
+		// acknowledging changes
+		readOnly, err := os.Open(segment)
+		if err != nil {
+			t.Fatalf("Failed to open log segment: %v", err)
+		}
+		store.wal.mutex.Lock()
+		writable := store.wal.file
+		store.wal.file = readOnly
+		store.wal.mutex.Unlock()
+		defer writable.Close()
+		if _, err := store.CreateWithID(ctx, "lost", "https://example.com/lost"); err == nil {
+			t.Fatal("Expected the create to fail")
+		}
+		if _, err := store.Lookup(ctx, "lost"); err != ErrNotFound {
+			t.Errorf("Expected a failed create not to be applied, got %v", err)
+		}
+		store.wal.mutex.Lock()
+		store.wal.file = writable
+		store.wal.mutex.Unlock()
+		readOnly.Close()
+		if _, err := store.CreateWithID(ctx, "later", "https://example.com/later"); err == nil {
+			t.Error("Expected a failed log to refuse further changes")
+		}
+
+		recovered, err := OpenMemoryStore(PersistenceOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("Failed to recover memory store: %v", err)
+		}
+		defer recovered.Close()
+		for id, want := range map[string]error{"before": nil, "after": nil, "lost": ErrNotFound, "later": ErrNotFound} {
+			if _, err := recovered.Lookup(ctx, id); err != want {
+				t.Errorf("Lookup(%s) after recovery = %v, want %v", id, err, want)
+			}
+		}
+	})
+
+	t.Run("snapshots compact the log", func(t *testing.T) {
+		dir := t.TempDir()
+		store, err := OpenMemoryStore(PersistenceOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("Failed to open memory store: %v", err)
+		}
+		url, err := store.Create(ctx, "https://example.com/snapshot")
+		if err != nil {
+			t.Fatalf("Failed to create URL: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			store.RecordHit(ctx, url.ID)
+		}
+		if err := store.Snapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		store.RecordHit(ctx, url.ID)
+
+		segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+		if len(segments) != 1 {
+			t.Errorf("Expected only the current log segment to remain, got %v", segments)
+		}
+		if _, err := os.Stat(filepath.Join(dir, snapshotFile)); err != nil {
+			t.Errorf("Expected a snapshot file: %v", err)
+		}
+
+		// Crash without the final snapshot: the snapshot plus the new segment
+		// must not count the first five hits twice
+		store.wal.sync()
+		recovered, err := OpenMemoryStore(PersistenceOptions{Dir: dir})
+		if err != nil {
+			t.Fatalf("Failed to recover memory store: %v", err)
+		}
+		defer recovered.Close()
+
+		looked, err := recovered.Lookup(ctx, url.ID)
+		if err != nil {
+			t.Fatalf("Failed to look up URL: %v", err)
+		}
+		if looked.Hits != 6 {
+			t.Errorf("Expected 6 hits, got %d", looked.Hits)
+		}
+	})
+
+	t.Run("rejects unknown sync modes", func(t *testing.T) {
+		if _, err := OpenMemoryStore(PersistenceOptions{Dir: t.TempDir(), Sync: "sometimes"}); err == nil {
+			t.Error("Expected an error for an unknown sync mode")
+		}
+	})
+}
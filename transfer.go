@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"go-url-shortener/storage"
+)
+
+// Export formats
+const (
+	formatJSONL = "jsonl"
+	formatCSV   = "csv"
+)
+
+// What import does with a record whose ID is already taken
+const (
+	onConflictSkip      = "skip"
+	onConflictOverwrite = "overwrite"
+	onConflictFail      = "fail"
+)
+
+// progressEvery is how many records pass between progress lines
+const progressEvery = 10000
+
+// csvHeader is the first row of a CSV export. Imports also accept the
+// first csvBaseColumns columns alone, as written before links had details.
+var csvHeader = []string{"id", "original", "created_at", "hits", "expires_at", "max_hits", "title", "description", "tags"}
+
+const csvBaseColumns = 6
+
+// storeFlags selects the store the export and import subcommands work on
+type storeFlags struct {
+	dbType    *string
+	dbPath    *string
+	dbDSN     *string
+	memoryDir *string
+}
+
+// addStoreFlags defines the store selection flags, named as for the server
+func addStoreFlags(flags *flag.FlagSet) *storeFlags {
+	return &storeFlags{
+		dbType:    flags.String("db", "sqlite", "Database type (memory, sqlite, bolt, postgres or redis)"),
+		dbPath:    flags.String("db-path", "urls.db", "Path to SQLite or bbolt database file (only for sqlite and bolt)"),
+		dbDSN:     flags.String("db-dsn", "", "PostgreSQL or Redis connection URL (only for postgres and redis)"),
+		memoryDir: flags.String("memory-dir", "", "Directory of a persistent memory store (only for memory)"),
+	}
+}
+
+// open opens the selected store. Hits are written straight away and the
+// memory store syncs every change, since these are short-lived processes.
+func (f *storeFlags) open() (storage.Store, error) {
+	switch *f.dbType {
+	case "memory":
+		if *f.memoryDir == "" {
+			return nil, errors.New("the memory store needs --memory-dir to hold data between runs")
+		}
+		return storage.OpenMemoryStore(storage.PersistenceOptions{Dir: *f.memoryDir, Sync: storage.SyncAlways})
+	case "sqlite":
+		return storage.NewSQLiteStore(*f.dbPath)
+	case "bolt":
+		return storage.NewBoltStore(*f.dbPath)
+	case "postgres":
+		return storage.NewPostgresStore(*f.dbDSN, 1)
+	case "redis":
+		return storage.NewRedisStore(*f.dbDSN)
+	default:
+		return nil, fmt.Errorf("unknown database type %q", *f.dbType)
+	}
+}
+
+// interruptContext is cancelled on SIGINT or SIGTERM, so a long transfer
+// stops cleanly between records
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// runExport implements the export subcommand, streaming every URL to a file
+// or stdout. Progress goes to log so that it never mixes with the records.
+//
+//	export [--db sqlite] [--db-path urls.db] [--format jsonl|csv] [--output file]
+func runExport(args []string, out, log io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(log)
+	store := addStoreFlags(flags)
+	format := flags.String("format", formatJSONL, "Output format (jsonl or csv)")
+	output := flags.String("output", "-", "File to write, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	if *format != formatJSONL && *format != formatCSV {
+		return fmt.Errorf("unknown format %q (want jsonl or csv)", *format)
+	}
+
+	s, err := store.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	var file *os.File
+	if *output != "-" {
+		file, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	var write func(*storage.URL) error
+	var flush func() error
+	buffered := bufio.NewWriter(out)
+	switch *format {
+	case formatJSONL:
+		encoder := json.NewEncoder(buffered)
+		encoder.SetEscapeHTML(false)
+		write = func(url *storage.URL) error { return encoder.Encode(url) }
+		flush = buffered.Flush
+	case formatCSV:
+		writer := csv.NewWriter(buffered)
+		if err := writer.Write(csvHeader); err != nil {
+			return err
+		}
+		write = func(url *storage.URL) error { return writer.Write(csvRecord(url)) }
+		flush = func() error {
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				return err
+			}
+			return buffered.Flush()
+		}
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	count := 0
+	err = s.Iterate(ctx, func(url *storage.URL) error {
+		if err := write(url); err != nil {
+			return err
+		}
+		count++
+		if count%progressEvery == 0 {
+			fmt.Fprintf(log, "Exported %d URLs\n", count)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(log, "Exported %d URLs\n", count)
+	return nil
+}
+
+// runImport implements the import subcommand, reading URLs exported by
+// runExport and creating them with their IDs, creation times and hits.
+//
+//	import [--db sqlite] [--db-path urls.db] [--format jsonl|csv] [--input file] [--on-conflict skip|overwrite|fail]
+func runImport(args []string, in io.Reader, log io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(log)
+	store := addStoreFlags(flags)
+	format := flags.String("format", formatJSONL, "Input format (jsonl or csv)")
+	input := flags.String("input", "-", "File to read, - for stdin")
+	onConflict := flags.String("on-conflict", onConflictFail, "What to do when an ID already exists (skip, overwrite or fail)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	switch *onConflict {
+	case onConflictSkip, onConflictOverwrite, onConflictFail:
+	default:
+		return fmt.Errorf("unknown conflict policy %q (want skip, overwrite or fail)", *onConflict)
+	}
+
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var read func() (*storage.URL, error)
+	switch *format {
+	case formatJSONL:
+		decoder := json.NewDecoder(bufio.NewReader(in))
+		read = func() (*storage.URL, error) {
+			var url storage.URL
+			if err := decoder.Decode(&url); err != nil {
+				return nil, err
+			}
+			return &url, nil
+		}
+	case formatCSV:
+		reader := csv.NewReader(bufio.NewReader(in))
+		reader.FieldsPerRecord = -1
+		reader.ReuseRecord = true
+		header, err := reader.Read()
+		if err == io.EOF {
+			read = func() (*storage.URL, error) { return nil, io.EOF }
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if got := strings.Join(header, ","); got != strings.Join(csvHeader, ",") && got != strings.Join(csvHeader[:csvBaseColumns], ",") {
+			return fmt.Errorf("unexpected CSV header %q (want %q)", got, strings.Join(csvHeader, ","))
+		}
+		reader.FieldsPerRecord = len(header)
+		read = func() (*storage.URL, error) {
+			record, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			return parseCSVRecord(record)
+		}
+	default:
+		return fmt.Errorf("unknown format %q (want jsonl or csv)", *format)
+	}
+
+	s, err := store.open()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	var created, overwritten, skipped int
+	for record := 1; ; record++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		url, err := read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", record, err)
+		}
+		if url.ID == "" {
+			return fmt.Errorf("record %d: missing id", record)
+		}
+
+		opts := []storage.CreateOption{storage.WithHits(url.Hits), storage.WithMaxHits(url.MaxHits), storage.WithDetails(url.Details)}
+		if !url.CreatedAt.IsZero() {
+			opts = append(opts, storage.WithCreatedAt(url.CreatedAt))
+		}
+		if url.ExpiresAt != nil {
+			opts = append(opts, storage.WithExpiry(*url.ExpiresAt))
+		}
+
+		_, err = s.CreateWithID(ctx, url.ID, url.Original, opts...)
+		switch {
+		case err == nil:
+			created++
+		case err != storage.ErrConflict:
+			return fmt.Errorf("record %d: %w", record, err)
+		case *onConflict == onConflictFail:
+			return fmt.Errorf("record %d: id %q already exists", record, url.ID)
+		case *onConflict == onConflictSkip:
+			skipped++
+		default:
+			// Replacing a link also drops its click history
+			if err := s.Delete(ctx, url.ID); err != nil && err != storage.ErrNotFound {
+				return fmt.Errorf("record %d: %w", record, err)
+			}
+			if _, err := s.CreateWithID(ctx, url.ID, url.Original, opts...); err != nil {
+				return fmt.Errorf("record %d: %w", record, err)
+			}
+			overwritten++
+		}
+
+		if done := created + overwritten + skipped; done%progressEvery == 0 {
+			fmt.Fprintf(log, "Imported %d URLs\n", done)
+		}
+	}
+
+	fmt.Fprintf(log, "Imported %d URLs: %d created, %d overwritten, %d skipped\n", created+overwritten+skipped, created, overwritten, skipped)
+	return nil
+}
+
+// csvRecord renders a URL as a CSV row in csvHeader order
+func csvRecord(url *storage.URL) []string {
+	expiresAt := ""
+	if url.ExpiresAt != nil {
+		expiresAt = url.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	return []string{
+		url.ID,
+		url.Original,
+		url.CreatedAt.Format(time.RFC3339Nano),
+		strconv.Itoa(url.Hits),
+		expiresAt,
+		strconv.Itoa(url.MaxHits),
+		url.Title,
+		url.Description,
+		strings.Join(url.Tags, ","),
+	}
+}
+
+// parseCSVRecord reads a row written by csvRecord
+func parseCSVRecord(record []string) (*storage.URL, error) {
+	url := &storage.URL{ID: record[0], Original: record[1]}
+
+	var err error
+	if url.CreatedAt, err = time.Parse(time.RFC3339Nano, record[2]); err != nil {
+		return nil, fmt.Errorf("created_at: %w", err)
+	}
+	if url.Hits, err = strconv.Atoi(record[3]); err != nil {
+		return nil, fmt.Errorf("hits: %w", err)
+	}
+	if record[4] != "" {
+		expiresAt, err := time.Parse(time.RFC3339Nano, record[4])
+		if err != nil {
+			return nil, fmt.Errorf("expires_at: %w", err)
+		}
+		url.ExpiresAt = &expiresAt
+	}
+	if url.MaxHits, err = strconv.Atoi(record[5]); err != nil {
+		return nil, fmt.Errorf("max_hits: %w", err)
+	}
+	if len(record) > csvBaseColumns {
+		url.Title, url.Description = record[6], record[7]
+		url.Tags = storage.NormalizeTags([]string{record[8]})
+	}
+	return url, nil
+}
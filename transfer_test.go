@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-url-shortener/storage"
+)
+
+func TestExportImport(t *testing.T) {
+	if !storage.SQLiteAvailable {
+		t.Skip("SQLite needs a build with cgo")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.db")
+
+	// Seed a SQLite database with hits, an expiring link and details
+	store, err := storage.NewSQLiteStore(source)
+	if err != nil {
+		t.Fatalf("Failed to create SQLite store: %v", err)
+	}
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if _, err := store.CreateWithID(ctx, "alpha", "https://example.com/a?x=1&y=<2>"); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	details := storage.Details{Title: "Beta, \"quoted\"", Description: "Two\nlines", Tags: []string{"docs", "team wiki"}}
+	if _, err := store.CreateWithID(ctx, "beta", "https://example.com/b", storage.WithExpiry(expiresAt), storage.WithMaxHits(10), storage.WithDetails(details)); err != nil {
+		t.Fatalf("Failed to create URL: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.Get(ctx, "beta"); err != nil {
+			t.Fatalf("Failed to get URL: %v", err)
+		}
+	}
+	original, _ := store.Lookup(ctx, "beta")
+	store.Close()
+
+	for _, format := range []string{"jsonl", "csv"} {
+		t.Run(format+" round trip", func(t *testing.T) {
+			var exported, log bytes.Buffer
+			if err := runExport([]string{"--db-path", source, "--format", format}, &exported, &log); err != nil {
+				t.Fatalf("Export failed: %v", err)
+			}
+			if !strings.Contains(log.String(), "Exported 2 URLs") {
+				t.Errorf("Unexpected export summary: %q", log.String())
+			}
+
+			target := filepath.Join(t.TempDir(), "target.db")
+			log.Reset()
+			if err := runImport([]string{"--db", "bolt", "--db-path", target, "--format", format}, &exported, &log); err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			if !strings.Contains(log.String(), "Imported 2 URLs: 2 created") {
+				t.Errorf("Unexpected import summary: %q", log.String())
+			}
+
+			imported, err := storage.NewBoltStore(target)
+			if err != nil {
+				t.Fatalf("Failed to open bbolt store: %v", err)
+			}
+			defer imported.Close()
+
+			url, err := imported.Lookup(ctx, "beta")
+			if err != nil {
+				t.Fatalf("Failed to look up imported URL: %v", err)
+			}
+			if url.Hits != 3 || url.MaxHits != 10 || !url.CreatedAt.Equal(original.CreatedAt) {
+				t.Errorf("Expected %+v, got %+v", original, url)
+			}
+			if url.ExpiresAt == nil || !url.ExpiresAt.Equal(expiresAt) {
+				t.Errorf("Expected expiry %v, got %v", expiresAt, url.ExpiresAt)
+			}
+			if url.Title != details.Title || url.Description != details.Description || strings.Join(url.Tags, "|") != "docs|team wiki" {
+				t.Errorf("Expected details %+v, got %+v", details, url.Details)
+			}
+			if url, _ := imported.Lookup(ctx, "alpha"); url == nil || url.Original != "https://example.com/a?x=1&y=<2>" {
+				t.Errorf("Unexpected imported URL: %+v", url)
+			}
+			if hits, _ := imported.GetTotalHits(ctx); hits != 3 {
+				t.Errorf("Expected 3 total hits, got %d", hits)
+			}
+		})
+	}
+
+	t.Run("conflict policies", func(t *testing.T) {
+		var exported bytes.Buffer
+		if err := runExport([]string{"--db-path", source}, &exported, io.Discard); err != nil {
+			t.Fatalf("Export failed: %v", err)
+		}
+
+		target := filepath.Join(t.TempDir(), "target.db")
+		existing, err := storage.NewSQLiteStore(target)
+		if err != nil {
+			t.Fatalf("Failed to create SQLite store: %v", err)
+		}
+		existing.CreateWithID(ctx, "beta", "https://example.com/existing")
+		existing.Close()
+
+		args := []string{"--db-path", target}
+		if err := runImport(args, bytes.NewReader(exported.Bytes()), io.Discard); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("Expected the default policy to fail on a conflict, got %v", err)
+		}
+
+		// Records before the conflict were imported, so now both collide
+		var log bytes.Buffer
+		if err := runImport(append(args, "--on-conflict", "skip"), bytes.NewReader(exported.Bytes()), &log); err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if !strings.Contains(log.String(), "2 skipped") {
+			t.Errorf("Unexpected import summary: %q", log.String())
+		}
+
+		log.Reset()
+		if err := runImport(append(args, "--on-conflict", "overwrite"), bytes.NewReader(exported.Bytes()), &log); err != nil {
+			t.Fatalf("Import failed: %v", err)
+		}
+		if !strings.Contains(log.String(), "2 overwritten") {
+			t.Errorf("Unexpected import summary: %q", log.String())
+		}
+
+		imported, err := storage.NewSQLiteStore(target)
+		if err != nil {
+			t.Fatalf("Failed to open SQLite store: %v", err)
+		}
+		defer imported.Close()
+		if url, _ := imported.Lookup(ctx, "beta"); url == nil || url.Original != "https://example.com/b" || url.Hits != 3 {
+			t.Errorf("Expected the exported URL to replace the existing one, got %+v", url)
+		}
+	})
+
+	t.Run("rejects bad input", func(t *testing.T) {
+		target := filepath.Join(t.TempDir(), "target.db")
+		err := runImport([]string{"--db-path", target, "--format", "csv"}, strings.NewReader("id,url\nx,y\n"), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "unexpected CSV header") {
+			t.Errorf("Expected a header error, got %v", err)
+		}
+		err = runImport([]string{"--db-path", target}, strings.NewReader("{\"id\":\"ok\",\"original\":\"https://example.com\"}\n{broken\n"), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "record 2") {
+			t.Errorf("Expected an error naming record 2, got %v", err)
+		}
+	})
+}